@@ -1,41 +1,263 @@
+// Package ability holds the player's special abilities. Each one is an Ability
+// registered under a name, and the player's Loadout runs whichever is selected,
+// paying for it with a shared energy meter.
 package ability
 
-import "fmt"
+import (
+	"fmt"
+	"rpg_demo/world"
+	"sort"
 
-type AbilityType int
+	"github.com/hajimehoshi/ebiten/v2"
+)
+
+// Ability is one special ability. Its hooks are called by the Loadout and the
+// player, an ability only implements what it needs by embedding Base.
+type Ability interface {
+	OnActivate(w *World)
+	OnTick(w *World, dt float64)
+	OnDeactivate(w *World)
+	// ModifyCollision gets whether the player's next step is blocked and
+	// returns whether it is with the ability active.
+	ModifyCollision(blocked bool) bool
+	// ModifyDraw changes how the player is drawn.
+	ModifyDraw(opts *ebiten.DrawImageOptions)
+}
+
+// Base does nothing for every hook.
+type Base struct{}
+
+func (Base) OnActivate(w *World)                      {}
+func (Base) OnTick(w *World, dt float64)              {}
+func (Base) OnDeactivate(w *World)                    {}
+func (Base) ModifyCollision(blocked bool) bool        { return blocked }
+func (Base) ModifyDraw(opts *ebiten.DrawImageOptions) {}
+
+// World is what abilities can do to everything but the player. The game
+// looks at it every tick.
+type World struct {
+	Frozen    bool // Time is stopped for everyone else
+	Rewinding bool // Time runs backwards, for everyone
+}
+
+// Spec describes an ability to the registry.
+type Spec struct {
+	Name     string
+	Order    int     // Where it comes when cycling
+	Cost     float64 // Energy needed to start it, and taken when it does
+	Drain    float64 // Energy per second while active
+	Duration float64 // Seconds it lasts once started, 0 for as long as the key is held
+	Cooldown float64 // Seconds after it ends before it can be used again
+	Ability  Ability
+}
+
+var registry = map[string]*Spec{}
+
+// Register adds an ability. Abilities register themselves from init.
+func Register(spec Spec) {
+	if _, ok := registry[spec.Name]; ok {
+		panic(fmt.Sprintf("ability %q registered twice", spec.Name))
+	}
+	registry[spec.Name] = &spec
+}
+
+// Lookup returns the registered ability called name, or nil.
+func Lookup(name string) *Spec {
+	return registry[name]
+}
+
+// Names returns every registered ability in cycling order.
+func Names() []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := registry[names[i]], registry[names[j]]
+		if a.Order != b.Order {
+			return a.Order < b.Order
+		}
+		return a.Name < b.Name
+	})
+	return names
+}
+
+// UnlockFlag is the world variable that makes an ability available, so
+// dialogue, cutscenes and saves can all unlock abilities.
+func UnlockFlag(name string) string {
+	return "ability." + name
+}
 
 const (
-	None AbilityType = iota
-	GhostMode
-	StopTime
-	MaxAbility
+	MaxEnergy   = 100.0
+	EnergyRegen = 10.0 // Energy recovered per second while no ability is active
 )
 
-type Ability struct {
-	Type      AbilityType
-	Activated bool
+// Loadout is the player's abilities: which one is selected, which one is
+// running and what's left of the energy meter.
+type Loadout struct {
+	Selected  string // Name of the selected ability, "" for none
+	Active    string // Name of the running ability, "" for none
+	Elapsed   float64
+	Energy    float64
+	Cooldowns map[string]float64 // Seconds until each ability can be used again
+	World     World
+	Vars      *world.Vars // Checked for unlocks, nil unlocks everything
+}
+
+func NewLoadout() *Loadout {
+	return &Loadout{
+		Energy:    MaxEnergy,
+		Cooldowns: make(map[string]float64),
+	}
+}
+
+// Unlocked reports whether the named ability is available to the player.
+func (l *Loadout) Unlocked(name string) bool {
+	if registry[name] == nil {
+		return false
+	}
+	return l.Vars == nil || l.Vars.Bool(UnlockFlag(name))
 }
 
-func (a *Ability) CycleAbility() {
-	// Increment the current ability type
-	a.Type++
+// Cycle selects the next unlocked ability, stopping the running one.
+func (l *Loadout) Cycle() {
+	l.Deactivate()
+	var unlocked []string
+	for _, name := range Names() {
+		if l.Unlocked(name) {
+			unlocked = append(unlocked, name)
+		}
+	}
+	if len(unlocked) == 0 {
+		l.Selected = ""
+		return
+	}
+	next := 0
+	for i, name := range unlocked {
+		if name == l.Selected {
+			next = (i + 1) % len(unlocked)
+		}
+	}
+	l.Selected = unlocked[next]
+}
 
-	// Check if we've exceeded the bounds of defined abilities, excluding MaxAbility
-	if a.Type >= MaxAbility {
-		a.Type = None + 1 // Assuming you want to skip 'None'. If not, just reset to None.
+// Activate starts the selected ability if it's off cooldown and there is
+// enough energy.
+func (l *Loadout) Activate() {
+	spec := registry[l.Selected]
+	if spec == nil || l.Active != "" || l.Cooldowns[spec.Name] > 0 {
+		return
+	}
+	if l.Energy < spec.Cost || l.Energy <= 0 {
+		return
 	}
+	l.Energy -= spec.Cost
+	l.Active = spec.Name
+	l.Elapsed = 0
+	spec.Ability.OnActivate(&l.World)
+}
 
-	a.Activated = false // Reset the active state when cycling
-	fmt.Println(a.Type)
+// Deactivate stops the running ability and starts its cooldown.
+func (l *Loadout) Deactivate() {
+	spec := registry[l.Active]
+	if spec == nil {
+		l.Active = ""
+		return
+	}
+	spec.Ability.OnDeactivate(&l.World)
+	l.Active = ""
+	l.Elapsed = 0
+	if spec.Cooldown > 0 {
+		l.Cooldowns[spec.Name] = spec.Cooldown
+	}
 }
 
-func (a *Ability) ActivateAbility() {
-	fmt.Println("Activated")
-	if a.Type != None {
-		a.Activated = true
+// Update runs the abilities for dt seconds. held is whether the ability key is
+// down and pressed whether it went down this tick. Abilities with a duration
+// start on a press and a second press ends them early, the others run while
+// the key is held. Either way they end when the energy runs out.
+func (l *Loadout) Update(dt float64, held, pressed bool) {
+	for name, left := range l.Cooldowns {
+		if left -= dt; left > 0 {
+			l.Cooldowns[name] = left
+		} else {
+			delete(l.Cooldowns, name)
+		}
+	}
+	if l.Selected != "" && !l.Unlocked(l.Selected) {
+		l.Deactivate()
+		l.Selected = ""
+	}
+	if l.Selected == "" {
+		// Pick up the first ability as soon as one is unlocked
+		l.Cycle()
+	}
+
+	if spec := registry[l.Active]; spec != nil {
+		l.Elapsed += dt
+		l.Energy -= spec.Drain * dt
+		spec.Ability.OnTick(&l.World, dt)
+		over := l.Energy <= 0
+		if spec.Duration > 0 {
+			over = over || l.Elapsed >= spec.Duration || pressed
+		} else {
+			over = over || !held
+		}
+		if over {
+			if l.Energy < 0 {
+				l.Energy = 0
+			}
+			l.Deactivate()
+		}
+	} else if spec := registry[l.Selected]; spec != nil {
+		if spec.Duration > 0 && pressed || spec.Duration == 0 && held {
+			l.Activate()
+		}
+	}
+
+	if l.Active == "" {
+		l.Energy += EnergyRegen * dt
+		if l.Energy > MaxEnergy {
+			l.Energy = MaxEnergy
+		}
+	}
+}
+
+// Restore puts the loadout back the way a save left it, running the
+// ability's OnActivate so its effects on the world come back too.
+func (l *Loadout) Restore(selected, active string, elapsed, energy float64, cooldowns map[string]float64) {
+	l.Deactivate()
+	l.World = World{}
+	l.Selected = selected
+	l.Energy = energy
+	l.Cooldowns = make(map[string]float64, len(cooldowns))
+	for name, left := range cooldowns {
+		l.Cooldowns[name] = left
+	}
+	if spec := registry[active]; spec != nil {
+		l.Active = active
+		l.Elapsed = elapsed
+		spec.Ability.OnActivate(&l.World)
 	}
 }
 
-func (a *Ability) DeactivateAbility() {
-	a.Activated = false
+// Is reports whether the named ability is running.
+func (l *Loadout) Is(name string) bool {
+	return l.Active == name
+}
+
+// ModifyCollision lets the running ability change whether the player is blocked.
+func (l *Loadout) ModifyCollision(blocked bool) bool {
+	if spec := registry[l.Active]; spec != nil {
+		return spec.Ability.ModifyCollision(blocked)
+	}
+	return blocked
+}
+
+// ModifyDraw lets the running ability change how the player is drawn.
+func (l *Loadout) ModifyDraw(opts *ebiten.DrawImageOptions) {
+	if spec := registry[l.Active]; spec != nil {
+		spec.Ability.ModifyDraw(opts)
+	}
 }
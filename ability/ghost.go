@@ -0,0 +1,27 @@
+package ability
+
+import "github.com/hajimehoshi/ebiten/v2"
+
+const GhostMode = "ghostMode"
+
+func init() {
+	Register(Spec{
+		Name:     GhostMode,
+		Order:    1,
+		Drain:    20,
+		Cooldown: 1,
+		Ability:  ghost{},
+	})
+}
+
+// ghost lets the player walk through walls, see-through, for as long as the
+// key is held.
+type ghost struct{ Base }
+
+func (ghost) ModifyCollision(blocked bool) bool {
+	return false
+}
+
+func (ghost) ModifyDraw(opts *ebiten.DrawImageOptions) {
+	opts.ColorScale.ScaleAlpha(0.5)
+}
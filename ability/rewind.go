@@ -0,0 +1,25 @@
+package ability
+
+const Rewind = "rewind"
+
+func init() {
+	Register(Spec{
+		Name:     Rewind,
+		Order:    3,
+		Drain:    15,
+		Cooldown: 2,
+		Ability:  rewind{},
+	})
+}
+
+// rewind plays the last few seconds backwards for as long as the key is held.
+// The game keeps the history and does the rewinding.
+type rewind struct{ Base }
+
+func (rewind) OnActivate(w *World) {
+	w.Rewinding = true
+}
+
+func (rewind) OnDeactivate(w *World) {
+	w.Rewinding = false
+}
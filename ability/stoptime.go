@@ -0,0 +1,27 @@
+package ability
+
+const StopTime = "stopTime"
+
+func init() {
+	Register(Spec{
+		Name:     StopTime,
+		Order:    2,
+		Cost:     20,
+		Drain:    8,
+		Duration: 5,
+		Cooldown: 3,
+		Ability:  stopTime{},
+	})
+}
+
+// stopTime freezes everything but the player for a few seconds. The game
+// does the freezing, this only tells it to.
+type stopTime struct{ Base }
+
+func (stopTime) OnActivate(w *World) {
+	w.Frozen = true
+}
+
+func (stopTime) OnDeactivate(w *World) {
+	w.Frozen = false
+}
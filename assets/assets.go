@@ -0,0 +1,231 @@
+// Package assets loads the game's files by name, relative to the assets
+// directory, and shares whatever has been decoded between everyone who asks
+// for the same file.
+package assets
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/png" // Sprites and maps are PNGs
+	"io"
+	"io/fs"
+	"path"
+	"strconv"
+	"sync"
+
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/audio/mp3"
+	"github.com/hajimehoshi/ebiten/v2/audio/wav"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+)
+
+// DefaultFont is built into the binary, it doesn't have to be in the assets directory.
+const DefaultFont = "goregular.ttf"
+
+var builtinFonts = map[string][]byte{
+	DefaultFont: goregular.TTF,
+}
+
+// Manager caches decoded assets. Every Image, Font or Audio call takes a
+// reference that has to be given back with Release; once nobody holds an
+// asset anymore it's dropped from the cache.
+type Manager struct {
+	FS      fs.FS
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+type entry struct {
+	value interface{}
+	refs  int
+}
+
+func New(fsys fs.FS) *Manager {
+	return &Manager{
+		FS:      fsys,
+		entries: make(map[string]*entry),
+	}
+}
+
+// Open opens a file for reading without caching it, for files that are only
+// read once such as scene data.
+func (m *Manager) Open(name string) (fs.File, error) {
+	if m.FS == nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return m.FS.Open(name)
+}
+
+// get returns the cached value for key, or calls load to fill the cache.
+func (m *Manager) get(key string, load func() (interface{}, error)) (interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.entries[key]; ok {
+		e.refs++
+		return e.value, nil
+	}
+	value, err := load()
+	if err != nil {
+		return nil, err
+	}
+	m.entries[key] = &entry{value: value, refs: 1}
+	return value, nil
+}
+
+func (m *Manager) release(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[key]
+	if !ok {
+		return
+	}
+	e.refs--
+	if e.refs <= 0 {
+		// Images aren't disposed, something may still be drawing them. The
+		// garbage collector frees them once the last user lets go.
+		delete(m.entries, key)
+	}
+}
+
+// Loaded returns the number of assets in the cache.
+func (m *Manager) Loaded() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.entries)
+}
+
+func (m *Manager) readFile(name string) ([]byte, error) {
+	f, err := m.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+func imageKey(name string) string { return "image:" + name }
+
+func fontKey(name string, size float64) string {
+	return "font:" + name + "@" + strconv.FormatFloat(size, 'g', -1, 64)
+}
+
+func audioKey(name string, sampleRate int) string {
+	return "audio:" + name + "@" + strconv.Itoa(sampleRate)
+}
+
+// Image decodes a PNG.
+func (m *Manager) Image(name string) (*ebiten.Image, error) {
+	v, err := m.get(imageKey(name), func() (interface{}, error) {
+		b, err := m.readFile(name)
+		if err != nil {
+			return nil, err
+		}
+		img, _, err := image.Decode(bytes.NewReader(b))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		return ebiten.NewImageFromImage(img), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*ebiten.Image), nil
+}
+
+func (m *Manager) ReleaseImage(name string) {
+	m.release(imageKey(name))
+}
+
+// Font loads a TrueType or OpenType font at the given size. Built in fonts
+// such as DefaultFont are used when the file isn't in the assets directory.
+func (m *Manager) Font(name string, size float64) (font.Face, error) {
+	v, err := m.get(fontKey(name, size), func() (interface{}, error) {
+		b, err := m.readFile(name)
+		if builtin, ok := builtinFonts[name]; ok && err != nil {
+			b, err = builtin, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := opentype.Parse(b)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		return opentype.NewFace(parsed, &opentype.FaceOptions{
+			Size:    size,
+			DPI:     72,
+			Hinting: font.HintingNone,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(font.Face), nil
+}
+
+func (m *Manager) ReleaseFont(name string, size float64) {
+	m.release(fontKey(name, size))
+}
+
+// Audio decodes an MP3 or WAV file into 16 bit stereo PCM at the given sample
+// rate, ready for audio.Context.NewPlayerFromBytes.
+func (m *Manager) Audio(name string, sampleRate int) ([]byte, error) {
+	v, err := m.get(audioKey(name, sampleRate), func() (interface{}, error) {
+		b, err := m.readFile(name)
+		if err != nil {
+			return nil, err
+		}
+		var stream io.Reader
+		switch path.Ext(name) {
+		case ".mp3":
+			stream, err = mp3.DecodeWithSampleRate(sampleRate, bytes.NewReader(b))
+		case ".wav":
+			stream, err = wav.DecodeWithSampleRate(sampleRate, bytes.NewReader(b))
+		default:
+			return nil, fmt.Errorf("%s: unsupported audio format", name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		return io.ReadAll(stream)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]byte), nil
+}
+
+func (m *Manager) ReleaseAudio(name string, sampleRate int) {
+	m.release(audioKey(name, sampleRate))
+}
+
+// Group remembers what it loaded so an owner, such as a scene, can give it
+// all back at once when it goes away.
+type Group struct {
+	m    *Manager
+	keys []string
+}
+
+func (m *Manager) Group() *Group {
+	return &Group{m: m}
+}
+
+// Image is Manager.Image, released along with the rest of the group.
+func (g *Group) Image(name string) (*ebiten.Image, error) {
+	img, err := g.m.Image(name)
+	if err == nil {
+		g.keys = append(g.keys, imageKey(name))
+	}
+	return img, err
+}
+
+// Release gives back everything the group loaded.
+func (g *Group) Release() {
+	for _, key := range g.keys {
+		g.m.release(key)
+	}
+	g.keys = nil
+}
@@ -0,0 +1,30 @@
+//go:build !release
+
+package assets
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// FS reads assets straight from disk so edits show up without a rebuild.
+// Release builds embed them instead, see embed.go.
+func FS() fs.FS {
+	return os.DirFS(Dir())
+}
+
+// Dir finds the assets directory: $RPG_ASSETS if set, otherwise ./assets if it
+// exists, otherwise the assets directory next to the executable.
+func Dir() string {
+	if dir := os.Getenv("RPG_ASSETS"); dir != "" {
+		return dir
+	}
+	if info, err := os.Stat("assets"); err == nil && info.IsDir() {
+		return "assets"
+	}
+	if exe, err := os.Executable(); err == nil {
+		return filepath.Join(filepath.Dir(exe), "assets")
+	}
+	return "assets"
+}
@@ -0,0 +1,19 @@
+//go:build release
+
+package assets
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// Music isn't checked in, add its extensions here when it is.
+//
+//go:embed *.png *.json *.evt
+var files embed.FS
+
+// FS serves the assets compiled into the binary, so a release build runs from
+// any directory.
+func FS() fs.FS {
+	return files
+}
@@ -0,0 +1,207 @@
+// Package camera decides which part of the world is on screen. The game moves
+// it once per Update and everything in the world is drawn through its
+// Transform, so the background, the characters and the foreground always agree.
+package camera
+
+import (
+	"math"
+
+	"github.com/hajimehoshi/ebiten/v2"
+)
+
+type Camera struct {
+	X, Y             float64 // World point at the middle of the screen, before shaking
+	Zoom             float64 // 2 shows everything twice as big
+	ScreenW, ScreenH float64
+	WorldW, WorldH   float64 // The camera never shows past the world, 0 for no limit
+	Smoothing        float64 // How fast the camera catches up with what it follows, per second, 0 for at once
+	DeadZoneW        float64 // Size of the box around the middle the followed point can move in
+	DeadZoneH        float64 // without the camera moving, in world pixels
+
+	followX, followY float64
+	pan              *move // Explicit target, overrides following until Release
+	zoom             *move // Zoom going towards a target, X only
+	shake            shake
+}
+
+// move is a value going towards a target at a fixed speed.
+type move struct {
+	X, Y  float64
+	Speed float64
+}
+
+type shake struct {
+	Intensity float64 // Largest offset in pixels, fades out over Duration
+	Duration  float64
+	Left      float64 // Seconds left
+	Time      float64
+}
+
+func New(screenW, screenH float64) *Camera {
+	return &Camera{
+		Zoom:      1,
+		ScreenW:   screenW,
+		ScreenH:   screenH,
+		Smoothing: 8,
+		DeadZoneW: 40,
+		DeadZoneH: 30,
+	}
+}
+
+// Follow sets the point the camera keeps on screen, usually the player. It
+// takes effect in Update.
+func (c *Camera) Follow(x, y float64) {
+	c.followX, c.followY = x, y
+}
+
+// Snap jumps straight to the followed point, for when smoothly moving there
+// would look wrong, like after going through a door.
+func (c *Camera) Snap() {
+	c.X, c.Y = c.followX, c.followY
+	c.X, c.Y = c.clamp(c.X, c.Y)
+}
+
+// PanTo moves the middle of the screen to x, y at speed pixels per second and
+// keeps it there, ignoring what the camera follows until Release. A speed of 0
+// cuts straight there.
+func (c *Camera) PanTo(x, y, speed float64) {
+	c.pan = &move{X: x, Y: y, Speed: speed}
+}
+
+// Release goes back to following after PanTo.
+func (c *Camera) Release() {
+	c.pan = nil
+}
+
+// Panning reports whether a pan hasn't reached its target yet.
+func (c *Camera) Panning() bool {
+	if c.pan == nil {
+		return false
+	}
+	x, y := c.clamp(c.pan.X, c.pan.Y)
+	return c.X != x || c.Y != y
+}
+
+// ZoomTo changes the zoom to zoom, by speed per second. A speed of 0 zooms at
+// once.
+func (c *Camera) ZoomTo(zoom, speed float64) {
+	if speed <= 0 {
+		c.Zoom = zoom
+		c.zoom = nil
+		return
+	}
+	c.zoom = &move{X: zoom, Speed: speed}
+}
+
+// Zooming reports whether a ZoomTo is still under way.
+func (c *Camera) Zooming() bool {
+	return c.zoom != nil
+}
+
+// Shake shakes the screen by up to intensity pixels for duration seconds,
+// calming down towards the end.
+func (c *Camera) Shake(intensity, duration float64) {
+	c.shake = shake{Intensity: intensity, Duration: duration, Left: duration}
+}
+
+// Shaking reports whether a Shake is still going.
+func (c *Camera) Shaking() bool {
+	return c.shake.Left > 0
+}
+
+// Update moves the camera for dt seconds.
+func (c *Camera) Update(dt float64) {
+	if c.zoom != nil {
+		c.Zoom = approach(c.Zoom, c.zoom.X, c.zoom.Speed*dt)
+		if c.Zoom == c.zoom.X {
+			c.zoom = nil
+		}
+	}
+
+	if c.pan != nil {
+		x, y := c.clamp(c.pan.X, c.pan.Y)
+		dx, dy := x-c.X, y-c.Y
+		dist := math.Hypot(dx, dy)
+		if step := c.pan.Speed * dt; dist <= step || c.pan.Speed <= 0 {
+			c.X, c.Y = x, y
+		} else {
+			c.X += dx / dist * step
+			c.Y += dy / dist * step
+		}
+	} else {
+		// Only chase the followed point once it leaves the dead zone
+		x, y := c.X, c.Y
+		if d := c.followX - c.X; math.Abs(d) > c.DeadZoneW/2 {
+			x = c.followX - math.Copysign(c.DeadZoneW/2, d)
+		}
+		if d := c.followY - c.Y; math.Abs(d) > c.DeadZoneH/2 {
+			y = c.followY - math.Copysign(c.DeadZoneH/2, d)
+		}
+		x, y = c.clamp(x, y)
+		if c.Smoothing <= 0 {
+			c.X, c.Y = x, y
+		} else {
+			// Close the same share of the gap every second whatever the tick rate
+			t := 1 - math.Exp(-c.Smoothing*dt)
+			c.X += (x - c.X) * t
+			c.Y += (y - c.Y) * t
+		}
+		c.X, c.Y = c.clamp(c.X, c.Y)
+	}
+
+	if c.shake.Left > 0 {
+		c.shake.Left -= dt
+		c.shake.Time += dt
+	}
+}
+
+// approach moves v towards target by at most step.
+func approach(v, target, step float64) float64 {
+	if math.Abs(target-v) <= step {
+		return target
+	}
+	return v + math.Copysign(step, target-v)
+}
+
+// clamp keeps the view inside the world, centering it on worlds smaller than
+// the screen.
+func (c *Camera) clamp(x, y float64) (float64, float64) {
+	viewW, viewH := c.ScreenW/c.Zoom, c.ScreenH/c.Zoom
+	clamp := func(v, view, world float64) float64 {
+		if world <= 0 {
+			return v
+		}
+		if world <= view {
+			return world / 2
+		}
+		return math.Min(math.Max(v, view/2), world-view/2)
+	}
+	return clamp(x, viewW, c.WorldW), clamp(y, viewH, c.WorldH)
+}
+
+// offset returns how far the shake moves the view right now. It's made of
+// sines rather than random numbers so replays draw the same frames.
+func (c *Camera) offset() (float64, float64) {
+	if c.shake.Left <= 0 || c.shake.Duration <= 0 {
+		return 0, 0
+	}
+	strength := c.shake.Intensity * c.shake.Left / c.shake.Duration
+	t := c.shake.Time
+	return strength * math.Sin(t*53), strength * math.Sin(t*41+1)
+}
+
+// Transform returns the world to screen transform.
+func (c *Camera) Transform() ebiten.GeoM {
+	ox, oy := c.offset()
+	var m ebiten.GeoM
+	m.Translate(-(c.X + ox), -(c.Y + oy))
+	m.Scale(c.Zoom, c.Zoom)
+	m.Translate(c.ScreenW/2, c.ScreenH/2)
+	return m
+}
+
+// ToScreen converts a world position to a screen position.
+func (c *Camera) ToScreen(x, y float64) (float64, float64) {
+	m := c.Transform()
+	return m.Apply(x, y)
+}
@@ -0,0 +1,34 @@
+// Package clock keeps the simulation time. The game steps it once per Update
+// and everything that moves or counts down uses its Delta, in seconds, instead
+// of counting ticks, so the game plays the same at any tick rate.
+package clock
+
+// DefaultTPS is ebiten's default tick rate, which the per-tick values in old
+// content and saves were written for.
+const DefaultTPS = 60
+
+type Clock struct {
+	TPS   int     // Updates per second
+	Scale float64 // How fast game time runs, 1 is normal, 0.5 slow motion, 0 frozen
+	Time  float64 // Game seconds since start, scaled
+	delta float64
+}
+
+func New(tps int) *Clock {
+	if tps <= 0 {
+		tps = DefaultTPS
+	}
+	return &Clock{TPS: tps, Scale: 1}
+}
+
+// Step advances the clock by one fixed tick. The step is always 1/TPS real
+// seconds, so the simulation stays deterministic, and Scale stretches it.
+func (c *Clock) Step() {
+	c.delta = c.Scale / float64(c.TPS)
+	c.Time += c.delta
+}
+
+// Delta returns the game seconds the current tick covers.
+func (c *Clock) Delta() float64 {
+	return c.delta
+}
@@ -0,0 +1,388 @@
+// Command validate checks scene files for mistakes the game would only trip
+// over at runtime, or not notice at all.
+//
+//	go run ./cmd/validate [scene.json | map.tmj | map.tmx | dir]...
+//
+// With no arguments it checks every scene in ./assets. A Tiled map is checked
+// together with the scene JSON next to it, the way the game loads them, and
+// cutscene scripts together with the scene that names them. It prints one line per
+// problem and exits with status 1 if there were any.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"rpg_demo/collisions"
+	"rpg_demo/cutscene"
+	"rpg_demo/data"
+	"rpg_demo/npc"
+	"rpg_demo/tiled"
+	"rpg_demo/trigger"
+	"rpg_demo/world"
+	"sort"
+	"strings"
+)
+
+// Size of the player's collision box, see player.New
+const (
+	playerWidth  = 192 / 4
+	playerHeight = 68
+)
+
+type validator struct {
+	problems []string
+	scenes   map[string]*data.Data // Every scene that loaded, by name, for door checks
+	library  map[string]bool       // Ids of the shared cutscenes, for Call checks
+}
+
+func (v *validator) report(file, path, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if path != "" {
+		msg = path + ": " + msg
+	}
+	v.problems = append(v.problems, file+": "+msg)
+}
+
+func main() {
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		args = []string{"assets"}
+	}
+
+	var files []string
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		if !info.IsDir() {
+			files = append(files, arg)
+			continue
+		}
+		for _, pattern := range []string{"*.json", "*.tmj", "*.tmx"} {
+			matches, err := filepath.Glob(filepath.Join(arg, pattern))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+			files = append(files, matches...)
+		}
+	}
+	files = dropSidecars(files)
+	sort.Strings(files)
+
+	v := &validator{scenes: make(map[string]*data.Data), library: make(map[string]bool)}
+	loaded := make(map[string]*data.Data)
+	for _, file := range files {
+		if filepath.Base(file) == cutscene.LibraryFile {
+			continue
+		}
+		if d := v.load(file); d != nil {
+			loaded[file] = d
+			v.scenes[sceneName(file)] = d
+		}
+	}
+	for _, file := range files {
+		if filepath.Base(file) == cutscene.LibraryFile {
+			v.checkLibrary(file)
+		}
+	}
+	for _, file := range files {
+		if d, ok := loaded[file]; ok {
+			v.check(file, d)
+		}
+	}
+
+	for _, p := range v.problems {
+		fmt.Println(p)
+	}
+	if len(v.problems) > 0 {
+		fmt.Printf("%d problem(s) in %d file(s)\n", len(v.problems), len(files))
+		os.Exit(1)
+	}
+	fmt.Printf("%d file(s) OK\n", len(files))
+}
+
+func sceneName(file string) string {
+	return strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+}
+
+// sceneFiles are the files a scene can be loaded from, in the order the game tries them.
+var sceneFiles = []string{".tmj", ".tmx", ".json"}
+
+// dropSidecars removes scene JSON files that belong to a Tiled map, they are
+// checked along with the map.
+func dropSidecars(files []string) []string {
+	var kept []string
+	for _, file := range files {
+		base := strings.TrimSuffix(file, filepath.Ext(file))
+		if filepath.Ext(file) == ".json" && (exists(base+".tmj") || exists(base+".tmx")) {
+			continue
+		}
+		kept = append(kept, file)
+	}
+	return kept
+}
+
+func exists(file string) bool {
+	_, err := os.Stat(file)
+	return err == nil
+}
+
+// load decodes a scene, reporting syntax errors and fields the game doesn't know about.
+func (v *validator) load(file string) *data.Data {
+	if !tiled.IsMap(file) {
+		return v.loadJSON(file)
+	}
+	d := &data.Data{}
+	if sidecar := strings.TrimSuffix(file, filepath.Ext(file)) + ".json"; exists(sidecar) {
+		if d = v.loadJSON(sidecar); d == nil {
+			return nil
+		}
+	}
+	m, err := tiled.Load(os.DirFS(filepath.Dir(file)), filepath.Base(file))
+	if err != nil {
+		v.report(file, "", "%s", strings.TrimPrefix(err.Error(), filepath.Base(file)+": "))
+		return nil
+	}
+	if err := m.Apply(d); err != nil {
+		v.report(file, "", "%s", err)
+		return nil
+	}
+	for _, ts := range m.Tilesets {
+		v.checkImage(file, "tileset "+ts.Name, filepath.Dir(file), ts.Image)
+	}
+	return d
+}
+
+func (v *validator) loadJSON(file string) *data.Data {
+	d, err := data.Load(file)
+	if err != nil {
+		v.report(file, "", "%s", strings.TrimPrefix(err.Error(), file+": "))
+		return nil
+	}
+	// Decode again strictly, a misspelled field silently loads as zero otherwise
+	b, err := os.ReadFile(file)
+	if err != nil {
+		v.report(file, "", "%s", err)
+		return d
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&data.Data{}); err != nil {
+		v.report(file, "", "%s", err)
+	}
+	// Scripts are checked like the actions they turn into
+	if err := cutscene.LoadScripts(os.DirFS(filepath.Dir(file)), d.Cutscenes); err != nil {
+		v.report(file, "", "%s", err)
+	}
+	return d
+}
+
+func (v *validator) check(file string, d *data.Data) {
+	dir := filepath.Dir(file)
+	for i, obs := range d.Obstacles {
+		r := image.Rect(obs.X1, obs.Y1, obs.X2, obs.Y2)
+		if r.Empty() {
+			v.report(file, fmt.Sprintf("obstacles[%d]", i), "has no area (%d,%d)-(%d,%d)", obs.X1, obs.Y1, obs.X2, obs.Y2)
+		}
+	}
+	for i, diag := range d.Diagonals {
+		path := fmt.Sprintf("diagonals[%d]", i)
+		if diag.Count <= 0 {
+			v.report(file, path, "count is %d, must be positive", diag.Count)
+		}
+		if diag.Width == 0 || diag.Height == 0 {
+			v.report(file, path, "steps have no area (%dx%d)", diag.Width, diag.Height)
+		}
+	}
+	for i, door := range d.Doors {
+		v.checkDoor(file, fmt.Sprintf("doors[%d]", i), door)
+	}
+	npcs := make(map[string]bool)
+	for i, n := range d.NPCs {
+		path := fmt.Sprintf("npcs[%d]", i)
+		if n.Name == "" {
+			v.report(file, path, "has no name")
+		} else if npcs[n.Name] {
+			v.report(file, path, "duplicate NPC name %q", n.Name)
+		}
+		npcs[n.Name] = true
+		if n.FrameCount <= 0 {
+			v.report(file, path, "frameCount is %d, must be positive", n.FrameCount)
+		}
+		if len(n.SpriteSheets) == 0 {
+			v.report(file, path, "has no sprite sheets")
+		}
+		for _, direction := range sortedKeys(n.SpriteSheets) {
+			v.checkImage(file, fmt.Sprintf("%s.spriteSheets.%s", path, direction), dir, n.SpriteSheets[direction])
+		}
+		if n.Image == "" {
+			v.report(file, path+".image", "no portrait image")
+		} else {
+			v.checkImage(file, path+".image", dir, n.Image)
+		}
+		for _, expression := range sortedKeys(n.Portraits) {
+			v.checkImage(file, fmt.Sprintf("%s.portraits.%s", path, expression), dir, n.Portraits[expression])
+		}
+		if err := npc.CheckBehaviors(&n); err != nil {
+			v.report(file, path+".behaviors", "%s", err)
+		}
+	}
+	ids := v.checkCutscenes(file, d.Cutscenes, npcs)
+	triggers := make(map[string]bool)
+	for i, t := range d.Triggers {
+		path := fmt.Sprintf("triggers[%d]", i)
+		if t.ID != "" {
+			if triggers[t.ID] {
+				v.report(file, path, "duplicate trigger id %q", t.ID)
+			}
+			triggers[t.ID] = true
+		}
+		v.checkTrigger(file, path, t, ids, npcs)
+	}
+}
+
+func (v *validator) checkTrigger(file, path string, t data.TriggerData, cutscenes, npcs map[string]bool) {
+	switch trigger.Event(t.On) {
+	case "", trigger.Enter, trigger.Exit:
+		if image.Rect(t.X1, t.Y1, t.X2, t.Y2).Empty() {
+			v.report(file, path, "has no area (%d,%d)-(%d,%d)", t.X1, t.Y1, t.X2, t.Y2)
+		}
+	case trigger.Interact:
+		if !npcs[t.NPC] {
+			v.report(file, path+".npc", "no NPC %q in the scene", t.NPC)
+		}
+	case trigger.SceneEntry:
+	case trigger.Flag:
+		if t.Condition == "" {
+			v.report(file, path+".condition", "flag trigger has no condition")
+		}
+	default:
+		v.report(file, path+".on", "unknown event %q", t.On)
+	}
+	if t.Condition != "" {
+		if _, err := world.Parse(t.Condition); err != nil {
+			v.report(file, path+".condition", "%s", err)
+		}
+	}
+	if !cutscenes[t.Cutscene] {
+		v.report(file, path+".cutscene", "no cutscene %q in the scene", t.Cutscene)
+	}
+}
+
+func (v *validator) checkDoor(file, path string, door data.DoorData) {
+	if image.Rect(door.X1, door.Y1, door.X2, door.Y2).Empty() {
+		v.report(file, path, "has no area (%d,%d)-(%d,%d)", door.X1, door.Y1, door.X2, door.Y2)
+	}
+	if door.Condition != "" {
+		if _, err := world.Parse(door.Condition); err != nil {
+			v.report(file, path+".condition", "%s", err)
+		}
+	}
+	if door.Destination == "" {
+		v.report(file, path, "has no destination")
+		return
+	}
+	dest, ok := v.scenes[door.Destination]
+	if !ok {
+		found := false
+		for _, ext := range sceneFiles {
+			found = found || exists(filepath.Join(filepath.Dir(file), door.Destination+ext))
+		}
+		if !found {
+			v.report(file, path+".destination", "no scene file for %s", door.Destination)
+		}
+		// Exists but wasn't checked or didn't load, nothing more to say about it here
+		return
+	}
+	// The player's position is the center of its box
+	x, y := int(door.NewX), int(door.NewY)
+	box := image.Rect(x-playerWidth/2, y-playerHeight/2, x+playerWidth-playerWidth/2, y+playerHeight-playerHeight/2)
+	for _, obs := range collisions.Obstacles(dest) {
+		if !box.Intersect(*obs).Empty() {
+			v.report(file, path, "player lands at (%v,%v) in %s, inside obstacle %v", door.NewX, door.NewY, door.Destination, *obs)
+			break
+		}
+	}
+}
+
+func (v *validator) checkImage(file, path, dir, name string) {
+	if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+		v.report(file, path, "missing image %s", name)
+	}
+}
+
+// checkTargets reports actions aimed at NPCs the scene doesn't have.
+// checkCutscenes checks a file's cutscenes and returns their ids. NPC targets
+// are only checked when npcs isn't nil.
+func (v *validator) checkCutscenes(file string, list []data.CutsceneData, npcs map[string]bool) map[string]bool {
+	ids := make(map[string]bool)
+	for i, c := range list {
+		path := fmt.Sprintf("cutscenes[%d]", i)
+		if c.ID == "" {
+			v.report(file, path, "has no id")
+		} else if ids[c.ID] {
+			v.report(file, path, "duplicate cutscene id %q", c.ID)
+		}
+		ids[c.ID] = true
+	}
+	for i, c := range list {
+		path := fmt.Sprintf("cutscenes[%d].actions", i)
+		actions, err := cutscene.DecodeActions(c.Actions)
+		if err != nil {
+			v.report(file, path, "%s", err)
+			continue
+		}
+		v.checkTargets(file, path, actions, npcs, ids)
+	}
+	return ids
+}
+
+// checkLibrary checks the shared cutscenes. Their NPCs depend on the scene
+// that calls them, so only the rest is checked.
+func (v *validator) checkLibrary(file string) {
+	d := v.loadJSON(file)
+	if d == nil {
+		return
+	}
+	if len(d.Obstacles)+len(d.Diagonals)+len(d.Doors)+len(d.NPCs)+len(d.Triggers) > 0 || d.Music != "" {
+		v.report(file, "", "only cutscenes are used from the shared cutscenes")
+	}
+	v.library = v.checkCutscenes(file, d.Cutscenes, nil)
+}
+
+func (v *validator) checkTargets(file, path string, actions []cutscene.CutsceneAction, npcs, calls map[string]bool) {
+	for i, action := range actions {
+		actionPath := fmt.Sprintf("%s[%d]", path, i)
+		kind := action.ActionType.TargetKind()
+		if kind == cutscene.CharacterTarget && action.TargetID == cutscene.PlayerTarget.TargetName() {
+			kind = cutscene.PlayerTarget
+		}
+		if (kind == cutscene.NPCTarget || kind == cutscene.CharacterTarget) && npcs != nil && !npcs[action.TargetID] {
+			v.report(file, actionPath, "%s targets unknown NPC %q", action.ActionType, action.TargetID)
+		}
+		if p, ok := action.Params.(*cutscene.CallParams); ok && !calls[p.Cutscene] && !v.library[p.Cutscene] {
+			v.report(file, actionPath, "calls unknown cutscene %q", p.Cutscene)
+		}
+		for _, b := range action.Blocks() {
+			v.checkTargets(file, actionPath+"."+b.Name, b.Actions, npcs, calls)
+		}
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -1,8 +1,10 @@
 package collisions
 
 import (
+	"fmt"
 	"image"
 	"rpg_demo/data"
+	"rpg_demo/world"
 )
 
 type Door struct {
@@ -10,19 +12,85 @@ type Door struct {
 	Id          string
 	Destination string
 	NewX, NewY  float64
+	Condition   *world.Cond // Locked unless this holds, nil means always open
 }
 
+// Collisions holds what the player can bump into in a scene. Queries go
+// through a grid index built by New, so the lists shouldn't be changed afterwards.
 type Collisions struct {
 	Obstacles []*image.Rectangle
 	Doors     []*Door
+	obstacles *Index
+	doors     *Index
 }
 
-func New(data *data.Data) Collisions {
+func New(data *data.Data) (Collisions, error) {
 
-	collisions := Collisions{}
+	collisions := Collisions{Obstacles: Obstacles(data)}
+	for _, d := range data.Doors {
+		i := image.Rect(d.X1, d.Y1, d.X2, d.Y2)
+		door := &Door{
+			Rect:        &i,
+			Id:          d.Id,
+			Destination: d.Destination,
+			NewX:        d.NewX,
+			NewY:        d.NewY,
+		}
+		if d.Condition != "" {
+			cond, err := world.Parse(d.Condition)
+			if err != nil {
+				return Collisions{}, fmt.Errorf("door %s: %w", d.Id, err)
+			}
+			door.Condition = cond
+		}
+		collisions.Doors = append(collisions.Doors, door)
+	}
+
+	collisions.obstacles = NewIndex(CellSize, collisions.Obstacles)
+	var rects []*image.Rectangle
+	for _, d := range collisions.Doors {
+		rects = append(rects, d.Rect)
+	}
+	collisions.doors = NewIndex(CellSize, rects)
+	return collisions, nil
+}
+
+// Blocked reports whether r overlaps an obstacle.
+func (c Collisions) Blocked(r image.Rectangle) bool {
+	return c.obstacles.Overlapping(r) >= 0
+}
+
+// ObstacleAt returns the obstacle containing p, or nil.
+func (c Collisions) ObstacleAt(p image.Point) *image.Rectangle {
+	if i := c.obstacles.At(p); i >= 0 {
+		return c.Obstacles[i]
+	}
+	return nil
+}
+
+// FirstObstacle returns the first obstacle on the straight line from a to b, or nil.
+func (c Collisions) FirstObstacle(a, b image.Point) *image.Rectangle {
+	if i := c.obstacles.Segment(a, b); i >= 0 {
+		return c.Obstacles[i]
+	}
+	return nil
+}
+
+// DoorAt returns a door overlapping r, or nil.
+func (c Collisions) DoorAt(r image.Rectangle) *Door {
+	if i := c.doors.Overlapping(r); i >= 0 {
+		return c.Doors[i]
+	}
+	return nil
+}
+
+// Obstacles returns the rectangles of a scene's obstacles, with every
+// diagonal expanded into its steps.
+func Obstacles(data *data.Data) []*image.Rectangle {
+	var obstacles []*image.Rectangle
 	for _, obs := range data.Obstacles {
 		i := image.Rect(obs.X1, obs.Y1, obs.X2, obs.Y2)
-		collisions.Obstacles = append(collisions.Obstacles, &i)
+		obstacles = append(obstacles, &i)
 	}
 	for _, d := range data.Diagonals {
 		for i := 0; i < d.Count; i++ {
@@ -31,19 +99,13 @@ func New(data *data.Data) Collisions {
 			x2 := x1 + d.Width
 			y2 := y1 + d.Height
 			i := image.Rect(x1, y1, x2, y2)
-			collisions.Obstacles = append(collisions.Obstacles, &i)
-		}
-	}
-	for _, d := range data.Doors {
-		i := image.Rect(d.X1, d.Y1, d.X2, d.Y2)
-		d := &Door{
-			Rect:        &i,
-			Id:          d.Id,
-			Destination: d.Destination,
-			NewX:        d.NewX,
-			NewY:        d.NewY,
+			obstacles = append(obstacles, &i)
 		}
-		collisions.Doors = append(collisions.Doors, d)
 	}
-	return collisions
+	return obstacles
+}
+
+// Open reports whether the door can be walked through with the given variables.
+func (d *Door) Open(vars *world.Vars) bool {
+	return d.Condition.Holds(vars)
 }
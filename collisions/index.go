@@ -0,0 +1,186 @@
+package collisions
+
+import (
+	"image"
+	"math"
+)
+
+// CellSize is the side of the grid cells New sorts rectangles into. It's a bit
+// bigger than a character so most queries only look at a few cells.
+const CellSize = 128
+
+type cell struct{ x, y int }
+
+// Index is a uniform grid over a fixed set of rectangles. Every rectangle is
+// listed in each cell it covers, so a query only has to look at the
+// rectangles in the cells it touches instead of all of them.
+//
+// A nil *Index holds no rectangles.
+type Index struct {
+	CellSize int
+	rects    []image.Rectangle
+	cells    map[cell][]int
+	seen     []uint32 // Query that last looked at each rectangle, so each is checked once
+	query    uint32
+}
+
+func NewIndex(cellSize int, rects []*image.Rectangle) *Index {
+	idx := &Index{
+		CellSize: cellSize,
+		rects:    make([]image.Rectangle, len(rects)),
+		cells:    make(map[cell][]int),
+		seen:     make([]uint32, len(rects)),
+	}
+	for i, r := range rects {
+		idx.rects[i] = r.Canon()
+		if idx.rects[i].Empty() {
+			// Can't overlap anything
+			continue
+		}
+		min, max := idx.cellRange(idx.rects[i])
+		for y := min.y; y <= max.y; y++ {
+			for x := min.x; x <= max.x; x++ {
+				c := cell{x, y}
+				idx.cells[c] = append(idx.cells[c], i)
+			}
+		}
+	}
+	return idx
+}
+
+func floorDiv(a, b int) int {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+// cellRange returns the first and last cell r covers. Max is exclusive in
+// image.Rectangle, hence the -1.
+func (idx *Index) cellRange(r image.Rectangle) (cell, cell) {
+	return cell{floorDiv(r.Min.X, idx.CellSize), floorDiv(r.Min.Y, idx.CellSize)},
+		cell{floorDiv(r.Max.X-1, idx.CellSize), floorDiv(r.Max.Y-1, idx.CellSize)}
+}
+
+// visit calls fn once for every rectangle listed in the cells r covers until
+// fn returns false.
+func (idx *Index) visit(r image.Rectangle, fn func(i int) bool) {
+	if idx == nil || r.Empty() {
+		return
+	}
+	idx.query++
+	if idx.query == 0 {
+		// Wrapped around, forget the old stamps
+		for i := range idx.seen {
+			idx.seen[i] = 0
+		}
+		idx.query = 1
+	}
+	min, max := idx.cellRange(r)
+	for y := min.y; y <= max.y; y++ {
+		for x := min.x; x <= max.x; x++ {
+			for _, i := range idx.cells[cell{x, y}] {
+				if idx.seen[i] == idx.query {
+					continue
+				}
+				idx.seen[i] = idx.query
+				if !fn(i) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Overlapping returns the index of a rectangle that overlaps r, or -1.
+func (idx *Index) Overlapping(r image.Rectangle) int {
+	found := -1
+	r = r.Canon()
+	idx.visit(r, func(i int) bool {
+		if idx.rects[i].Overlaps(r) {
+			found = i
+			return false
+		}
+		return true
+	})
+	return found
+}
+
+// All returns the indexes of every rectangle that overlaps r.
+func (idx *Index) All(r image.Rectangle) []int {
+	var found []int
+	r = r.Canon()
+	idx.visit(r, func(i int) bool {
+		if idx.rects[i].Overlaps(r) {
+			found = append(found, i)
+		}
+		return true
+	})
+	return found
+}
+
+// At returns the index of a rectangle containing p, or -1.
+func (idx *Index) At(p image.Point) int {
+	found := -1
+	idx.visit(image.Rect(p.X, p.Y, p.X+1, p.Y+1), func(i int) bool {
+		if p.In(idx.rects[i]) {
+			found = i
+			return false
+		}
+		return true
+	})
+	return found
+}
+
+// Segment returns the index of the first rectangle the segment from a to b
+// runs into, or -1 if nothing is in the way.
+func (idx *Index) Segment(a, b image.Point) int {
+	found, nearest := -1, math.Inf(1)
+	bounds := image.Rectangle{a, b}.Canon()
+	bounds.Max = bounds.Max.Add(image.Pt(1, 1))
+	idx.visit(bounds, func(i int) bool {
+		if t, ok := segmentHits(a, b, idx.rects[i]); ok && t < nearest {
+			found, nearest = i, t
+		}
+		return true
+	})
+	return found
+}
+
+// segmentHits clips the segment from a to b against r (Liang-Barsky) and
+// returns how far along the segment, from 0 to 1, it enters r.
+func segmentHits(a, b image.Point, r image.Rectangle) (float64, bool) {
+	x0, y0 := float64(a.X), float64(a.Y)
+	dx, dy := float64(b.X-a.X), float64(b.Y-a.Y)
+	t0, t1 := 0.0, 1.0
+	clip := func(p, q float64) bool {
+		if p == 0 {
+			return q >= 0
+		}
+		t := q / p
+		if p < 0 {
+			if t > t1 {
+				return false
+			}
+			if t > t0 {
+				t0 = t
+			}
+		} else {
+			if t < t0 {
+				return false
+			}
+			if t < t1 {
+				t1 = t
+			}
+		}
+		return true
+	}
+	// The right and bottom edges are outside the rectangle, as everywhere else in image
+	minX, minY := float64(r.Min.X), float64(r.Min.Y)
+	maxX, maxY := float64(r.Max.X)-1e-9, float64(r.Max.Y)-1e-9
+	if clip(-dx, x0-minX) && clip(dx, maxX-x0) && clip(-dy, y0-minY) && clip(dy, maxY-y0) {
+		return t0, true
+	}
+	return 0, false
+}
@@ -0,0 +1,192 @@
+package collisions
+
+import (
+	"image"
+	"math/rand"
+	"rpg_demo/data"
+	"testing"
+)
+
+const worldSize = 20000
+
+// randomMap scatters n obstacles from 16 to 128 pixels wide over a map that
+// goes from -worldSize/2 to worldSize/2 both ways, the same ones for a given seed.
+func randomMap(seed int64, n int) *data.Data {
+	rng := rand.New(rand.NewSource(seed))
+	d := &data.Data{}
+	for i := 0; i < n; i++ {
+		x, y := rng.Intn(worldSize)-worldSize/2, rng.Intn(worldSize)-worldSize/2
+		w, h := 16+rng.Intn(112), 16+rng.Intn(112)
+		d.Obstacles = append(d.Obstacles, data.ObstacleData{X1: x, Y1: y, X2: x + w, Y2: y + h})
+	}
+	return d
+}
+
+// linearBlocked is how player.Colliding used to check every obstacle.
+func linearBlocked(obstacles []*image.Rectangle, r image.Rectangle) bool {
+	for _, obstacle := range obstacles {
+		if r.Overlaps(*obstacle) {
+			return true
+		}
+	}
+	return false
+}
+
+func linearAt(obstacles []*image.Rectangle, p image.Point) bool {
+	for _, obstacle := range obstacles {
+		if p.In(*obstacle) {
+			return true
+		}
+	}
+	return false
+}
+
+// linearSegment returns how far along the segment the first obstacle it runs
+// into is, and whether there is one.
+func linearSegment(obstacles []*image.Rectangle, a, b image.Point) (float64, bool) {
+	nearest, hit := 2.0, false
+	for _, obstacle := range obstacles {
+		if t, ok := segmentHits(a, b, *obstacle); ok && t < nearest {
+			nearest, hit = t, true
+		}
+	}
+	return nearest, hit
+}
+
+// checkAgainstScan compares every kind of query on idx with a scan of all of
+// rects.
+func checkAgainstScan(t *testing.T, idx *Index, rects []*image.Rectangle, boxes []image.Rectangle, segments [][2]image.Point) {
+	t.Helper()
+	for _, box := range boxes {
+		i := idx.Overlapping(box)
+		if want := linearBlocked(rects, box); (i >= 0) != want {
+			t.Errorf("Overlapping(%v) = %d, scan says %v", box, i, want)
+		} else if i >= 0 && !rects[i].Overlaps(box) {
+			t.Errorf("Overlapping(%v) = %v, which doesn't overlap it", box, *rects[i])
+		}
+
+		p := box.Min
+		i = idx.At(p)
+		if want := linearAt(rects, p); (i >= 0) != want {
+			t.Errorf("At(%v) = %d, scan says %v", p, i, want)
+		} else if i >= 0 && !p.In(*rects[i]) {
+			t.Errorf("At(%v) = %v, which doesn't contain it", p, *rects[i])
+		}
+	}
+	for _, s := range segments {
+		i := idx.Segment(s[0], s[1])
+		want, hit := linearSegment(rects, s[0], s[1])
+		if (i >= 0) != hit {
+			t.Errorf("Segment(%v, %v) = %d, scan says %v", s[0], s[1], i, hit)
+			continue
+		}
+		if !hit {
+			continue
+		}
+		// Obstacles the segment enters at the same point are equally first
+		if got, _ := segmentHits(s[0], s[1], *rects[i]); got != want {
+			t.Errorf("Segment(%v, %v) hits %v at %v, the first hit is at %v", s[0], s[1], *rects[i], got, want)
+		}
+	}
+}
+
+func TestIndexMatchesScan(t *testing.T) {
+	c, err := New(randomMap(1, 10000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rng := rand.New(rand.NewSource(2))
+	boxes := make([]image.Rectangle, 2000)
+	segments := make([][2]image.Point, 2000)
+	for i := range boxes {
+		x, y := rng.Intn(worldSize)-worldSize/2, rng.Intn(worldSize)-worldSize/2
+		boxes[i] = image.Rect(x, y, x+48, y+68)
+		segments[i] = [2]image.Point{{x, y}, {x + rng.Intn(400) - 200, y + rng.Intn(400) - 200}}
+	}
+	for _, cellSize := range []int{16, CellSize, 1000} {
+		checkAgainstScan(t, NewIndex(cellSize, c.Obstacles), c.Obstacles, boxes, segments)
+	}
+}
+
+func TestIndexEdges(t *testing.T) {
+	// Rectangles on both sides of the origin and right on cell boundaries,
+	// where floorDiv and the exclusive Max edge matter
+	rect := func(x0, y0, x1, y1 int) *image.Rectangle {
+		r := image.Rect(x0, y0, x1, y1)
+		return &r
+	}
+	rects := []*image.Rectangle{
+		rect(-16, -16, 0, 0),
+		rect(0, 0, 16, 16),
+		rect(-33, 5, -17, 6),
+		rect(32, -48, 33, -32),
+		rect(-1, 40, 1, 41),
+	}
+	var boxes []image.Rectangle
+	for y := -50; y <= 50; y++ {
+		for x := -50; x <= 50; x++ {
+			boxes = append(boxes, image.Rect(x, y, x+1, y+1), image.Rect(x, y, x+16, y+16))
+		}
+	}
+	var segments [][2]image.Point
+	for _, b := range boxes {
+		segments = append(segments, [2]image.Point{b.Min, image.Pt(-b.Min.Y, b.Min.X)})
+	}
+	idx := NewIndex(16, rects)
+	checkAgainstScan(t, idx, rects, boxes, segments)
+
+	// Max is outside the rectangle
+	if i := idx.At(image.Pt(0, 0)); i != 1 {
+		t.Errorf("At(0,0) = %d, want 1, the point is only in the second rectangle", i)
+	}
+	if i := idx.Overlapping(image.Rect(16, 0, 20, 16)); i != -1 {
+		t.Errorf("box right of (0,0)-(16,16) overlaps %d", i)
+	}
+	if i := idx.Overlapping(image.Rect(-20, -20, -16, -16)); i != -1 {
+		t.Errorf("box touching the corner of (-16,-16)-(0,0) overlaps %d", i)
+	}
+	if i := idx.Segment(image.Pt(-40, 5), image.Pt(-10, 5)); i != 2 {
+		t.Errorf("segment through (-33,5)-(-17,6) hits %d, want 2", i)
+	}
+	if i := idx.Segment(image.Pt(-40, 6), image.Pt(-10, 6)); i != -1 {
+		t.Errorf("segment along the bottom edge of (-33,5)-(-17,6) hits %d", i)
+	}
+}
+
+func benchmarkBlocked(b *testing.B, blocked func(c Collisions, r image.Rectangle) bool) {
+	c, err := New(randomMap(1, 10000))
+	if err != nil {
+		b.Fatal(err)
+	}
+	rng := rand.New(rand.NewSource(2))
+	boxes := make([]image.Rectangle, 1024)
+	for i := range boxes {
+		x, y := rng.Intn(worldSize)-worldSize/2, rng.Intn(worldSize)-worldSize/2
+		boxes[i] = image.Rect(x, y, x+48, y+68)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		blocked(c, boxes[i%len(boxes)])
+	}
+}
+
+func BenchmarkBlockedLinear(b *testing.B) {
+	benchmarkBlocked(b, func(c Collisions, r image.Rectangle) bool {
+		return linearBlocked(c.Obstacles, r)
+	})
+}
+
+func BenchmarkBlockedGrid(b *testing.B) {
+	benchmarkBlocked(b, Collisions.Blocked)
+}
+
+func BenchmarkNewIndex(b *testing.B) {
+	c, err := New(randomMap(1, 10000))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		NewIndex(CellSize, c.Obstacles)
+	}
+}
@@ -0,0 +1,605 @@
+package cutscene
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"rpg_demo/clock"
+	"rpg_demo/data"
+	"rpg_demo/dialogue"
+	"rpg_demo/emote"
+	"rpg_demo/world"
+)
+
+// TargetKind is what an action's targetId has to resolve to.
+type TargetKind int
+
+const (
+	NoTarget TargetKind = iota
+	PlayerTarget
+	NPCTarget
+	DialogueTarget
+	MusicTarget
+	SceneTarget
+	WorldTarget
+	CameraTarget
+	LibraryTarget
+	CharacterTarget // The player, as "player", or an NPC by name
+)
+
+// targetNames are the fixed targetIds of the targets that aren't NPCs.
+var targetNames = map[TargetKind]string{
+	PlayerTarget:   "player",
+	DialogueTarget: "dialogue",
+	MusicTarget:    "music",
+	SceneTarget:    "scene",
+	WorldTarget:    "world",
+	CameraTarget:   "camera",
+	LibraryTarget:  "cutscenes",
+}
+
+// Params is the decoded data of an action. Every action type has its own
+// struct, listed in the registry.
+type Params interface{}
+
+type MoveParams struct {
+	X, Y float64
+}
+
+type TeleportParams struct {
+	X, Y float64
+}
+
+type TurnParams struct {
+	Direction string
+}
+
+// FadeParams is how fast a fade goes. Older scene files give a bare number,
+// the alpha change per tick at clock.DefaultTPS.
+type FadeParams struct {
+	Speed float64 // Alpha change per second
+}
+
+type DialogueParams struct {
+	Lines []string
+}
+
+type ChangeSceneParams struct {
+	Scene string
+}
+
+type ChangeMusicParams struct {
+	Song string
+}
+
+// WaitParams is how long a Wait lasts. Older scene files give a bare number of
+// frames, which are taken to be ticks at clock.DefaultTPS.
+type WaitParams struct {
+	Seconds float64
+	Frames  int
+}
+
+type SetFlagParams struct {
+	Name  string
+	Value world.Value
+}
+
+// PanCameraParams moves the middle of the screen to X, Y at Speed pixels per
+// second, 0 cutting straight there, and holds it there until the cutscene ends.
+// Release hands the camera back to the player instead.
+type PanCameraParams struct {
+	X, Y    float64
+	Speed   float64
+	Release bool
+}
+
+type ShakeCameraParams struct {
+	Intensity float64 // Pixels
+	Duration  float64 // Seconds
+}
+
+// ZoomCameraParams zooms to Zoom at Speed per second, 0 for at once.
+type ZoomCameraParams struct {
+	Zoom  float64
+	Speed float64
+}
+
+// JoinParams lists the tracks and labels a Join waits for. Without any it
+// waits for every other track.
+type JoinParams struct {
+	Tracks []string
+}
+
+// IfParams holds both branches of an If. Whichever one the condition picks
+// plays as a nested cutscene, and the If completes when that branch does.
+type IfParams struct {
+	Condition *world.Cond
+	Then      []CutsceneAction
+	Else      []CutsceneAction
+}
+
+// RepeatParams plays Actions Times times over, as a nested cutscene.
+type RepeatParams struct {
+	Times   int
+	Actions []CutsceneAction
+}
+
+// GotoParams carries on from the action labeled Label on the same track,
+// provided Condition holds. Jumping back makes a loop.
+type GotoParams struct {
+	Label     string
+	Condition *world.Cond
+}
+
+// CallParams plays another cutscene as a nested one, looked up in the current
+// scene and then in the shared cutscenes.
+type CallParams struct {
+	Cutscene string
+}
+
+// EmoteParams pops up a bubble over the target's head for Seconds,
+// emote.DefaultSeconds if 0. The action doesn't wait for it to go away.
+type EmoteParams struct {
+	Emote   emote.Kind
+	Seconds float64
+}
+
+// Block is a list of actions nested in an action, like the branches of an If.
+type Block struct {
+	Name    string // As written in the scene file
+	Actions []CutsceneAction
+}
+
+// Blocks returns the lists of actions nested in the action.
+func (a CutsceneAction) Blocks() []Block {
+	switch p := a.Params.(type) {
+	case *IfParams:
+		return []Block{{"then", p.Then}, {"else", p.Else}}
+	case *RepeatParams:
+		return []Block{{"actions", p.Actions}}
+	}
+	return nil
+}
+
+// CopyActions copies a list of actions along with the lists nested in them, so
+// targets can be resolved into the copy without touching the original.
+func CopyActions(actions []CutsceneAction) []CutsceneAction {
+	out := make([]CutsceneAction, len(actions))
+	copy(out, actions)
+	for i := range out {
+		switch p := out[i].Params.(type) {
+		case *IfParams:
+			out[i].Params = &IfParams{Condition: p.Condition, Then: CopyActions(p.Then), Else: CopyActions(p.Else)}
+		case *RepeatParams:
+			out[i].Params = &RepeatParams{Times: p.Times, Actions: CopyActions(p.Actions)}
+		}
+	}
+	return out
+}
+
+// actionSpec describes how to decode one action type.
+type actionSpec struct {
+	Type      CutsceneActionType
+	Target    TargetKind
+	NewParams func() Params // nil for actions that take no data
+}
+
+// registry maps the actionType names used in scene files to their specs
+var registry = map[string]actionSpec{
+	"MovePlayer":     {MovePlayer, PlayerTarget, func() Params { return &MoveParams{} }},
+	"MoveNPC":        {MoveNPC, NPCTarget, func() Params { return &MoveParams{} }},
+	"ShowDialogue":   {ShowDialogue, DialogueTarget, func() Params { return &DialogueParams{} }},
+	"TeleportNPC":    {TeleportNPC, NPCTarget, func() Params { return &TeleportParams{} }},
+	"TeleportPlayer": {TeleportPlayer, PlayerTarget, func() Params { return &TeleportParams{} }},
+	"TurnNPC":        {TurnNPC, NPCTarget, func() Params { return &TurnParams{} }},
+	"TurnPlayer":     {TurnPlayer, PlayerTarget, func() Params { return &TurnParams{} }},
+	"FadeIn":         {FadeIn, NoTarget, func() Params { return &FadeParams{} }},
+	"FadeOut":        {FadeOut, NoTarget, func() Params { return &FadeParams{} }},
+	"ChangeScene":    {ChangeScene, SceneTarget, func() Params { return &ChangeSceneParams{} }},
+	"StopMusic":      {StopMusic, MusicTarget, nil},
+	"ChangeMusic":    {ChangeMusic, MusicTarget, func() Params { return &ChangeMusicParams{} }},
+	"Wait":           {Wait, NoTarget, func() Params { return &WaitParams{} }},
+	"SetFlag":        {SetFlag, WorldTarget, func() Params { return &SetFlagParams{} }},
+	"If":             {If, WorldTarget, func() Params { return &IfParams{} }},
+	"PanCamera":      {PanCamera, CameraTarget, func() Params { return &PanCameraParams{} }},
+	"ShakeCamera":    {ShakeCamera, CameraTarget, func() Params { return &ShakeCameraParams{} }},
+	"ZoomCamera":     {ZoomCamera, CameraTarget, func() Params { return &ZoomCameraParams{} }},
+	"Join":           {Join, NoTarget, func() Params { return &JoinParams{} }},
+	"Repeat":         {Repeat, NoTarget, func() Params { return &RepeatParams{} }},
+	"Goto":           {Goto, WorldTarget, func() Params { return &GotoParams{} }},
+	"Call":           {Call, LibraryTarget, func() Params { return &CallParams{} }},
+	"Emote":          {Emote, CharacterTarget, func() Params { return &EmoteParams{} }},
+}
+
+func (t CutsceneActionType) String() string {
+	for name, spec := range registry {
+		if spec.Type == t {
+			return name
+		}
+	}
+	return fmt.Sprintf("CutsceneActionType(%d)", int(t))
+}
+
+// TargetKind returns what the action's TargetID refers to.
+func (t CutsceneActionType) TargetKind() TargetKind {
+	return registry[t.String()].Target
+}
+
+// TargetName returns the fixed targetId for kinds other than NPCTarget.
+func (k TargetKind) TargetName() string {
+	return targetNames[k]
+}
+
+// DecodeActions turns scene data into typed actions. Errors name the index
+// of the offending action, nested If branches included. Labels and tracks
+// belong to the list they are in, an If branch can't wait for the actions
+// around it.
+func DecodeActions(dataList []data.CutsceneAction) ([]CutsceneAction, error) {
+	var actions []CutsceneAction
+	for i, actionData := range dataList {
+		action, err := decodeAction(actionData)
+		if err != nil {
+			return nil, fmt.Errorf("action %d (%s): %w", i, actionData.ActionType, err)
+		}
+		actions = append(actions, action)
+	}
+	if err := checkSync(actions); err != nil {
+		return nil, err
+	}
+	return actions, nil
+}
+
+func decodeAction(actionData data.CutsceneAction) (CutsceneAction, error) {
+	spec, ok := registry[actionData.ActionType]
+	if !ok {
+		return CutsceneAction{}, fmt.Errorf("unknown action type")
+	}
+	action := CutsceneAction{
+		ActionType:   spec.Type,
+		TargetID:     actionData.TargetID,
+		WaitPrevious: actionData.WaitPrevious,
+		Track:        actionData.Track,
+		Label:        actionData.Label,
+		WaitFor:      actionData.WaitFor,
+	}
+	if action.Track == "" {
+		action.Track = MainTrack
+	}
+
+	switch spec.Target {
+	case NoTarget:
+		if action.TargetID != "" {
+			return action, fmt.Errorf("takes no target but got %q", action.TargetID)
+		}
+	case NPCTarget:
+		if action.TargetID == "" {
+			return action, fmt.Errorf("needs the name of an NPC as targetId")
+		}
+	case CharacterTarget:
+		if action.TargetID == "" {
+			return action, fmt.Errorf("needs %q or the name of an NPC as targetId", PlayerTarget.TargetName())
+		}
+	default:
+		name := spec.Target.TargetName()
+		if action.TargetID == "" {
+			action.TargetID = name
+		} else if action.TargetID != name {
+			return action, fmt.Errorf("target must be %q, got %q", name, action.TargetID)
+		}
+	}
+
+	raw := bytes.TrimSpace(actionData.Data)
+	hasData := len(raw) > 0 && !bytes.Equal(raw, []byte("null"))
+	if spec.NewParams == nil {
+		if hasData {
+			return action, fmt.Errorf("takes no data")
+		}
+		return action, nil
+	}
+	params := spec.NewParams()
+	if !hasData {
+		if _, ok := params.(interface{ optional() }); !ok {
+			return action, fmt.Errorf("missing data")
+		}
+	} else if err := json.Unmarshal(raw, params); err != nil {
+		return action, err
+	}
+	if v, ok := params.(interface{ validate() error }); ok {
+		if err := v.validate(); err != nil {
+			return action, err
+		}
+	}
+	action.Params = params
+	return action, nil
+}
+
+// unmarshalShorthand decodes action data that may be written either as an
+// object or as the bare value of its main field, e.g. "data": "left" instead
+// of "data": {"direction": "left"}. Unknown fields are errors so typos don't
+// slip through.
+func unmarshalShorthand(b []byte, field string, v interface{}) error {
+	b = bytes.TrimSpace(b)
+	if len(b) > 0 && b[0] != '{' {
+		var err error
+		b, err = json.Marshal(map[string]json.RawMessage{field: b})
+		if err != nil {
+			return err
+		}
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// legacy decodes action data written the way scene files did before speeds
+// and times were per second, as a bare number in per-tick units. It reports
+// false for the object form.
+func legacy(b []byte, n *float64) bool {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 || b[0] == '{' {
+		return false
+	}
+	return json.Unmarshal(b, n) == nil
+}
+
+func unmarshalStrict(b []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+func (p *MoveParams) UnmarshalJSON(b []byte) error {
+	type plain MoveParams
+	return unmarshalStrict(b, (*plain)(p))
+}
+
+func (p *TeleportParams) UnmarshalJSON(b []byte) error {
+	type plain TeleportParams
+	return unmarshalStrict(b, (*plain)(p))
+}
+
+func (p *TurnParams) UnmarshalJSON(b []byte) error {
+	type plain TurnParams
+	return unmarshalShorthand(b, "direction", (*plain)(p))
+}
+
+func (p *TurnParams) validate() error {
+	switch p.Direction {
+	case "up", "down", "left", "right":
+		return nil
+	}
+	return fmt.Errorf("invalid direction %q", p.Direction)
+}
+
+func (p *FadeParams) UnmarshalJSON(b []byte) error {
+	var perTick float64
+	if legacy(b, &perTick) {
+		p.Speed = perTick * clock.DefaultTPS
+		return nil
+	}
+	type plain FadeParams
+	return unmarshalStrict(b, (*plain)(p))
+}
+
+func (p *FadeParams) validate() error {
+	if p.Speed <= 0 {
+		return fmt.Errorf("fade speed must be positive")
+	}
+	return nil
+}
+
+func (p *DialogueParams) UnmarshalJSON(b []byte) error {
+	type plain DialogueParams
+	return unmarshalShorthand(b, "lines", (*plain)(p))
+}
+
+func (p *DialogueParams) validate() error {
+	if len(p.Lines) == 0 {
+		return fmt.Errorf("dialogue has no lines")
+	}
+	for i, line := range p.Lines {
+		if err := dialogue.CheckMarkup(line); err != nil {
+			return fmt.Errorf("line %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (p *ChangeSceneParams) UnmarshalJSON(b []byte) error {
+	type plain ChangeSceneParams
+	return unmarshalShorthand(b, "scene", (*plain)(p))
+}
+
+func (p *ChangeSceneParams) validate() error {
+	if p.Scene == "" {
+		return fmt.Errorf("missing scene name")
+	}
+	return nil
+}
+
+func (p *ChangeMusicParams) UnmarshalJSON(b []byte) error {
+	type plain ChangeMusicParams
+	return unmarshalShorthand(b, "song", (*plain)(p))
+}
+
+func (p *ChangeMusicParams) validate() error {
+	if p.Song == "" {
+		return fmt.Errorf("missing song")
+	}
+	return nil
+}
+
+func (p *WaitParams) UnmarshalJSON(b []byte) error {
+	var frames float64
+	if legacy(b, &frames) {
+		if frames != math.Trunc(frames) {
+			return fmt.Errorf(`a bare number counts frames, got %v, use {"seconds": %v} for seconds`, frames, frames)
+		}
+		p.Frames = int(frames)
+		return nil
+	}
+	type plain WaitParams
+	return unmarshalStrict(b, (*plain)(p))
+}
+
+func (p *WaitParams) validate() error {
+	if p.Frames != 0 {
+		if p.Seconds != 0 {
+			return fmt.Errorf("wait has both seconds and frames")
+		}
+		p.Seconds = float64(p.Frames) / clock.DefaultTPS
+		p.Frames = 0
+	}
+	if p.Seconds <= 0 {
+		return fmt.Errorf("wait must be longer than zero")
+	}
+	return nil
+}
+
+func (p *SetFlagParams) UnmarshalJSON(b []byte) error {
+	type plain SetFlagParams
+	return unmarshalStrict(b, (*plain)(p))
+}
+
+func (p *SetFlagParams) validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("missing flag name")
+	}
+	return nil
+}
+
+func (p *JoinParams) UnmarshalJSON(b []byte) error {
+	type plain JoinParams
+	return unmarshalShorthand(b, "tracks", (*plain)(p))
+}
+
+// A bare Join waits for every other track.
+func (p *JoinParams) optional() {}
+
+func (p *IfParams) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		Condition string
+		Then      []data.CutsceneAction
+		Else      []data.CutsceneAction
+	}
+	if err := unmarshalStrict(b, &raw); err != nil {
+		return err
+	}
+	cond, err := world.Parse(raw.Condition)
+	if err != nil {
+		return err
+	}
+	p.Condition = cond
+	if p.Then, err = DecodeActions(raw.Then); err != nil {
+		return fmt.Errorf("then: %w", err)
+	}
+	if p.Else, err = DecodeActions(raw.Else); err != nil {
+		return fmt.Errorf("else: %w", err)
+	}
+	return nil
+}
+
+func (p *RepeatParams) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		Times   int
+		Actions []data.CutsceneAction
+	}
+	if err := unmarshalStrict(b, &raw); err != nil {
+		return err
+	}
+	if raw.Times < 1 || raw.Times > MaxRepeat {
+		return fmt.Errorf("times must be between 1 and %d, got %d", MaxRepeat, raw.Times)
+	}
+	p.Times = raw.Times
+	var err error
+	if p.Actions, err = DecodeActions(raw.Actions); err != nil {
+		return fmt.Errorf("actions: %w", err)
+	}
+	return nil
+}
+
+func (p *GotoParams) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		Label     string
+		Condition string
+	}
+	if err := unmarshalShorthand(b, "label", &raw); err != nil {
+		return err
+	}
+	if raw.Label == "" {
+		return fmt.Errorf("missing label")
+	}
+	cond, err := world.Parse(raw.Condition)
+	if err != nil {
+		return err
+	}
+	p.Label, p.Condition = raw.Label, cond
+	return nil
+}
+
+func (p *CallParams) UnmarshalJSON(b []byte) error {
+	type plain CallParams
+	return unmarshalShorthand(b, "cutscene", (*plain)(p))
+}
+
+func (p *CallParams) validate() error {
+	if p.Cutscene == "" {
+		return fmt.Errorf("missing cutscene id")
+	}
+	return nil
+}
+
+func (p *EmoteParams) UnmarshalJSON(b []byte) error {
+	type plain EmoteParams
+	return unmarshalShorthand(b, "emote", (*plain)(p))
+}
+
+func (p *EmoteParams) validate() error {
+	if _, err := emote.Parse(string(p.Emote)); err != nil {
+		return err
+	}
+	if p.Seconds < 0 {
+		return fmt.Errorf("emote seconds can't be negative")
+	}
+	return nil
+}
+
+func (p *PanCameraParams) UnmarshalJSON(b []byte) error {
+	type plain PanCameraParams
+	return unmarshalStrict(b, (*plain)(p))
+}
+
+func (p *PanCameraParams) validate() error {
+	if p.Speed < 0 {
+		return fmt.Errorf("pan speed can't be negative")
+	}
+	return nil
+}
+
+func (p *ShakeCameraParams) UnmarshalJSON(b []byte) error {
+	type plain ShakeCameraParams
+	return unmarshalStrict(b, (*plain)(p))
+}
+
+func (p *ShakeCameraParams) validate() error {
+	if p.Intensity <= 0 || p.Duration <= 0 {
+		return fmt.Errorf("shake intensity and duration must be positive")
+	}
+	return nil
+}
+
+func (p *ZoomCameraParams) UnmarshalJSON(b []byte) error {
+	type plain ZoomCameraParams
+	return unmarshalShorthand(b, "zoom", (*plain)(p))
+}
+
+func (p *ZoomCameraParams) validate() error {
+	if p.Zoom <= 0 {
+		return fmt.Errorf("zoom must be positive")
+	}
+	if p.Speed < 0 {
+		return fmt.Errorf("zoom speed can't be negative")
+	}
+	return nil
+}
@@ -2,15 +2,20 @@ package cutscene
 
 import (
 	"fmt"
+	"log"
+	"math"
+	"rpg_demo/camera"
+	"rpg_demo/collisions"
 	"rpg_demo/data"
 	"rpg_demo/dialogue"
+	"rpg_demo/emote"
+	"rpg_demo/input"
 	"rpg_demo/music"
 	"rpg_demo/npc"
 	"rpg_demo/player"
 	"rpg_demo/shared"
+	"rpg_demo/world"
 	"time"
-
-	"github.com/hajimehoshi/ebiten/v2"
 )
 
 type CutsceneActionType int
@@ -29,126 +34,159 @@ const (
 	StopMusic
 	ChangeMusic
 	Wait
+	SetFlag
+	If
+	PanCamera
+	ShakeCamera
+	ZoomCamera
+	Join
+	Repeat
+	Goto
+	Call
+	Emote
 )
 
-// actionMap maps strings to CutsceneActionType constants
-var actionMap = map[string]CutsceneActionType{
-	"MovePlayer":     MovePlayer,
-	"MoveNPC":        MoveNPC,
-	"ShowDialogue":   ShowDialogue,
-	"TeleportNPC":    TeleportNPC,
-	"TeleportPlayer": TeleportPlayer,
-	"TurnNPC":        TurnNPC,
-	"TurnPlayer":     TurnPlayer,
-	"FadeIn":         FadeIn,
-	"FadeOut":        FadeOut,
-	"ChangeScene":    ChangeScene,
-	"StopMusic":      StopMusic,
-	"ChangeMusic":    ChangeMusic,
-	"Wait":           Wait,
-}
-
 type CutsceneAction struct {
 	ActionType   CutsceneActionType
-	Target       interface{}
-	Data         interface{}
-	WaitPrevious bool // Whether to wait for previous actions to complete
+	TargetID     string      // As written in the scene file
+	Target       interface{} // What TargetID resolves to, filled in by the game before playing
+	Params       Params      // One of the *Params structs, depending on ActionType
+	WaitPrevious bool        // Whether to wait for the earlier actions of its track to complete
+	Track        string      // Actions on different tracks run side by side
+	Label        string      // Name WaitFor and Join can refer to, optional
+	WaitFor      []string    // Labels and tracks that must be done before it starts
 }
 type Vector2D struct {
 	X, Y float64
 }
+
 type Cutscene struct {
-	Actions       []CutsceneAction
-	Current       int
-	ActiveActions map[int]bool // Tracks active actions by their index
-	IsPlaying     bool
+	ID          string
+	Actions     []CutsceneAction
+	IsPlaying   bool
+	Unskippable bool
+	FastForward bool              // Dialogue goes by without waiting for the player, set by the game each tick
+	tracks      []*track          // In the order they first appear
+	status      []status          // By action index
+	elapsed     []float64         // Seconds each Wait has lasted, by action index
+	blocks      map[int]*Cutscene // Nested cutscene of each If, Repeat and Call that has started, by action index
+	repeats     []int             // Times each Repeat has played its actions, by action index
+	jumps       int               // Gotos taken so far
+	caller      *Cutscene         // Cutscene this one is nested in, nil at the top
+	depth       int               // Number of Calls it is nested in
 }
 
-func LoadCutscenes(dataList []data.CutsceneData) map[string]*Cutscene {
+// LoadCutscenes decodes every cutscene of a scene. The first broken action
+// fails the whole scene, with the scene, cutscene and action in the error.
+func LoadCutscenes(sceneName string, dataList []data.CutsceneData) (map[string]*Cutscene, error) {
 	cutscenes := make(map[string]*Cutscene)
 	for _, cutscene := range dataList {
-		cutscenes[cutscene.ID] = New(&cutscene)
+		c, err := New(&cutscene)
+		if err != nil {
+			return nil, fmt.Errorf("scene %q: %w", sceneName, err)
+		}
+		cutscenes[cutscene.ID] = c
 	}
-	return cutscenes
+	return cutscenes, nil
 }
 
-func New(data *data.CutsceneData) *Cutscene {
-	var actions []CutsceneAction
-
-	for _, actionData := range data.Actions {
-		action := CutsceneAction{
-			ActionType:   getActionType(actionData.ActionType),
-			WaitPrevious: actionData.WaitPrevious,
-			Target:       actionData.TargetID,
-			Data:         actionData.Data,
-		}
-		switch action.ActionType {
-		case FadeOut:
-			action.Data = actionData.Data
-		}
-		actions = append(actions, action)
+func New(data *data.CutsceneData) (*Cutscene, error) {
+	actions, err := DecodeActions(data.Actions)
+	if err != nil {
+		return nil, fmt.Errorf("cutscene %q: %w", data.ID, err)
 	}
 	cutscene := &Cutscene{
-		Actions: actions,
+		ID:          data.ID,
+		Actions:     actions,
+		Unskippable: data.Unskippable,
 	}
-	return cutscene
+	return cutscene, nil
 }
 
 func (c *Cutscene) Start() {
-	c.Current = 0
 	c.IsPlaying = true
-	c.ActiveActions = make(map[int]bool)
+	c.tracks = splitTracks(c.Actions)
+	c.status = make([]status, len(c.Actions))
+	c.elapsed = make([]float64, len(c.Actions))
+	c.blocks = make(map[int]*Cutscene)
+	c.repeats = make([]int, len(c.Actions))
+	c.jumps = 0
 }
 
-func (c *Cutscene) Update(t *shared.Transition, k shared.KeyPressed) {
+// Update plays dt seconds of the cutscene. Tracks take their turn in the order
+// they first appear in the cutscene, and each track runs its actions in order,
+// so the same input always plays the same way.
+func (c *Cutscene) Update(t *shared.Transition, in *input.Handler, dt float64, obstacles collisions.Collisions) {
 	if !c.IsPlaying {
 		return
 	}
 
-	for i, action := range c.Actions {
-		if i < c.Current && !c.ActiveActions[i] {
-			// Skip completed actions
-			continue
-		}
-
-		if action.WaitPrevious && i > c.Current {
-			// If the action should wait for previous ones, don't start it yet
-			continue
-		}
-
-		// Process the action
-		completed := c.processAction(action, t, k)
-		if completed {
-			c.ActiveActions[i] = false // Mark action as completed
-			if i == c.Current {
-				c.Current++ // Move to the next action
+	changed, busy := false, false
+	for _, tr := range c.tracks {
+		for k, i := range tr.actions {
+			if c.status[i] == done {
+				continue
+			}
+			if c.status[i] == waiting && !c.ready(tr, k) {
+				// Nothing after it on the track can start either
+				break
+			}
+			if c.processAction(i, c.Actions[i], t, in, dt, obstacles) {
+				c.status[i] = done
+				changed = true
+				if c.Actions[i].ActionType == Goto && c.goTo(tr, k) {
+					// The track goes on from the label next tick
+					break
+				}
+			} else {
+				changed = changed || c.status[i] == waiting
+				c.status[i] = running
+				busy = true
 			}
-		} else {
-			c.ActiveActions[i] = true // Mark action as active
 		}
 	}
 
-	// Check if all actions are completed
-	if c.Current >= len(c.Actions) {
+	if c.allDone() {
+		c.IsPlaying = false
+	} else if !changed && !busy {
+		// Whatever is left waits on something that can never happen
+		log.Printf("Cutscene %s: stuck waiting, ending it", c.ID)
 		c.IsPlaying = false
-		fmt.Println("DONE")
 	}
 }
 
-func (c *Cutscene) processAction(action CutsceneAction, t *shared.Transition, k shared.KeyPressed) bool {
+func (c *Cutscene) processAction(i int, action CutsceneAction, t *shared.Transition, in *input.Handler, dt float64, obstacles collisions.Collisions) bool {
 	switch action.ActionType {
+	case SetFlag:
+		vars := action.Target.(*world.Vars)
+		p := action.Params.(*SetFlagParams)
+		vars.Set(p.Name, p.Value)
+		return true
+	case If, Repeat, Call:
+		sub := c.block(i, action)
+		if sub == nil {
+			return true
+		}
+		sub.FastForward = c.FastForward
+		sub.Update(t, in, dt, obstacles)
+		return !sub.IsPlaying && !c.again(i, action, sub)
+	case Goto:
+		// Update and Skip do the jump once the Goto is done
+		return true
 	case MoveNPC:
 		cnpc := action.Target.(*npc.NPC)
-		destination := action.Data.(Vector2D)
-		return moveTowards(cnpc, destination)
+		p := action.Params.(*MoveParams)
+		return moveTowards(cnpc, Vector2D{X: p.X, Y: p.Y}, dt, obstacles)
 	case MovePlayer:
 		p := action.Target.(*player.Player)
-		destination := action.Data.(Vector2D)
-		destination.X = destination.X + float64(p.Frame.Width)/2
-		destination.Y = destination.Y + float64(p.Frame.Height)/2
-		return moveTowards(p, destination)
+		params := action.Params.(*MoveParams)
+		destination := Vector2D{
+			X: params.X + float64(p.Frame.Width)/2,
+			Y: params.Y + float64(p.Frame.Height)/2,
+		}
+		return moveTowards(p, destination, dt, obstacles)
 	case FadeOut:
-		t.Alpha += action.Data.(float64)
+		t.Alpha += action.Params.(*FadeParams).Speed * dt
 		f := false
 		if t.Alpha >= 1.0 {
 			t.Alpha = 1.0
@@ -156,7 +194,7 @@ func (c *Cutscene) processAction(action CutsceneAction, t *shared.Transition, k
 		}
 		return f
 	case FadeIn:
-		t.Alpha -= action.Data.(float64)
+		t.Alpha -= action.Params.(*FadeParams).Speed * dt
 		f := false
 		if t.Alpha <= 0.0 {
 			t.Alpha = 0.0
@@ -166,55 +204,37 @@ func (c *Cutscene) processAction(action CutsceneAction, t *shared.Transition, k
 		return f
 	case TeleportPlayer:
 		p := action.Target.(*player.Player)
-		destination := action.Data.(Vector2D)
+		destination := action.Params.(*TeleportParams)
 		p.X = destination.X + float64(p.Frame.Width)/2
 		p.Y = destination.Y + float64(p.Frame.Height)/2
 		return true
 	case TeleportNPC:
 		cnpc := action.Target.(*npc.NPC)
-		destination := action.Data.(Vector2D)
+		destination := action.Params.(*TeleportParams)
 		cnpc.X = destination.X
 		cnpc.Y = destination.Y
 		return true
 	case TurnPlayer:
 		p := action.Target.(*player.Player)
-		dir := action.Data.(string)
-		p.Direction = dir
+		p.Direction = action.Params.(*TurnParams).Direction
 		return true
 	case TurnNPC:
 		p := action.Target.(*npc.NPC)
-		dir := action.Data.(string)
-		p.Direction = dir
+		p.Direction = action.Params.(*TurnParams).Direction
 		return true
 	case ShowDialogue:
 		d := action.Target.(*dialogue.Dialogue)
 		if !d.IsOpen {
-			d.IsOpen = true
-			d.CurrentLine = 0
-			d.CharIndex = 0
-			d.Finished = false
-			d.TextLines = action.Data.([]string)
-		} else {
-			if ebiten.IsKeyPressed(ebiten.KeyZ) && !k.KeyZ {
-				if d.Finished {
-					d.NextLine()
-					if !d.IsOpen {
-						return true
-					}
-				} else {
-					// Instantly display all characters in the current line
-					d.CharIndex = len(d.TextLines[d.CurrentLine])
-					d.Finished = true
-				}
-
+			d.Open(dialogue.Linear(action.Params.(*DialogueParams).Lines))
+		} else if in.JustPressed(input.Interact) || c.FastForward {
+			d.Advance()
+			if !d.IsOpen {
+				return true
 			}
-			d.Update()
-			// return d.Finished
 		}
 	case ChangeScene:
 		s := action.Target.(*string)
-		newScene := action.Data.(string)
-		*s = newScene
+		*s = action.Params.(*ChangeSceneParams).Scene
 		return true
 	case StopMusic:
 		m := action.Target.(*music.Music)
@@ -224,7 +244,7 @@ func (c *Cutscene) processAction(action CutsceneAction, t *shared.Transition, k
 		return true
 	case ChangeMusic:
 		m := action.Target.(*music.Music)
-		newSong := action.Data.(string)
+		newSong := action.Params.(*ChangeMusicParams).Song
 		t.Music = true
 		// Channel to signal when fade-out is complete
 		doneChan := make(chan struct{})
@@ -240,96 +260,182 @@ func (c *Cutscene) processAction(action CutsceneAction, t *shared.Transition, k
 			if m.IsPlaying() || m.Paused {
 				m.CloseAudio() // Ensure the current audio is closed
 			}
-			m.LoadAudio("./assets/" + newSong)
+			m.LoadAudio(newSong)
 			m.PlayAudio()
 			t.Music = false
 		}()
 		return true
-	case Wait:
-		t.Timer += 1
-		targetFloat, ok := action.Data.(float64) // Assert to float64 first
-		if !ok {
-			// Handle the error if the conversion fails
-			fmt.Println("Error: expected float64 for timer target")
-			return false
-		}
-		target := int(targetFloat) // Convert float64 to int
-		if t.Timer == target {
-			t.Timer = 0
+	case PanCamera:
+		cam := action.Target.(*camera.Camera)
+		p := action.Params.(*PanCameraParams)
+		if p.Release {
+			cam.Release()
 			return true
 		}
-		fmt.Println(t.Timer)
+		cam.PanTo(p.X, p.Y, p.Speed)
+		return !cam.Panning()
+	case ShakeCamera:
+		cam := action.Target.(*camera.Camera)
+		if c.status[i] == waiting {
+			p := action.Params.(*ShakeCameraParams)
+			cam.Shake(p.Intensity, p.Duration)
+		}
+		return !cam.Shaking()
+	case ZoomCamera:
+		cam := action.Target.(*camera.Camera)
+		if c.status[i] == waiting {
+			p := action.Params.(*ZoomCameraParams)
+			cam.ZoomTo(p.Zoom, p.Speed)
+		}
+		return !cam.Zooming()
+	case Emote:
+		p := action.Params.(*EmoteParams)
+		switch target := action.Target.(type) {
+		case *player.Player:
+			target.Emote = emote.New(p.Emote, p.Seconds)
+		case *npc.NPC:
+			target.Emote = emote.New(p.Emote, p.Seconds)
+		}
+		return true
+	case Join:
+		return c.joined(action)
+	case Wait:
+		c.elapsed[i] += dt
+		return c.elapsed[i] >= action.Params.(*WaitParams).Seconds
 	}
 	return false
 }
 
-func moveTowards(entity interface{}, target Vector2D) bool {
-	const speed = 5.0
-	res := false
+// Skip ends the cutscene at once, leaving everything the way it would be had
+// it played to the end: walks end at their destination, fades at their final
+// alpha, dialogue is closed and scene, music and flag changes all happen.
+func (c *Cutscene) Skip(t *shared.Transition, obstacles collisions.Collisions) {
+	if !c.IsPlaying {
+		return
+	}
+	// Finish actions in an order the tracks could have played them in
+	for changed := true; changed; {
+		changed = false
+		for _, tr := range c.tracks {
+			for k, i := range tr.actions {
+				if c.status[i] == done {
+					continue
+				}
+				if c.status[i] == waiting && !c.ready(tr, k) || c.Actions[i].ActionType == Join && !c.joined(c.Actions[i]) {
+					break
+				}
+				c.finish(i, c.Actions[i], t, obstacles)
+				c.status[i] = done
+				changed = true
+				if c.Actions[i].ActionType == Goto && c.goTo(tr, k) {
+					break
+				}
+			}
+		}
+	}
+	c.IsPlaying = false
+}
+
+// finish does what is left of an action in one go.
+func (c *Cutscene) finish(i int, action CutsceneAction, t *shared.Transition, obstacles collisions.Collisions) {
+	switch action.ActionType {
+	case If, Repeat, Call:
+		for sub := c.block(i, action); sub != nil; {
+			sub.Skip(t, obstacles)
+			if !c.again(i, action, sub) {
+				break
+			}
+		}
+	case MoveNPC:
+		n := action.Target.(*npc.NPC)
+		p := action.Params.(*MoveParams)
+		n.X, n.Y = p.X, p.Y
+	case MovePlayer:
+		p := action.Target.(*player.Player)
+		params := action.Params.(*MoveParams)
+		p.X = params.X + float64(p.Frame.Width)/2
+		p.Y = params.Y + float64(p.Frame.Height)/2
+	case FadeOut:
+		t.Alpha = 1
+	case FadeIn:
+		t.Alpha = 0
+	case ShowDialogue:
+		d := action.Target.(*dialogue.Dialogue)
+		d.IsOpen = false
+	case PanCamera:
+		cam := action.Target.(*camera.Camera)
+		p := action.Params.(*PanCameraParams)
+		if p.Release {
+			cam.Release()
+		} else {
+			cam.PanTo(p.X, p.Y, 0)
+		}
+	case ShakeCamera:
+		action.Target.(*camera.Camera).Shake(0, 0)
+	case ZoomCamera:
+		action.Target.(*camera.Camera).ZoomTo(action.Params.(*ZoomCameraParams).Zoom, 0)
+	case Emote:
+		// Nobody would see it, the cutscene is over
+	case Join, Goto:
+		// Skip only gets here once the join is over, and does the jump itself
+	default:
+		// Everything else is over in a single tick anyway
+		c.processAction(i, action, t, nil, 0, obstacles)
+	}
+}
+
+// walkSpeed is how fast cutscene walks go, in pixels per second.
+const walkSpeed = 300.0
+
+// moveTowards walks for dt seconds of a cutscene walk. Obstacles end the walk
+// early rather than leave the cutscene stuck on a wall.
+func moveTowards(entity interface{}, target Vector2D, dt float64, c collisions.Collisions) bool {
+	step := walkSpeed * dt
 	switch e := entity.(type) {
 	case *player.Player:
-		fmt.Println(e.X, e.Y)
-		if e.X > target.X {
-			e.Direction = "left"
-			e.X -= speed
-		} else if e.X < target.X {
-			e.Direction = "right"
-			e.X += speed
-		} else if e.Y < target.Y {
-			e.Direction = "down"
-			e.Y += speed
-		} else if e.Y > target.Y {
-			e.Direction = "up"
-			e.Y -= speed
-		} else {
+		x, y, direction, done := walkStep(e.X, e.Y, target, step)
+		if done {
 			e.Frame.Count = 2
-			res = true
-			fmt.Println("Achieved")
+			return true
 		}
-		e.Frame.TickCount++
-		if e.Frame.TickCount >= 10 && !res {
-			e.Frame.Current = (e.Frame.Current + 1) % e.Frame.Count
-			e.Frame.TickCount = 0 // Reset the tick count
+		e.Direction = direction
+		if e.Colliding(c, x, y) {
+			log.Printf("Cutscene: player blocked at %v,%v on the way to %v,%v", e.X, e.Y, target.X, target.Y)
+			return true
 		}
-		fmt.Println(e.Direction)
+		e.X, e.Y = x, y
+		e.Frame.Animate(dt)
 	case *npc.NPC:
-		fmt.Println(e.X, e.Y)
-		if e.X > target.X {
-			e.Direction = "left"
-			e.X -= speed
-		} else if e.X < target.X {
-			e.Direction = "right"
-			e.X += speed
-		} else if e.Y < target.Y {
-			e.Direction = "down"
-			e.Y += speed
-		} else if e.Y > target.Y {
-			e.Direction = "up"
-			e.Y -= speed
-		} else {
-			// e.CurrentFrame = 2
-			res = true
-			fmt.Println("Achieved")
+		x, y, direction, done := walkStep(e.X, e.Y, target, step)
+		if done {
+			return true
 		}
-		e.Frame.TickCount++
-		if e.Frame.TickCount >= 10 && !res {
-			e.Frame.Current = (e.Frame.Current + 1) % e.Frame.Count
-			e.Frame.TickCount = 0 // Reset the tick count
+		e.Direction = direction
+		if c.Blocked(e.Rect(x, y)) {
+			log.Printf("Cutscene: %s blocked at %v,%v on the way to %v,%v", e.Name, e.X, e.Y, target.X, target.Y)
+			return true
 		}
-		fmt.Println(e.Direction)
+		e.X, e.Y = x, y
+		e.Frame.Animate(dt)
 	default:
-		res = true
+		return true
 	}
-
-	return res
+	return false
 }
 
-// getActionType returns the CutsceneActionType for a given string
-func getActionType(actionType string) CutsceneActionType {
-	if val, ok := actionMap[actionType]; ok {
-		return val
+// walkStep moves from x, y up to step pixels towards target, first along X and
+// then along Y, and returns the direction that faces. done is set once x, y
+// is the target.
+func walkStep(x, y float64, target Vector2D, step float64) (float64, float64, string, bool) {
+	switch {
+	case x > target.X:
+		return math.Max(x-step, target.X), y, "left", false
+	case x < target.X:
+		return math.Min(x+step, target.X), y, "right", false
+	case y < target.Y:
+		return x, math.Min(y+step, target.Y), "down", false
+	case y > target.Y:
+		return x, math.Max(y-step, target.Y), "up", false
 	}
-	// Handle the case where the actionType is not found
-	fmt.Println("Invalid action type:", actionType)
-	return -1
+	return x, y, "", true
 }
@@ -0,0 +1,123 @@
+package cutscene
+
+import (
+	"log"
+	"rpg_demo/world"
+	"strings"
+)
+
+// Limits that keep a broken cutscene from hanging the game.
+const (
+	MaxJumps     = 1000 // Gotos one cutscene can take before it's stopped
+	MaxCallDepth = 16   // Calls that can be nested inside each other
+	MaxRepeat    = 1000 // Most times a Repeat can play its actions
+)
+
+// LibraryFile holds the cutscenes every scene can Call. It has the layout of a
+// scene file but only its cutscenes are used.
+const LibraryFile = "cutscenes.json"
+
+// Library finds the cutscene a Call plays, ready to play in the current scene.
+type Library func(id string) (*Cutscene, error)
+
+// block returns the nested cutscene action i plays: the branch an If picked,
+// the actions of a Repeat or the cutscene a Call plays. It's made the first
+// time it's needed, and is nil for a Call that can't be played.
+func (c *Cutscene) block(i int, action CutsceneAction) *Cutscene {
+	if sub, ok := c.blocks[i]; ok {
+		return sub
+	}
+	var sub *Cutscene
+	switch p := action.Params.(type) {
+	case *IfParams:
+		sub = &Cutscene{ID: c.ID, Actions: p.Else, depth: c.depth}
+		if p.Condition.Holds(action.Target.(*world.Vars)) {
+			sub.Actions = p.Then
+		}
+	case *RepeatParams:
+		sub = &Cutscene{ID: c.ID, Actions: p.Actions, depth: c.depth}
+	case *CallParams:
+		if c.depth >= MaxCallDepth {
+			log.Printf("Cutscene %s: calls nested more than %d deep, not calling %s", c.stack(), MaxCallDepth, p.Cutscene)
+			break
+		}
+		callee, err := action.Target.(Library)(p.Cutscene)
+		if err != nil {
+			log.Printf("Cutscene %s: can't call %s: %s", c.stack(), p.Cutscene, err)
+			break
+		}
+		sub = callee
+		sub.depth = c.depth + 1
+	}
+	if sub != nil {
+		sub.caller = c
+		sub.Start()
+	}
+	// A Call that failed is remembered too, so it's only reported once
+	c.blocks[i] = sub
+	return sub
+}
+
+// again restarts the actions of a Repeat that hasn't played them enough
+// times yet, and reports whether it did.
+func (c *Cutscene) again(i int, action CutsceneAction, sub *Cutscene) bool {
+	p, ok := action.Params.(*RepeatParams)
+	if !ok {
+		return false
+	}
+	c.repeats[i]++
+	if c.repeats[i] >= p.Times {
+		return false
+	}
+	sub.Start()
+	return true
+}
+
+// goTo takes the k-th action of tr, a Goto that just ran, to its label if its
+// condition holds, and reports whether it did. Going back plays the actions
+// from the label again, going forward skips the ones in between.
+func (c *Cutscene) goTo(tr *track, k int) bool {
+	action := c.Actions[tr.actions[k]]
+	p := action.Params.(*GotoParams)
+	if !p.Condition.Holds(action.Target.(*world.Vars)) {
+		return false
+	}
+	c.jumps++
+	if c.jumps > MaxJumps {
+		log.Printf("Cutscene %s: more than %d gotos, stopping it", c.stack(), MaxJumps)
+		for i := range c.status {
+			c.status[i] = done
+		}
+		return true
+	}
+	to := 0
+	for m, i := range tr.actions {
+		if c.Actions[i].Label == p.Label {
+			to = m
+		}
+	}
+	if to > k {
+		for _, i := range tr.actions[k+1 : to] {
+			c.status[i] = done
+		}
+		return true
+	}
+	for _, i := range tr.actions[to : k+1] {
+		c.status[i] = waiting
+		c.elapsed[i] = 0
+		c.repeats[i] = 0
+		delete(c.blocks, i)
+	}
+	return true
+}
+
+// stack describes the chain of Calls that led to c, for log messages.
+func (c *Cutscene) stack() string {
+	var ids []string
+	for f := c; f != nil; f = f.caller {
+		if f.caller == nil || f.caller.depth != f.depth {
+			ids = append([]string{f.ID}, ids...)
+		}
+	}
+	return strings.Join(ids, " > ")
+}
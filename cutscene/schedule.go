@@ -0,0 +1,156 @@
+package cutscene
+
+import "fmt"
+
+// MainTrack is the track of actions that don't name one.
+const MainTrack = "main"
+
+type status int
+
+const (
+	waiting status = iota
+	running
+	done
+)
+
+// track is a list of actions that play one after the other, by index into
+// the cutscene's actions.
+type track struct {
+	name    string
+	actions []int
+}
+
+func splitTracks(actions []CutsceneAction) []*track {
+	var tracks []*track
+	byName := make(map[string]*track)
+	for i, action := range actions {
+		tr, ok := byName[action.Track]
+		if !ok {
+			tr = &track{name: action.Track}
+			byName[action.Track] = tr
+			tracks = append(tracks, tr)
+		}
+		tr.actions = append(tr.actions, i)
+	}
+	return tracks
+}
+
+// ready reports whether the k-th action of tr may start. An action starts
+// alongside the one before it on its track, or once every earlier action on
+// the track is done if it has WaitPrevious, and never before what it waits for.
+// Nothing after a Join starts until the Join is done.
+func (c *Cutscene) ready(tr *track, k int) bool {
+	if k > 0 && c.status[tr.actions[k-1]] == waiting {
+		return false
+	}
+	for _, i := range tr.actions[:k] {
+		if c.Actions[i].ActionType == Join && c.status[i] != done {
+			return false
+		}
+	}
+	action := c.Actions[tr.actions[k]]
+	if action.WaitPrevious {
+		for _, i := range tr.actions[:k] {
+			if c.status[i] != done {
+				return false
+			}
+		}
+	}
+	for _, name := range action.WaitFor {
+		if !c.finished(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// finished reports whether the action labeled name, or every action of the
+// track called name, is done.
+func (c *Cutscene) finished(name string) bool {
+	for i, action := range c.Actions {
+		if (action.Label == name || action.Track == name) && c.status[i] != done {
+			return false
+		}
+	}
+	return true
+}
+
+// joined reports whether everything a Join waits for is done.
+func (c *Cutscene) joined(action CutsceneAction) bool {
+	names := action.Params.(*JoinParams).Tracks
+	if len(names) == 0 {
+		for i, other := range c.Actions {
+			if other.Track != action.Track && c.status[i] != done {
+				return false
+			}
+		}
+		return true
+	}
+	for _, name := range names {
+		if !c.finished(name) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Cutscene) allDone() bool {
+	for _, s := range c.status {
+		if s != done {
+			return false
+		}
+	}
+	return true
+}
+
+// syncError is a problem checkSync found with the action at index.
+type syncError struct {
+	index int
+	err   error
+}
+
+func (e *syncError) Error() string {
+	return fmt.Sprintf("action %d: %s", e.index, e.err)
+}
+
+// checkSync makes sure every label, WaitFor and Join in a list of actions
+// refers to something in the same list, and that nothing waits for itself.
+func checkSync(actions []CutsceneAction) error {
+	tracks := make(map[string]bool)
+	labels := make(map[string]int)
+	for i, action := range actions {
+		tracks[action.Track] = true
+		if action.Label == "" {
+			continue
+		}
+		if _, ok := labels[action.Label]; ok {
+			return &syncError{i, fmt.Errorf("duplicate label %q", action.Label)}
+		}
+		labels[action.Label] = i
+	}
+	for i, action := range actions {
+		if tracks[action.Label] {
+			return &syncError{i, fmt.Errorf("label %q is also a track", action.Label)}
+		}
+		names := action.WaitFor
+		if p, ok := action.Params.(*JoinParams); ok {
+			names = append(names[:len(names):len(names)], p.Tracks...)
+		}
+		if p, ok := action.Params.(*GotoParams); ok {
+			j, isLabel := labels[p.Label]
+			if !isLabel || actions[j].Track != action.Track {
+				return &syncError{i, fmt.Errorf("no label %q on track %q to go to", p.Label, action.Track)}
+			}
+		}
+		for _, name := range names {
+			j, isLabel := labels[name]
+			switch {
+			case !isLabel && !tracks[name]:
+				return &syncError{i, fmt.Errorf("no label or track %q", name)}
+			case isLabel && j == i || name == action.Track:
+				return &syncError{i, fmt.Errorf("waits for itself through %q", name)}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package cutscene
+
+import (
+	"rpg_demo/collisions"
+	"rpg_demo/shared"
+	"testing"
+)
+
+func TestJoinHoldsBackTheRestOfItsTrack(t *testing.T) {
+	// The main track waits half a second and joins track b, which waits a
+	// second. The wait after the Join may only start once b is done.
+	c := &Cutscene{ID: "join", Actions: []CutsceneAction{
+		{ActionType: Wait, Track: MainTrack, Params: &WaitParams{Seconds: 0.5}},
+		{ActionType: Join, Track: MainTrack, Params: &JoinParams{Tracks: []string{"b"}}},
+		{ActionType: Wait, Track: MainTrack, Params: &WaitParams{Seconds: 0.25}},
+		{ActionType: Wait, Track: "b", Params: &WaitParams{Seconds: 1}},
+	}}
+	if err := checkSync(c.Actions); err != nil {
+		t.Fatal(err)
+	}
+	c.Start()
+	tr := &shared.Transition{}
+	for tick := 1; tick <= 4; tick++ {
+		c.Update(tr, nil, 0.25, collisions.Collisions{})
+		if c.status[2] != waiting {
+			t.Fatalf("tick %d: the wait after the Join started before track b was done", tick)
+		}
+	}
+	if c.status[0] != done || c.status[3] != done || c.status[1] == done {
+		t.Fatalf("after a second: statuses %v, want both waits done and the Join not yet", c.status)
+	}
+	// The Join sees b done on the next tick, and the short wait starts and ends with it
+	c.Update(tr, nil, 0.25, collisions.Collisions{})
+	if c.IsPlaying {
+		t.Errorf("still playing with statuses %v", c.status)
+	}
+}
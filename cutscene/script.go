@@ -0,0 +1,616 @@
+package cutscene
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"rpg_demo/data"
+	"strconv"
+	"strings"
+)
+
+// ScriptExt is the extension of cutscene script files.
+const ScriptExt = ".evt"
+
+// Scripts are a shorter way to write a cutscene's actions, one per line:
+//
+//	# Bryan shows the player around
+//	fadeout 0.6
+//	teleport player 0,0
+//	move player 150,200
+//	& move Bryan 200,200
+//	say "This is our first Scene." "Pretty Cool huh?"
+//	if flag watchedExampleCutscene
+//	    set ability.ghostMode true
+//	end
+//
+// Every action waits for the one before it unless the line starts with &.
+// Before the command a line can also have @track to put the action on a
+// track and after=a,b to wait for labels or tracks. A line with just name:
+// labels the next action. # starts a comment.
+//
+// The commands are:
+//
+//	move <player|NPC> x,y             walk there
+//	teleport <player|NPC> x,y
+//	turn <player|NPC> up|down|left|right
+//	fadein <speed>, fadeout <speed>   alpha per second
+//	say "line" "line"...              a line without quotes is one line of dialogue
+//	scene <name>
+//	music <song>, music stop
+//	wait <frames>, wait <seconds>s    a bare number counts frames, like in scene files
+//	set <variable> <value>
+//	pan x,y [speed], pan release
+//	shake <intensity> <seconds>
+//	zoom <zoom> [speed]
+//	if <condition> ... [else ...] end   "flag x" and "choice node n" work as conditions too
+//	repeat <times> ... end
+//	goto <label> [if <condition>]
+//	call <cutscene>
+//	join [track or label...]
+//	emote <player|NPC> !|?|heart|sweat [seconds]
+type scriptCommand func(p *scriptParser, args []token, a *data.CutsceneAction) error
+
+var scriptCommands map[string]scriptCommand
+
+func init() {
+	// Filled in here because if and repeat parse nested blocks through the map
+	scriptCommands = map[string]scriptCommand{
+		"move":     moveCommand,
+		"teleport": teleportCommand,
+		"turn":     turnCommand,
+		"fadein":   fadeCommand("FadeIn"),
+		"fadeout":  fadeCommand("FadeOut"),
+		"say":      sayCommand,
+		"scene":    sceneCommand,
+		"music":    musicCommand,
+		"wait":     waitCommand,
+		"set":      setCommand,
+		"pan":      panCommand,
+		"shake":    shakeCommand,
+		"zoom":     zoomCommand,
+		"if":       ifCommand,
+		"repeat":   repeatCommand,
+		"goto":     gotoCommand,
+		"call":     callCommand,
+		"join":     joinCommand,
+		"emote":    emoteCommand,
+	}
+}
+
+// LoadScripts fills in the actions of every cutscene that names a script,
+// reading the scripts from fsys.
+func LoadScripts(fsys fs.FS, cutscenes []data.CutsceneData) error {
+	for i := range cutscenes {
+		c := &cutscenes[i]
+		if c.Script == "" {
+			continue
+		}
+		if len(c.Actions) > 0 {
+			return fmt.Errorf("cutscene %q: has both a script and actions", c.ID)
+		}
+		src, err := fs.ReadFile(fsys, c.Script)
+		if err != nil {
+			return fmt.Errorf("cutscene %q: %w", c.ID, err)
+		}
+		if c.Actions, err = ParseScript(c.Script, string(src)); err != nil {
+			return fmt.Errorf("cutscene %q: %w", c.ID, err)
+		}
+	}
+	return nil
+}
+
+// ParseScript turns a script into the actions a scene file would have. Errors
+// start with name and the line number.
+func ParseScript(name, src string) ([]data.CutsceneAction, error) {
+	p := &scriptParser{name: name, lines: strings.Split(src, "\n")}
+	actions, end, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+	if end != "" {
+		return nil, p.errorf("%s without if or repeat", end)
+	}
+	return actions, nil
+}
+
+type scriptParser struct {
+	name  string
+	lines []string
+	line  int // Number of the line being parsed, from 1
+}
+
+// token is a word of a script line. Quoted strings are one token.
+type token struct {
+	Text   string // Without quotes
+	Raw    string // As written
+	Quoted bool
+}
+
+func (p *scriptParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%s:%d: %s", p.name, p.line, fmt.Sprintf(format, args...))
+}
+
+// block parses lines up to the end of the script or an else or end line,
+// which it returns.
+func (p *scriptParser) block() ([]data.CutsceneAction, string, error) {
+	var actions []data.CutsceneAction
+	var decoded []CutsceneAction
+	var lines []int
+	label := ""
+	end := ""
+	for p.line < len(p.lines) && end == "" {
+		p.line++
+		tokens, err := tokenize(p.lines[p.line-1])
+		if err != nil {
+			return nil, "", p.errorf("%s", err)
+		}
+		if len(tokens) == 0 {
+			continue
+		}
+		if first := tokens[0]; !first.Quoted && (first.Text == "else" || first.Text == "end") {
+			if len(tokens) > 1 {
+				return nil, "", p.errorf("%s takes nothing after it", first.Text)
+			}
+			end = first.Text
+			break
+		}
+		if len(tokens) == 1 && !tokens[0].Quoted && strings.HasSuffix(tokens[0].Text, ":") {
+			if label != "" {
+				return nil, "", p.errorf("two labels for the same action")
+			}
+			label = strings.TrimSuffix(tokens[0].Text, ":")
+			continue
+		}
+		a := data.CutsceneAction{WaitPrevious: true, Label: label}
+		label = ""
+		line := p.line
+		if tokens, err = modifiers(tokens, &a); err != nil {
+			return nil, "", p.errorf("%s", err)
+		}
+		if len(tokens) == 0 {
+			return nil, "", p.errorf("missing command")
+		}
+		command, ok := scriptCommands[tokens[0].Text]
+		if !ok || tokens[0].Quoted {
+			return nil, "", p.errorf("unknown command %q", tokens[0].Text)
+		}
+		if err := command(p, tokens[1:], &a); err != nil {
+			// Nested blocks have already said where
+			if strings.HasPrefix(err.Error(), p.name+":") {
+				return nil, "", err
+			}
+			return nil, "", fmt.Errorf("%s:%d: %s: %w", p.name, line, tokens[0].Text, err)
+		}
+		action, err := decodeAction(a)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s:%d: %s: %w", p.name, line, tokens[0].Text, err)
+		}
+		actions = append(actions, a)
+		decoded = append(decoded, action)
+		lines = append(lines, line)
+	}
+	if label != "" {
+		return nil, "", p.errorf("label %s: no action after it", label)
+	}
+	var sync *syncError
+	if err := checkSync(decoded); errors.As(err, &sync) {
+		return nil, "", fmt.Errorf("%s:%d: %s", p.name, lines[sync.index], sync.err)
+	}
+	return actions, end, nil
+}
+
+// modifiers takes &, @track and after=... off the front of a line.
+func modifiers(tokens []token, a *data.CutsceneAction) ([]token, error) {
+	for len(tokens) > 0 && !tokens[0].Quoted {
+		t := tokens[0].Text
+		switch {
+		case t == "&":
+			a.WaitPrevious = false
+		case strings.HasPrefix(t, "@"):
+			if a.Track = t[1:]; a.Track == "" {
+				return nil, fmt.Errorf("@ needs a track name")
+			}
+		case strings.HasPrefix(t, "after="):
+			for _, name := range strings.Split(t[len("after="):], ",") {
+				if name == "" {
+					return nil, fmt.Errorf("empty name in %s", t)
+				}
+				a.WaitFor = append(a.WaitFor, name)
+			}
+		default:
+			return tokens, nil
+		}
+		tokens = tokens[1:]
+	}
+	return tokens, nil
+}
+
+// tokenize splits a line into words, keeping "quoted strings" together and
+// dropping comments.
+func tokenize(line string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(line); {
+		switch c := line[i]; {
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#':
+			return tokens, nil
+		case c == '"':
+			j := i + 1
+			for j < len(line) && line[j] != '"' {
+				if line[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(line) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			raw := line[i : j+1]
+			text, err := strconv.Unquote(raw)
+			if err != nil {
+				return nil, fmt.Errorf("bad string %s", raw)
+			}
+			tokens = append(tokens, token{Text: text, Raw: raw, Quoted: true})
+			i = j + 1
+		default:
+			j := i
+			for j < len(line) && !strings.ContainsRune(" \t\r#\"", rune(line[j])) {
+				j++
+			}
+			tokens = append(tokens, token{Text: line[i:j], Raw: line[i:j]})
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// setData stores v as the action's data.
+func setData(a *data.CutsceneAction, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	a.Data = b
+	return nil
+}
+
+func wantArgs(args []token, min, max int, usage string) error {
+	if len(args) < min || len(args) > max {
+		return fmt.Errorf("usage: %s", usage)
+	}
+	return nil
+}
+
+func number(t token) (float64, error) {
+	f, err := strconv.ParseFloat(t.Text, 64)
+	if err != nil || t.Quoted {
+		return 0, fmt.Errorf("%q is not a number", t.Text)
+	}
+	return f, nil
+}
+
+// point reads x,y.
+func point(t token) (map[string]float64, error) {
+	xs, ys, ok := strings.Cut(t.Text, ",")
+	x, errX := strconv.ParseFloat(xs, 64)
+	y, errY := strconv.ParseFloat(ys, 64)
+	if !ok || errX != nil || errY != nil || t.Quoted {
+		return nil, fmt.Errorf("%q is not a position like 100,200", t.Text)
+	}
+	return map[string]float64{"x": x, "y": y}, nil
+}
+
+// target sets the action type for the player or an NPC.
+func target(a *data.CutsceneAction, who token, player, npc string) {
+	a.ActionType, a.TargetID = npc, who.Text
+	if who.Text == "player" {
+		a.ActionType = player
+	}
+}
+
+func moveCommand(p *scriptParser, args []token, a *data.CutsceneAction) error {
+	if err := wantArgs(args, 2, 2, "move <player|NPC> x,y"); err != nil {
+		return err
+	}
+	target(a, args[0], "MovePlayer", "MoveNPC")
+	pos, err := point(args[1])
+	if err != nil {
+		return err
+	}
+	return setData(a, pos)
+}
+
+func teleportCommand(p *scriptParser, args []token, a *data.CutsceneAction) error {
+	if err := wantArgs(args, 2, 2, "teleport <player|NPC> x,y"); err != nil {
+		return err
+	}
+	target(a, args[0], "TeleportPlayer", "TeleportNPC")
+	pos, err := point(args[1])
+	if err != nil {
+		return err
+	}
+	return setData(a, pos)
+}
+
+func turnCommand(p *scriptParser, args []token, a *data.CutsceneAction) error {
+	if err := wantArgs(args, 2, 2, "turn <player|NPC> up|down|left|right"); err != nil {
+		return err
+	}
+	target(a, args[0], "TurnPlayer", "TurnNPC")
+	return setData(a, args[1].Text)
+}
+
+func fadeCommand(actionType string) scriptCommand {
+	return func(p *scriptParser, args []token, a *data.CutsceneAction) error {
+		if err := wantArgs(args, 1, 1, strings.ToLower(actionType)+" <speed>"); err != nil {
+			return err
+		}
+		a.ActionType = actionType
+		speed, err := number(args[0])
+		if err != nil {
+			return err
+		}
+		return setData(a, map[string]float64{"speed": speed})
+	}
+}
+
+func sayCommand(p *scriptParser, args []token, a *data.CutsceneAction) error {
+	if err := wantArgs(args, 1, len(args), `say "line" "line"...`); err != nil {
+		return err
+	}
+	a.ActionType = "ShowDialogue"
+	var lines, words []string
+	for _, t := range args {
+		if t.Quoted {
+			lines = append(lines, t.Text)
+		} else {
+			words = append(words, t.Text)
+		}
+	}
+	if len(lines) > 0 && len(words) > 0 {
+		return fmt.Errorf("either quote every line or none")
+	}
+	if len(words) > 0 {
+		lines = []string{strings.Join(words, " ")}
+	}
+	return setData(a, lines)
+}
+
+func sceneCommand(p *scriptParser, args []token, a *data.CutsceneAction) error {
+	if err := wantArgs(args, 1, 1, "scene <name>"); err != nil {
+		return err
+	}
+	a.ActionType = "ChangeScene"
+	return setData(a, args[0].Text)
+}
+
+func musicCommand(p *scriptParser, args []token, a *data.CutsceneAction) error {
+	if err := wantArgs(args, 1, 1, "music <song|stop>"); err != nil {
+		return err
+	}
+	if args[0].Text == "stop" && !args[0].Quoted {
+		a.ActionType = "StopMusic"
+		return nil
+	}
+	a.ActionType = "ChangeMusic"
+	return setData(a, args[0].Text)
+}
+
+func waitCommand(p *scriptParser, args []token, a *data.CutsceneAction) error {
+	const usage = "wait <frames>, wait <n> frames, wait <seconds>s or wait <n> seconds"
+	if err := wantArgs(args, 1, 2, usage); err != nil {
+		return err
+	}
+	a.ActionType = "Wait"
+	// A bare number counts frames, like in scene files
+	count, unit := args[0], "frames"
+	if len(args) == 2 {
+		unit = args[1].Text
+	} else if text, ok := strings.CutSuffix(count.Text, "s"); ok && !count.Quoted {
+		count.Text, unit = text, "seconds"
+	}
+	n, err := number(count)
+	if err != nil {
+		return err
+	}
+	switch unit {
+	case "seconds":
+		return setData(a, map[string]float64{"seconds": n})
+	case "frames":
+		if n != float64(int(n)) {
+			return fmt.Errorf("frames must be a whole number, use %vs for seconds", n)
+		}
+		return setData(a, map[string]int{"frames": int(n)})
+	}
+	return fmt.Errorf("usage: %s", usage)
+}
+
+func setCommand(p *scriptParser, args []token, a *data.CutsceneAction) error {
+	if err := wantArgs(args, 2, 2, "set <variable> <value>"); err != nil {
+		return err
+	}
+	a.ActionType = "SetFlag"
+	value := json.RawMessage(args[1].Text)
+	if args[1].Quoted || !json.Valid(value) {
+		// Anything that isn't true, false or a number is a string
+		b, err := json.Marshal(args[1].Text)
+		if err != nil {
+			return err
+		}
+		value = b
+	}
+	return setData(a, map[string]interface{}{"name": args[0].Text, "value": value})
+}
+
+func panCommand(p *scriptParser, args []token, a *data.CutsceneAction) error {
+	if err := wantArgs(args, 1, 2, "pan x,y [speed] or pan release"); err != nil {
+		return err
+	}
+	a.ActionType = "PanCamera"
+	if args[0].Text == "release" && len(args) == 1 {
+		return setData(a, map[string]bool{"release": true})
+	}
+	pos, err := point(args[0])
+	if err != nil {
+		return err
+	}
+	if len(args) == 2 {
+		if pos["speed"], err = number(args[1]); err != nil {
+			return err
+		}
+	}
+	return setData(a, pos)
+}
+
+func shakeCommand(p *scriptParser, args []token, a *data.CutsceneAction) error {
+	if err := wantArgs(args, 2, 2, "shake <intensity> <seconds>"); err != nil {
+		return err
+	}
+	a.ActionType = "ShakeCamera"
+	intensity, err := number(args[0])
+	if err != nil {
+		return err
+	}
+	duration, err := number(args[1])
+	if err != nil {
+		return err
+	}
+	return setData(a, map[string]float64{"intensity": intensity, "duration": duration})
+}
+
+func zoomCommand(p *scriptParser, args []token, a *data.CutsceneAction) error {
+	if err := wantArgs(args, 1, 2, "zoom <zoom> [speed]"); err != nil {
+		return err
+	}
+	a.ActionType = "ZoomCamera"
+	params := map[string]float64{}
+	var err error
+	if params["zoom"], err = number(args[0]); err != nil {
+		return err
+	}
+	if len(args) == 2 {
+		if params["speed"], err = number(args[1]); err != nil {
+			return err
+		}
+	}
+	return setData(a, params)
+}
+
+// condition turns the rest of a line into a condition, with shorthands for
+// flags and dialogue choices.
+func condition(args []token) (string, error) {
+	if len(args) == 0 {
+		return "", fmt.Errorf("missing condition")
+	}
+	switch {
+	case args[0].Text == "flag" && len(args) == 2:
+		return args[1].Text, nil
+	case args[0].Text == "choice" && len(args) == 3:
+		return fmt.Sprintf("choice.%s == %s", args[1].Text, args[2].Text), nil
+	}
+	raw := make([]string, len(args))
+	for i, t := range args {
+		raw[i] = t.Raw
+	}
+	return strings.Join(raw, " "), nil
+}
+
+func ifCommand(p *scriptParser, args []token, a *data.CutsceneAction) error {
+	cond, err := condition(args)
+	if err != nil {
+		return err
+	}
+	a.ActionType = "If"
+	line := p.line
+	then, end, err := p.block()
+	if err != nil {
+		return err
+	}
+	var otherwise []data.CutsceneAction
+	if end == "else" {
+		if otherwise, end, err = p.block(); err != nil {
+			return err
+		}
+	}
+	if end != "end" {
+		p.line = line
+		return p.errorf("if without end")
+	}
+	return setData(a, map[string]interface{}{"condition": cond, "then": then, "else": otherwise})
+}
+
+func repeatCommand(p *scriptParser, args []token, a *data.CutsceneAction) error {
+	if err := wantArgs(args, 1, 1, "repeat <times> ... end"); err != nil {
+		return err
+	}
+	a.ActionType = "Repeat"
+	times, err := strconv.Atoi(args[0].Text)
+	if err != nil {
+		return fmt.Errorf("%q is not a whole number", args[0].Text)
+	}
+	line := p.line
+	actions, end, err := p.block()
+	if err != nil {
+		return err
+	}
+	if end != "end" {
+		p.line = line
+		return p.errorf("repeat without end")
+	}
+	return setData(a, map[string]interface{}{"times": times, "actions": actions})
+}
+
+func gotoCommand(p *scriptParser, args []token, a *data.CutsceneAction) error {
+	if len(args) != 1 && (len(args) < 3 || args[1].Text != "if") {
+		return fmt.Errorf("usage: goto <label> [if <condition>]")
+	}
+	a.ActionType = "Goto"
+	params := map[string]string{"label": args[0].Text}
+	if len(args) > 1 {
+		cond, err := condition(args[2:])
+		if err != nil {
+			return err
+		}
+		params["condition"] = cond
+	}
+	return setData(a, params)
+}
+
+func callCommand(p *scriptParser, args []token, a *data.CutsceneAction) error {
+	if err := wantArgs(args, 1, 1, "call <cutscene>"); err != nil {
+		return err
+	}
+	a.ActionType = "Call"
+	return setData(a, args[0].Text)
+}
+
+func joinCommand(p *scriptParser, args []token, a *data.CutsceneAction) error {
+	a.ActionType = "Join"
+	if len(args) == 0 {
+		return nil
+	}
+	names := make([]string, len(args))
+	for i, t := range args {
+		names[i] = t.Text
+	}
+	return setData(a, names)
+}
+
+func emoteCommand(p *scriptParser, args []token, a *data.CutsceneAction) error {
+	if err := wantArgs(args, 2, 3, "emote <player|NPC> !|?|heart|sweat [seconds]"); err != nil {
+		return err
+	}
+	a.ActionType, a.TargetID = "Emote", args[0].Text
+	params := map[string]interface{}{"emote": args[1].Text}
+	if len(args) == 3 {
+		seconds, err := number(args[2])
+		if err != nil {
+			return err
+		}
+		params["seconds"] = seconds
+	}
+	return setData(a, params)
+}
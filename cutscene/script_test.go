@@ -0,0 +1,43 @@
+package cutscene
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWaitUnits(t *testing.T) {
+	for _, c := range []struct {
+		line string
+		want WaitParams
+	}{
+		// A bare number counts frames, the same as {"data": 60} in a scene file
+		{"wait 60", WaitParams{Seconds: 1}},
+		{"wait 30 frames", WaitParams{Seconds: 0.5}},
+		{"wait 1.5s", WaitParams{Seconds: 1.5}},
+		{"wait 2 seconds", WaitParams{Seconds: 2}},
+	} {
+		raw, err := ParseScript("test.evt", c.line)
+		if err != nil {
+			t.Errorf("%s: %s", c.line, err)
+			continue
+		}
+		actions, err := DecodeActions(raw)
+		if err != nil {
+			t.Errorf("%s: %s", c.line, err)
+			continue
+		}
+		if got := *actions[0].Params.(*WaitParams); got != c.want {
+			t.Errorf("%s: got %+v, want %+v", c.line, got, c.want)
+		}
+	}
+}
+
+func TestWaitErrors(t *testing.T) {
+	for _, line := range []string{"wait 1.5", "wait 2 minutes", "wait soon", "wait \"1s\""} {
+		if _, err := ParseScript("test.evt", line); err == nil {
+			t.Errorf("%s: parsed", line)
+		} else if !strings.HasPrefix(err.Error(), "test.evt:1:") {
+			t.Errorf("%s: error %q doesn't give the line", line, err)
+		}
+	}
+}
@@ -2,8 +2,8 @@ package data
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
-	"log"
 	"os"
 )
 
@@ -13,6 +13,7 @@ type Data struct {
 	Doors     []DoorData
 	NPCs      []NPCData
 	Cutscenes []CutsceneData
+	Triggers  []TriggerData
 	Music     string
 }
 
@@ -34,11 +35,42 @@ type DoorData struct {
 	NewX, NewY  float64
 	Destination string
 	Id          string
+	Condition   string // The door stays locked unless this holds
+}
+type TriggerData struct {
+	ID        string // Remembers a trigger that only fires once, defaults to its position in the list
+	On        string // "enter" (the default), "exit", "interact", "sceneEntry" or "flag"
+	X1, Y1    int    // Area for enter and exit
+	X2, Y2    int
+	NPC       string // NPC to talk to for interact
+	Condition string // Only fires while this holds, for flag it fires when this becomes true
+	Cutscene  string // Played when the trigger fires
+	Once      bool   // Never fires again once it has, even after a save and load
 }
 type BehaviorData struct {
 	Type    string                 // A string to denote the type of behavior (e.g., "walker", "talker")
 	Details map[string]interface{} // Additional details specific to each behavior type
 }
+type DialogueChoiceData struct {
+	Text      string
+	Next      string
+	Condition string // Only offered when this holds
+}
+type DialogueNodeData struct {
+	ID        string
+	Speaker   string
+	Text      string
+	Choices   []DialogueChoiceData
+	Next      string
+	End       bool
+	Condition string                 // Only shown when this holds, otherwise Else is shown instead
+	Else      string                 // Empty means the conversation ends
+	Set       map[string]interface{} // Variables to set when the node is shown
+}
+type DialogueTreeData struct {
+	Start string
+	Nodes []DialogueNodeData
+}
 type NPCData struct {
 	Name         string
 	SpriteSheets map[string]string
@@ -46,31 +78,49 @@ type NPCData struct {
 	X, Y         float64
 	Behaviors    []BehaviorData
 	Image        string
+	Portraits    map[string]string // Portrait for each expression, Image is used for the rest
 }
 type CutsceneAction struct {
 	ActionType   string
 	TargetID     string
-	Data         interface{}
+	Data         json.RawMessage // Decoded by the cutscene package according to ActionType
 	WaitPrevious bool
+	Track        string   // Actions on different tracks run side by side, "" is the main track
+	Label        string   // Lets other actions wait for this one
+	WaitFor      []string // Labels and tracks that must be done before the action starts
 }
 type CutsceneData struct {
-	ID      string
-	Actions []CutsceneAction
+	ID          string
+	Actions     []CutsceneAction
+	Script      string // .evt file to read the actions from instead
+	Unskippable bool   // The player can neither skip nor fast-forward it
 }
 
-func LoadJsonFile(path string) *Data {
+// Load reads a scene file. Malformed JSON is an error rather than a scene
+// with whatever part of it happened to decode.
+func Load(path string) (*Data, error) {
 	//Loading json file
 	jsonFile, err := os.Open(path)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer jsonFile.Close()
+	data, err := Decode(jsonFile)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return data, nil
+}
 
+// Decode reads a scene from r.
+func Decode(r io.Reader) (*Data, error) {
 	data := &Data{}
-	byteValue, err := io.ReadAll(jsonFile)
+	byteValue, err := io.ReadAll(r)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	if err := json.Unmarshal(byteValue, data); err != nil {
+		return nil, err
 	}
-	json.Unmarshal(byteValue, data)
-	return data
+	return data, nil
 }
@@ -2,72 +2,197 @@ package dialogue
 
 import (
 	"image/color"
-	"log"
 	"math"
+	"rpg_demo/assets"
+	"rpg_demo/emote"
+	"rpg_demo/input"
+	"rpg_demo/world"
 	"strings"
 
 	"github.com/hajimehoshi/ebiten/v2"
 	"github.com/hajimehoshi/ebiten/v2/text"
 	"golang.org/x/image/font"
-	"golang.org/x/image/font/gofont/goregular"
-	"golang.org/x/image/font/opentype"
 	"golang.org/x/image/math/fixed"
 )
 
 type Dialogue struct {
-	TextLines         []string
-	CurrentLine       int
-	CharIndex         int
-	FramesPerChar     int // Number of frames to wait before showing the next character
-	AccumulatedFrames int // Frame counter for the typewriter effect
-	IsOpen            bool
-	Finished          bool
-	Font              font.Face
-	Image             *ebiten.Image
-	Speaker           string
-}
-
-func New() *Dialogue {
-	font, err := loadFontFace()
+	Tree           *Tree
+	Node           *Node // Node currently shown
+	CharIndex      int
+	CharsPerSecond float64 // Speed of the typewriter effect
+	Accumulated    float64 // Seconds since the last character was shown
+	IsOpen         bool
+	Finished       bool
+	Font           font.Face
+	Image          *ebiten.Image
+	Speaker        string
+	Selected       int                          // Highlighted entry of the choice menu
+	Chosen         map[string]int               // Last choice taken at each node, by node ID
+	OnChoice       func(node *Node, choice int) // Called whenever the player confirms a choice
+	Vars           *world.Vars                  // Checked by node and choice conditions, nil reads every variable as unset
+	// Looks up the portrait of a speaker with an expression, nil if there's
+	// none. Lines that name neither fall back to Image.
+	PortraitOf func(speaker, expression string) *ebiten.Image
+	OnEmote    func(who string, kind emote.Kind) // Called for each emote of a line when it's shown
+}
+
+func New(a *assets.Manager) (*Dialogue, error) {
+	font, err := a.Font(assets.DefaultFont, 25)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	d := &Dialogue{
-		TextLines:     []string{""},
-		FramesPerChar: 2, //One character every 2 frames
-		CurrentLine:   0,
-		CharIndex:     0,
-		Font:          font,
+		CharsPerSecond: 30,
+		CharIndex:      0,
+		Font:           font,
+		Chosen:         make(map[string]int),
 	}
-	return d
+	return d, nil
 
 }
 
-func (d *Dialogue) Update() {
-	if !d.IsOpen || d.Finished {
+// Update handles the choice menu and types out dt seconds worth of text.
+func (d *Dialogue) Update(in *input.Handler, dt float64) {
+	if !d.IsOpen {
+		return
+	}
+	if d.Finished {
+		// Move the cursor through the choice menu
+		if n := len(d.choices()); n > 0 {
+			if in.JustPressed(input.MoveUp) {
+				d.Selected = (d.Selected + n - 1) % n
+			}
+			if in.JustPressed(input.MoveDown) {
+				d.Selected = (d.Selected + 1) % n
+			}
+		}
 		return
 	}
 
-	d.AccumulatedFrames++
-	if d.AccumulatedFrames >= d.FramesPerChar {
-		d.AccumulatedFrames = 0
+	d.Accumulated += dt
+	for d.Accumulated >= 1/d.CharsPerSecond && !d.Finished {
+		d.Accumulated -= 1 / d.CharsPerSecond
 		d.CharIndex++
-		if d.CharIndex > len(d.TextLines[d.CurrentLine]) {
-			d.CharIndex = len(d.TextLines[d.CurrentLine])
+		if d.CharIndex > len(d.Node.Text) {
+			d.CharIndex = len(d.Node.Text)
 			d.Finished = true
 		}
 	}
 }
 
+// Open starts a conversation at the tree's start node.
+func (d *Dialogue) Open(tree *Tree) {
+	d.Tree = tree
+	d.IsOpen = true
+	d.goTo(tree.Start)
+}
+
+// goTo shows the node with the given id, following Else for nodes whose
+// condition doesn't hold. It closes the dialogue if that leads nowhere.
+func (d *Dialogue) goTo(id string) {
+	node := d.Tree.Nodes[id]
+	// Bounded so a cycle of failing conditions can't hang the game
+	for i := 0; i <= len(d.Tree.Nodes) && node != nil && !node.Condition.Holds(d.Vars); i++ {
+		node = d.Tree.Nodes[node.Else]
+	}
+	if node == nil || !node.Condition.Holds(d.Vars) {
+		d.IsOpen = false
+		return
+	}
+	if d.Vars != nil {
+		for name, value := range node.Set {
+			d.Vars.Set(name, value)
+		}
+	}
+	d.Node = node
+	d.CharIndex = 0
+	d.Accumulated = 0
+	d.Finished = false
+	d.Selected = 0
+	if d.OnEmote != nil {
+		for _, e := range node.Emotes {
+			who := e.Who
+			if who == "" {
+				who = d.speaker()
+			}
+			d.OnEmote(who, e.Kind)
+		}
+	}
+}
+
+// choices returns the indexes of the current node's choices whose condition
+// holds. Choices can disappear while the menu is up when a variable changes,
+// so it keeps Selected on one of them.
+func (d *Dialogue) choices() []int {
+	var visible []int
+	for i, choice := range d.Node.Choices {
+		if choice.Condition.Holds(d.Vars) {
+			visible = append(visible, i)
+		}
+	}
+	if d.Selected >= len(visible) {
+		d.Selected = len(visible) - 1
+	}
+	if d.Selected < 0 {
+		d.Selected = 0
+	}
+	return visible
+}
+
+// Advance is what the interact key does: finish typing the current line,
+// confirm the highlighted choice, or move on to the next line.
+func (d *Dialogue) Advance() {
+	if !d.IsOpen {
+		return
+	}
+	if !d.Finished {
+		// Instantly display all characters in the current line
+		d.CharIndex = len(d.Node.Text)
+		d.Finished = true
+		return
+	}
+	if visible := d.choices(); len(visible) > 0 {
+		d.Choose(visible[d.Selected])
+		return
+	}
+	d.NextLine()
+}
+
+// Choose takes choice i of the current node and jumps to its target.
+func (d *Dialogue) Choose(i int) {
+	node := d.Node
+	d.Chosen[node.ID] = i
+	if d.OnChoice != nil {
+		d.OnChoice(node, i)
+	}
+	d.goTo(node.Choices[i].Next)
+}
+
 func (d *Dialogue) NextLine() {
-	if d.CurrentLine < len(d.TextLines)-1 {
-		d.CurrentLine++
-		d.CharIndex = 0
-		d.Finished = false
-	} else {
+	if d.Node.End || d.Node.Next == "" {
 		// No more lines, close the dialogue
 		d.IsOpen = false
+		return
+	}
+	d.goTo(d.Node.Next)
+}
+
+// speaker returns the name shown in the name box for the current line.
+func (d *Dialogue) speaker() string {
+	if d.Node.Speaker != "" {
+		return d.Node.Speaker
+	}
+	return d.Speaker
+}
+
+// portrait returns the picture shown next to the current line, nil for none.
+func (d *Dialogue) portrait() *ebiten.Image {
+	if d.PortraitOf != nil && (d.Node.Expression != "" || d.Node.Speaker != "") {
+		if img := d.PortraitOf(d.speaker(), d.Node.Expression); img != nil {
+			return img
+		}
 	}
+	return d.Image
 }
 
 func (d *Dialogue) Draw(screen *ebiten.Image) {
@@ -88,21 +213,19 @@ func (d *Dialogue) Draw(screen *ebiten.Image) {
 	opts.GeoM.Translate(float64(boxX), float64(boxY))
 	screen.DrawImage(dialogueBox, opts)
 	dialogueBox.Dispose()
-	var err error
-	scale := 0.165
-	if d.Image != nil {
+	portrait := d.portrait()
+	if portrait != nil {
+		// Portraits fill the height of the box whatever their size
+		scale := float64(boxHeight) / float64(portrait.Bounds().Dy())
 		ImageOpts := &ebiten.DrawImageOptions{}
 		ImageOpts.GeoM.Scale(scale, scale)
 		ImageOpts.GeoM.Translate(float64(boxX), float64(boxY))
-		screen.DrawImage(d.Image, ImageOpts)
-		if err != nil {
-			log.Fatal(err)
-		}
-		if d.Speaker != "" {
-			scaledWidth := float64(d.Image.Bounds().Dx()) * scale
+		screen.DrawImage(portrait, ImageOpts)
+		if speaker := d.speaker(); speaker != "" {
+			scaledWidth := float64(portrait.Bounds().Dx()) * scale
 			boxWidth := int(math.Round(scaledWidth))
 			boxHeight := 40
-			bounds := font.MeasureString(d.Font, d.Speaker)
+			bounds := font.MeasureString(d.Font, speaker)
 			textWidth := bounds.Ceil()
 			startX := boxX + (boxWidth-textWidth)/2
 			nameBox := ebiten.NewImage(boxWidth, boxHeight)
@@ -111,23 +234,27 @@ func (d *Dialogue) Draw(screen *ebiten.Image) {
 			opts.GeoM.Translate(float64(boxX), float64(boxY+170-boxHeight))
 			opts.ColorScale.Scale(1, 1, 1, 0.60)
 			screen.DrawImage(nameBox, opts)
-			text.Draw(screen, d.Speaker, d.Font, startX, boxY+170-boxHeight+30, color.White)
+			text.Draw(screen, speaker, d.Font, startX, boxY+170-boxHeight+30, color.White)
 		}
 	}
 
 	fontFace := d.Font
-	if err != nil {
-		log.Fatal(err)
-	}
 	var textToDisplay string
 
-	if d.Image != nil {
-		textToDisplay = wrapText(d.TextLines[d.CurrentLine][:d.CharIndex], 540, fontFace)
+	if portrait != nil {
+		textToDisplay = wrapText(d.Line(), 540, fontFace)
 	} else {
-		textToDisplay = wrapText(d.TextLines[d.CurrentLine][:d.CharIndex], 630, fontFace)
+		textToDisplay = wrapText(d.Line(), 630, fontFace)
+	}
+	// The choice menu goes under the text once it is fully typed out
+	var choices []Choice
+	if d.Finished {
+		for _, i := range d.choices() {
+			choices = append(choices, d.Node.Choices[i])
+		}
 	}
 	// Calculate the number of lines and the height of each line
-	numLines := countLines(textToDisplay)
+	numLines := countLines(textToDisplay) + len(choices)
 	lineHeight := fontFace.Metrics().Height.Ceil() // Or a custom line height if you prefer
 
 	// Calculate the starting Y position for vertical centering
@@ -140,15 +267,37 @@ func (d *Dialogue) Draw(screen *ebiten.Image) {
 	}
 
 	// Draw the text
-	if d.Image != nil {
-		text.Draw(screen, textToDisplay, fontFace, boxX+200, startY, color.White)
-	} else {
-		text.Draw(screen, textToDisplay, fontFace, boxX+70, startY+5, color.White)
+	textX, textY := boxX+70, startY+5
+	if portrait != nil {
+		textX, textY = boxX+200, startY
 	}
+	text.Draw(screen, textToDisplay, fontFace, textX, textY, color.White)
 
+	// Draw the choices, highlighting the selected one
+	choiceY := textY + countLines(textToDisplay)*lineHeight
+	for i, choice := range choices {
+		label, clr := "  "+choice.Text, color.Color(color.White)
+		if i == d.Selected {
+			label, clr = "> "+choice.Text, color.RGBA{0xff, 0xd7, 0x00, 0xff}
+		}
+		text.Draw(screen, label, fontFace, textX, choiceY+i*lineHeight, clr)
+	}
 }
+
+// Line returns the part of the current line that has been typed out so far,
+// or an empty string when the dialogue is closed.
+func (d *Dialogue) Line() string {
+	if !d.IsOpen {
+		return ""
+	}
+	return d.Node.Text[:d.CharIndex]
+}
+
 func (d *Dialogue) IsLastLine() bool {
-	return d.CurrentLine == len(d.TextLines)-1
+	if d.Node == nil {
+		return false
+	}
+	return d.Node.Last() || d.Node.Next == "" && len(d.choices()) == 0
 }
 
 func wrapText(text string, maxWidth int, face font.Face) string {
@@ -179,33 +328,3 @@ func wrapText(text string, maxWidth int, face font.Face) string {
 func countLines(text string) int {
 	return strings.Count(text, "\n") + 1
 }
-func loadFontFace() (font.Face, error) {
-	// Read the font data
-	fontBytes := goregular.TTF
-
-	// Parse the font data
-	fontParsed, err := opentype.Parse(fontBytes)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// Specify the font size
-	const dpi = 72
-	face, err := opentype.NewFace(fontParsed, &opentype.FaceOptions{
-		Size:    25,
-		DPI:     dpi,
-		Hinting: font.HintingNone,
-	})
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	return face, nil
-}
-
-func (d *Dialogue) OpenAndReset() {
-	d.IsOpen = true
-	d.CharIndex = 0
-	d.CurrentLine = 0
-	d.Finished = false
-}
@@ -0,0 +1,94 @@
+package dialogue
+
+import (
+	"fmt"
+	"rpg_demo/emote"
+	"strings"
+)
+
+// Lines can carry markup that isn't shown:
+//
+//	[angry] Get out!            the speaker's angry portrait for this line
+//	[Kenneth:angry] Get out!    Kenneth says it, with his angry portrait
+//	[Kenneth:] Hi.              Kenneth says it, with his usual portrait
+//	{!} Who's there?            a "!" bubble over the speaker
+//	{Kenneth:sweat} Uh oh.      a sweat bubble over Kenneth, or "player"
+//
+// Emotes pop up when the line is shown.
+
+// Emote is a bubble a line pops up over someone's head.
+type Emote struct {
+	Who  string // Empty for the speaker
+	Kind emote.Kind
+}
+
+// markup is what parseMarkup found in a line.
+type markup struct {
+	text       string
+	speaker    string
+	expression string
+	emotes     []Emote
+}
+
+// parseMarkup takes the tags out of a line of text.
+func parseMarkup(text string) (markup, error) {
+	var m markup
+	line := text
+	var out strings.Builder
+	for {
+		i := strings.IndexAny(line, "[{")
+		if i < 0 {
+			out.WriteString(line)
+			break
+		}
+		closing := "]"
+		if line[i] == '{' {
+			closing = "}"
+		}
+		j := strings.Index(line[i:], closing)
+		if j < 0 {
+			return m, fmt.Errorf("%q: unclosed %c", text, line[i])
+		}
+		out.WriteString(line[:i])
+		tag := strings.TrimSpace(line[i+1 : i+j])
+		who, what, named := strings.Cut(tag, ":")
+		if !named {
+			who, what = "", tag
+		}
+		who, what = strings.TrimSpace(who), strings.TrimSpace(what)
+		if closing == "]" {
+			if m.expression != "" || m.speaker != "" {
+				return m, fmt.Errorf("%q: more than one portrait tag", text)
+			}
+			if named && who == "" {
+				return m, fmt.Errorf("%q: empty speaker in [%s]", text, tag)
+			}
+			m.speaker, m.expression = who, what
+		} else {
+			kind, err := emote.Parse(what)
+			if err != nil {
+				return m, fmt.Errorf("%q: %w", text, err)
+			}
+			m.emotes = append(m.emotes, Emote{Who: who, Kind: kind})
+		}
+		line = line[i+j+1:]
+	}
+	m.text = strings.Join(strings.Fields(out.String()), " ")
+	return m, nil
+}
+
+// CheckMarkup reports what's wrong with the markup of a line, if anything.
+func CheckMarkup(line string) error {
+	_, err := parseMarkup(line)
+	return err
+}
+
+// apply puts the markup of the node's text into the node.
+func (n *Node) apply(m markup) {
+	n.Text = m.text
+	if m.speaker != "" {
+		n.Speaker = m.speaker
+	}
+	n.Expression = m.expression
+	n.Emotes = m.emotes
+}
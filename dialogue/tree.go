@@ -0,0 +1,154 @@
+package dialogue
+
+import (
+	"fmt"
+	"rpg_demo/data"
+	"rpg_demo/world"
+	"strconv"
+)
+
+// Node is a single line of a conversation. After it the conversation follows
+// the picked choice, goes to Next, or ends.
+type Node struct {
+	ID         string
+	Speaker    string // Overrides the dialogue's speaker for this line when set
+	Text       string // Without its markup
+	Expression string // Portrait to show, "" for the speaker's usual one
+	Emotes     []Emote
+	Choices    []Choice
+	Next       string
+	End        bool
+	Condition  *world.Cond // When it doesn't hold the conversation goes to Else instead
+	Else       string
+	Set        map[string]world.Value // Variables to set when the node is shown
+}
+
+type Choice struct {
+	Text      string
+	Next      string
+	Condition *world.Cond // Hides the choice unless it holds
+}
+
+type Tree struct {
+	Start string
+	Nodes map[string]*Node
+}
+
+// NewTree builds a tree from scene data and checks that every node it points
+// to exists. Start defaults to the first node.
+func NewTree(data *data.DialogueTreeData) (*Tree, error) {
+	if len(data.Nodes) == 0 {
+		return nil, fmt.Errorf("dialogue tree has no nodes")
+	}
+	t := &Tree{
+		Start: data.Start,
+		Nodes: make(map[string]*Node),
+	}
+	if t.Start == "" {
+		t.Start = data.Nodes[0].ID
+	}
+	for _, nd := range data.Nodes {
+		if nd.ID == "" {
+			return nil, fmt.Errorf("dialogue node %q has no id", nd.Text)
+		}
+		if _, exists := t.Nodes[nd.ID]; exists {
+			return nil, fmt.Errorf("duplicate dialogue node %q", nd.ID)
+		}
+		node := &Node{
+			ID:      nd.ID,
+			Speaker: nd.Speaker,
+			Next:    nd.Next,
+			End:     nd.End,
+			Else:    nd.Else,
+		}
+		m, err := parseMarkup(nd.Text)
+		if err != nil {
+			return nil, fmt.Errorf("dialogue node %q: %w", nd.ID, err)
+		}
+		node.apply(m)
+		if nd.Condition != "" {
+			cond, err := world.Parse(nd.Condition)
+			if err != nil {
+				return nil, fmt.Errorf("dialogue node %q: %w", nd.ID, err)
+			}
+			node.Condition = cond
+		}
+		if len(nd.Set) > 0 {
+			node.Set = make(map[string]world.Value)
+			for name, raw := range nd.Set {
+				value, err := world.ValueOf(raw)
+				if err != nil {
+					return nil, fmt.Errorf("dialogue node %q: set %s: %w", nd.ID, name, err)
+				}
+				node.Set[name] = value
+			}
+		}
+		for i, cd := range nd.Choices {
+			choice := Choice{Text: cd.Text, Next: cd.Next}
+			if cd.Condition != "" {
+				cond, err := world.Parse(cd.Condition)
+				if err != nil {
+					return nil, fmt.Errorf("dialogue node %q: choice %d: %w", nd.ID, i, err)
+				}
+				choice.Condition = cond
+			}
+			node.Choices = append(node.Choices, choice)
+		}
+		t.Nodes[nd.ID] = node
+	}
+	if _, ok := t.Nodes[t.Start]; !ok {
+		return nil, fmt.Errorf("dialogue start node %q does not exist", t.Start)
+	}
+	for _, node := range t.Nodes {
+		if node.End && len(node.Choices) > 0 {
+			return nil, fmt.Errorf("dialogue node %q is an end node but has choices", node.ID)
+		}
+		if node.Next != "" {
+			if _, ok := t.Nodes[node.Next]; !ok {
+				return nil, fmt.Errorf("dialogue node %q: next node %q does not exist", node.ID, node.Next)
+			}
+		}
+		if node.Else != "" {
+			if _, ok := t.Nodes[node.Else]; !ok {
+				return nil, fmt.Errorf("dialogue node %q: else node %q does not exist", node.ID, node.Else)
+			}
+		}
+		for i, choice := range node.Choices {
+			if _, ok := t.Nodes[choice.Next]; !ok {
+				return nil, fmt.Errorf("dialogue node %q: choice %d goes to missing node %q", node.ID, i, choice.Next)
+			}
+		}
+	}
+	return t, nil
+}
+
+// Linear turns a flat list of lines into a tree that plays them in order.
+// Lines with broken markup are shown as they are, CheckMarkup catches them
+// when the cutscene loads.
+func Linear(lines []string) *Tree {
+	t := &Tree{
+		Start: "0",
+		Nodes: make(map[string]*Node),
+	}
+	for i, line := range lines {
+		node := &Node{ID: strconv.Itoa(i), Text: line}
+		if m, err := parseMarkup(line); err == nil {
+			node.apply(m)
+		}
+		if i < len(lines)-1 {
+			node.Next = strconv.Itoa(i + 1)
+		} else {
+			node.End = true
+		}
+		t.Nodes[node.ID] = node
+	}
+	if len(lines) == 0 {
+		t.Nodes["0"] = &Node{ID: "0", End: true}
+	}
+	return t
+}
+
+// Last reports whether the conversation ends after this node.
+func (n *Node) Last() bool {
+	return n.End || (n.Next == "" && len(n.Choices) == 0)
+}
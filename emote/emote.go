@@ -0,0 +1,129 @@
+// Package emote draws the little bubbles that pop up over a character's head,
+// like a "!" when they notice something or a heart when they're smitten.
+package emote
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/text"
+	"github.com/hajimehoshi/ebiten/v2/vector"
+	"golang.org/x/image/font/basicfont"
+)
+
+type Kind string
+
+const (
+	Exclaim  Kind = "!"
+	Question Kind = "?"
+	Heart    Kind = "heart"
+	Sweat    Kind = "sweat"
+)
+
+// Kinds lists every emote, in the order they're listed in errors.
+var Kinds = []Kind{Exclaim, Question, Heart, Sweat}
+
+// DefaultSeconds is how long a bubble stays up when nothing says otherwise.
+const DefaultSeconds = 1.5
+
+// Parse checks that name is a known emote.
+func Parse(name string) (Kind, error) {
+	for _, k := range Kinds {
+		if string(k) == name {
+			return k, nil
+		}
+	}
+	return "", fmt.Errorf("unknown emote %q, must be one of %q", name, Kinds)
+}
+
+const (
+	radius  = 14.0 // Of the bubble, in screen pixels
+	popTime = 0.15 // Seconds the bubble takes to grow to full size
+	gap     = 6.0  // Between the top of the head and the tail of the bubble
+)
+
+// Bubble is an emote shown over a character for a while.
+type Bubble struct {
+	Kind Kind
+	Left float64 // Seconds until it goes away
+	age  float64
+}
+
+// New pops up a bubble for the given number of seconds, DefaultSeconds if 0.
+func New(kind Kind, seconds float64) *Bubble {
+	if seconds <= 0 {
+		seconds = DefaultSeconds
+	}
+	return &Bubble{Kind: kind, Left: seconds}
+}
+
+// Update ages the bubble by dt seconds and reports whether it's still up.
+func (b *Bubble) Update(dt float64) bool {
+	b.age += dt
+	b.Left -= dt
+	return b.Left > 0
+}
+
+// Draw draws the bubble above x, y, the top middle of a character in world
+// coordinates. view is the camera's world to screen transform. Bubbles keep
+// the same size however far the camera zooms.
+func (b *Bubble) Draw(screen *ebiten.Image, x, y float64, view ebiten.GeoM) {
+	sx, sy := view.Apply(x, y)
+	scale := math.Min(b.age/popTime, 1)
+	r := float32(radius * scale)
+	cx, cy := float32(sx), float32(sy-gap-radius*scale)
+
+	// The bubble and its tail pointing down at the head
+	white := color.RGBA{0xff, 0xff, 0xff, 0xff}
+	vector.DrawFilledCircle(screen, cx, cy, r, white, true)
+	fillTriangle(screen, cx-r/3, cy+r*0.8, cx+r/3, cy+r*0.8, cx, cy+r+float32(gap)/2, white)
+	vector.StrokeCircle(screen, cx, cy, r, 1, color.Black, true)
+	if scale < 1 {
+		return
+	}
+
+	switch b.Kind {
+	case Exclaim, Question:
+		face := basicfont.Face7x13
+		text.Draw(screen, string(b.Kind), face, int(cx)-3, int(cy)+5, color.RGBA{0xc0, 0x10, 0x10, 0xff})
+	case Heart:
+		red := color.RGBA{0xe0, 0x20, 0x50, 0xff}
+		lobe := r * 0.3
+		vector.DrawFilledCircle(screen, cx-lobe, cy-lobe/2, lobe, red, true)
+		vector.DrawFilledCircle(screen, cx+lobe, cy-lobe/2, lobe, red, true)
+		fillTriangle(screen, cx-2*lobe, cy-lobe/3, cx+2*lobe, cy-lobe/3, cx, cy+r*0.6, red)
+	case Sweat:
+		blue := color.RGBA{0x40, 0x90, 0xe0, 0xff}
+		drop := r * 0.35
+		vector.DrawFilledCircle(screen, cx, cy+drop/2, drop, blue, true)
+		fillTriangle(screen, cx-drop, cy+drop/3, cx+drop, cy+drop/3, cx, cy-r*0.6, blue)
+	}
+}
+
+// whitePixel is stretched over the triangles, DrawTriangles needs a source
+// image. It's made on first use.
+var whitePixel *ebiten.Image
+
+func fillTriangle(screen *ebiten.Image, x1, y1, x2, y2, x3, y3 float32, clr color.RGBA) {
+	if whitePixel == nil {
+		img := ebiten.NewImage(3, 3)
+		img.Fill(color.White)
+		whitePixel = img.SubImage(img.Bounds().Inset(1)).(*ebiten.Image)
+	}
+	var path vector.Path
+	path.MoveTo(x1, y1)
+	path.LineTo(x2, y2)
+	path.LineTo(x3, y3)
+	path.Close()
+	vertices, indices := path.AppendVerticesAndIndicesForFilling(nil, nil)
+	for i := range vertices {
+		vertices[i].SrcX, vertices[i].SrcY = 1, 1
+		vertices[i].ColorR = float32(clr.R) / 0xff
+		vertices[i].ColorG = float32(clr.G) / 0xff
+		vertices[i].ColorB = float32(clr.B) / 0xff
+		vertices[i].ColorA = float32(clr.A) / 0xff
+	}
+	screen.DrawTriangles(vertices, indices, whitePixel, &ebiten.DrawTrianglesOptions{AntiAlias: true})
+}
@@ -3,143 +3,425 @@ package game
 import (
 	"fmt"
 	"image/color"
-	"rpg_demo/ability"
+	"log"
+	"rpg_demo/assets"
+	"rpg_demo/camera"
+	"rpg_demo/clock"
 	"rpg_demo/collisions"
 	"rpg_demo/cutscene"
 	"rpg_demo/dialogue"
+	"rpg_demo/emote"
+	"rpg_demo/input"
 	"rpg_demo/music"
+	"rpg_demo/npc"
 	"rpg_demo/player"
+	"rpg_demo/replay"
+	"rpg_demo/rewind"
+	"rpg_demo/savegame"
 	"rpg_demo/scene"
 	"rpg_demo/shared"
+	"rpg_demo/trigger"
+	"rpg_demo/world"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/ebitenutil"
 )
 
 type Game struct {
-	Player              *player.Player
-	Scenes              map[string]*scene.Scene
-	CurrentScene        string
-	CurrentDoor         *collisions.Door
-	CutScene            *cutscene.Cutscene
-	State               shared.GameState
-	Transition          *shared.Transition
-	Music               *music.Music
-	KeyPressedLastFrame shared.KeyPressed
-	Dialogue            *dialogue.Dialogue
+	Player        *player.Player
+	Scenes        map[string]*scene.Scene
+	CurrentScene  string
+	CurrentDoor   *collisions.Door
+	CutScene      *cutscene.Cutscene
+	Cutscenes     map[string]*cutscene.Cutscene // Shared by every scene, for Call
+	State         shared.GameState
+	Transition    *shared.Transition
+	Music         *music.Music
+	Input         *input.Handler
+	Bindings      input.Bindings // What the player presses, for on-screen hints
+	Paused        bool
+	Dialogue      *dialogue.Dialogue
+	Vars          *world.Vars // Flags and variables shared by dialogue, cutscenes and doors
+	ShowVars      bool        // Draw the variable debug overlay
+	Saves         *savegame.Slots
+	Error         error // Shown on the error screen while State is ErrorState
+	Assets        *assets.Manager
+	Headless      bool // Running without a window or audio device, see NewHeadless
+	Tick          int  // Number of Update calls so far
+	Clock         *clock.Clock
+	Camera        *camera.Camera
+	History       *rewind.Buffer // Last few seconds of the current scene, for the rewind ability
+	Recorder      *replay.Recorder
+	Replay        *replay.Player
+	liveSource    input.Source                   // Input to go back to once a replay ends
+	pendingScenes map[string]savegame.SceneState // Restored scene state waiting for the scene to load
+	newScene      func(name string) (*scene.Scene, error)
+	snapshot      rewind.Snapshot  // Reused to record History without allocating
+	snapCamera    bool             // Move the camera straight to the player on the next Update
+	lockedDoor    *collisions.Door // Last locked door the player bumped into, to report it once
 }
 
-func New() *Game {
-	sceneMap := make(map[string]*scene.Scene)
-	sceneMap["mainMap"] = scene.New("mainMap")
-	return &Game{
-		Player:       player.New(),
-		CurrentScene: "mainMap",
-		Scenes:       sceneMap,
+// New creates the game at the start of the main map. Broken or missing scene
+// files don't stop it, they are shown on the error screen once the game runs.
+func New() (*Game, error) {
+	a := assets.New(assets.FS())
+	newScene := func(name string) (*scene.Scene, error) {
+		return scene.New(name, a)
+	}
+	g, err := newGame(player.New(a.Image), input.NewDevice(loadBindings(a)), newScene, a)
+	if err != nil {
+		return nil, err
+	}
+	g.CurrentScene = "mainMap"
+	if g.Cutscenes, err = scene.SharedCutscenes(a); err != nil {
+		g.Cutscenes = map[string]*cutscene.Cutscene{}
+		g.ShowError(err)
+	}
+	if _, err := g.loadScene(g.CurrentScene); err != nil {
+		g.ShowError(err)
+	}
+	return g, nil
+}
+
+func newGame(p *player.Player, source input.Source, newScene func(string) (*scene.Scene, error), a *assets.Manager) (*Game, error) {
+	d, err := dialogue.New(a)
+	if err != nil {
+		return nil, err
+	}
+	g := &Game{
+		Player:    p,
+		Scenes:    make(map[string]*scene.Scene),
+		Cutscenes: make(map[string]*cutscene.Cutscene),
 		Transition: &shared.Transition{
 			Alpha:     0.0,
-			FadeSpeed: 0.05,
+			FadeSpeed: 3,
 		},
-		Music:    &music.Music{},
-		Dialogue: dialogue.New(),
+		Clock:    clock.New(ebiten.TPS()),
+		Camera:   camera.New(screenWidth, screenHeight),
+		Music:    &music.Music{Assets: a},
+		Input:    input.New(source),
+		Dialogue: d,
+		Vars:     world.New(),
+		Saves:    savegame.NewSlots("saves"),
+		Assets:   a,
+		newScene: newScene,
+		// Start on the player rather than drift over from the corner
+		snapCamera: true,
+	}
+	g.Bindings = input.DefaultBindings()
+	if device, ok := source.(*input.Device); ok {
+		g.Bindings = device.Bindings
+	}
+	g.Dialogue.Vars = g.Vars
+	g.Player.Abilities.Vars = g.Vars
+	g.History = g.newHistory()
+	// Remember every answer so conditions can check it as choice.<node id>
+	g.Dialogue.OnChoice = func(node *dialogue.Node, choice int) {
+		g.Vars.SetInt("choice."+node.ID, choice)
+	}
+	g.Dialogue.PortraitOf = g.portrait
+	g.Dialogue.OnEmote = func(who string, kind emote.Kind) {
+		g.showEmote(who, kind, 0)
+	}
+	return g, nil
+}
+
+// portrait finds the portrait of the named NPC of the current scene with the
+// given expression, nil if nobody there goes by that name.
+func (g *Game) portrait(speaker, expression string) *ebiten.Image {
+	if s, ok := g.Scenes[g.CurrentScene]; ok {
+		if n, ok := s.NPCs[speaker]; ok {
+			return n.Portrait(expression)
+		}
+	}
+	return nil
+}
+
+// showEmote pops up a bubble over the player or an NPC of the current scene
+// for the given seconds, emote.DefaultSeconds if 0.
+func (g *Game) showEmote(who string, kind emote.Kind, seconds float64) {
+	if who == cutscene.PlayerTarget.TargetName() {
+		g.Player.Emote = emote.New(kind, seconds)
+		return
+	}
+	if s, ok := g.Scenes[g.CurrentScene]; ok {
+		if n, ok := s.NPCs[who]; ok {
+			n.Emote = emote.New(kind, seconds)
+			return
+		}
 	}
+	log.Printf("No one called %q in scene %q to show %s over", who, g.CurrentScene, kind)
+}
+
+// bindingsFile is where the key bindings are, in the assets directory so they
+// are found whatever directory the game is started from.
+const bindingsFile = "bindings.json"
+
+// loadBindings reads the key binding file, falling back to the defaults if it
+// is missing or broken so a bad config never locks the player out.
+func loadBindings(a *assets.Manager) input.Bindings {
+	bindings, err := input.LoadBindings(a, bindingsFile)
+	if err != nil {
+		log.Println("Using default key bindings:", err)
+		return input.DefaultBindings()
+	}
+	return bindings
 }
 
 func (g *Game) Update() error {
+	defer g.checkpoint()
+	g.Tick++
+	g.Clock.Step()
+	dt := g.Clock.Delta()
+	g.Input.Update()
+	if g.State == shared.ErrorState {
+		return g.updateError()
+	}
+	from := g.CurrentScene
+	if g.Input.JustPressed(input.Pause) {
+		g.Paused = !g.Paused
+	}
+	if g.Paused {
+		return nil
+	}
+	g.HandleSaves()
+	if g.Input.JustPressed(input.DebugVars) {
+		g.ShowVars = !g.ShowVars
+		log.Print("World variables:\n", g.Vars.Dump())
+	}
 	Scene := g.Scenes[g.CurrentScene]
 	g.HandleMusic()
-	if (!g.Player.Ability.Activated || g.Player.Ability.Type != ability.StopTime) && g.State == shared.TimeStopped {
+	if !g.Player.Abilities.World.Frozen && g.State == shared.TimeStopped {
 		g.State = shared.PlayState
 	}
+	g.freezeWorld(g.State == shared.TimeStopped)
 
 	switch g.State {
 	case shared.PlayState:
-		err := g.Player.Update(Scene.Collisions, func(door *collisions.Door) {
-			g.CurrentDoor = door
-		}, func(state shared.GameState) {
-			g.State = state
-		})
+		err := g.Player.Update(g.Input, dt, Scene.Collisions, g.EnterDoor)
 		if err != nil {
 			return err
 		}
-		Scene.Update()
-		Scene.HandleNPCInteractions(g.Player, g.KeyPressedLastFrame.KeyZ, g.Dialogue)
-		g.KeyPressedLastFrame.KeyZ = ebiten.IsKeyPressed(ebiten.KeyZ)
-		if ebiten.IsKeyPressed(ebiten.KeyD) && !g.KeyPressedLastFrame.KeyD {
-			g.CutScene = Scene.Cutscenes["exampleCutscene"]
-			g.processCutscene()
-			fmt.Println(g.CutScene)
-			g.CutScene.Start()
-			g.State = shared.CutSceneState
-		}
-		g.KeyPressedLastFrame.KeyD = ebiten.IsKeyPressed(ebiten.KeyD)
-		if ebiten.IsKeyPressed(ebiten.KeyV) && !g.KeyPressedLastFrame.KeyV {
-			g.Player.Ability.CycleAbility()
-		}
-		g.KeyPressedLastFrame.KeyV = ebiten.IsKeyPressed(ebiten.KeyV)
-		if g.Player.Ability.Type == ability.StopTime && g.Player.Ability.Activated {
+		Scene.Update(g.Input, dt)
+		if g.State != shared.PlayState {
+			// Walked into a door, nothing else may take over from its transition
+			break
+		}
+		if t := g.checkTriggers(Scene); t != nil {
+			if err := g.StartCutscene(t.Cutscene); err != nil {
+				g.ShowError(err)
+				return nil
+			}
+		}
+		if g.Input.JustPressed(input.DebugCutscene) {
+			if err := g.StartCutscene("exampleCutscene"); err != nil {
+				g.ShowError(err)
+				return nil
+			}
+		}
+		if g.Input.JustPressed(input.CycleAbility) {
+			g.Player.Abilities.Cycle()
+		}
+		if g.Player.Abilities.World.Frozen {
 			g.State = shared.TimeStopped
+			g.freezeWorld(true)
 		}
+		if !g.startRewind() {
+			// After the update, so the newest snapshot is the tick before the rewind
+			g.record(Scene)
+		}
+	case shared.Rewinding:
+		g.updateRewind(Scene, dt)
 	case shared.TimeStopped:
-		g.Player.Update(Scene.Collisions, func(d *collisions.Door) { g.CurrentDoor = d }, func(newState shared.GameState) { g.State = newState })
+		// Only the player gets any time, and doors stay shut in a frozen world.
+		// None of it is recorded, rewinding it would only move the player back.
+		err := g.Player.Update(g.Input, dt, Scene.Collisions, func(*collisions.Door) {})
+		if err != nil {
+			return err
+		}
+		Scene.Update(g.Input, 0)
+		Scene.HandleNPCInteractions(g.Player, g.Input, g.Dialogue)
 	case shared.TransitionState:
-		g.Transition.Alpha += g.Transition.FadeSpeed
+		g.Transition.Alpha += g.Transition.FadeSpeed * dt
 		if g.Transition.Alpha >= 1.0 {
 			g.Transition.Alpha = 1.0
+			if _, loaded := g.Scenes[g.CurrentDoor.Destination]; !loaded {
+				if _, err := g.loadScene(g.CurrentDoor.Destination); err != nil {
+					// Stay on this side of the door
+					g.Transition.Alpha = 0
+					g.ShowError(err)
+					return nil
+				}
+			}
 			g.State = shared.NewSceneState
 			g.CurrentScene = g.CurrentDoor.Destination
 			g.Player.X = g.CurrentDoor.NewX
 			g.Player.Y = g.CurrentDoor.NewY
 		}
 	case shared.NewSceneState:
-		g.Transition.Alpha -= g.Transition.FadeSpeed
+		g.Transition.Alpha -= g.Transition.FadeSpeed * dt
 		if g.Transition.Alpha <= 0.0 {
 			g.Transition.Alpha = 0.0
 			g.State = shared.PlayState
 			// The new scene is fully visible now, and game continues as normal
 		}
 	case shared.CutSceneState:
+		if g.CutScene.IsPlaying && !g.CutScene.Unskippable {
+			if g.Input.JustPressed(input.SkipCutscene) {
+				g.CutScene.Skip(g.Transition, Scene.Collisions)
+				g.snapCamera = true
+			}
+			// Fast-forwarding speeds up the dialogue and camera too
+			g.CutScene.FastForward = g.Input.Pressed(input.FastForward)
+			if g.CutScene.FastForward {
+				dt *= fastForward
+			}
+		}
 		if g.CutScene.IsPlaying {
-			g.CutScene.Update(g.Transition, g.KeyPressedLastFrame)
+			g.CutScene.Update(g.Transition, g.Input, dt, Scene.Collisions)
 		} else {
 			g.State = shared.PlayState
+			// Give the camera back to the player
+			g.Camera.Release()
+			g.Camera.ZoomTo(1, 2)
 		}
 
 	}
-	if g.Dialogue.IsOpen && !g.Dialogue.Finished {
-		g.Dialogue.Update()
+	if g.Dialogue.IsOpen {
+		g.Dialogue.Update(g.Input, dt)
 	}
+	Scene.UpdateEmotes(g.Player, dt)
 	_, exists := g.Scenes[g.CurrentScene]
 	if !exists {
-		g.Scenes[g.CurrentScene] = scene.New(g.CurrentScene)
+		if _, err := g.loadScene(g.CurrentScene); err != nil {
+			// Go back to the scene we came from if there is one, so the game can carry on
+			if _, ok := g.Scenes[from]; ok {
+				g.CurrentScene = from
+			}
+			g.ShowError(err)
+		}
+	}
+	if g.CurrentScene != from {
+		g.unloadScene(from)
+		g.History.Clear()
+		g.snapCamera = true
+	}
+	g.updateCamera(dt)
+	return nil
+}
+
+// updateCamera keeps the camera on the player and inside the current scene.
+func (g *Game) updateCamera(dt float64) {
+	if s, ok := g.Scenes[g.CurrentScene]; ok {
+		g.Camera.WorldW, g.Camera.WorldH = s.Width, s.Height
+	}
+	g.Camera.Follow(g.Player.X, g.Player.Y)
+	if g.snapCamera {
+		g.Camera.Snap()
+		g.snapCamera = false
+	}
+	g.Camera.Update(dt)
+}
+
+// freezeWorld stops or restarts everything but the player for the time stop
+// ability. Without any time the NPCs keep still by themselves, what's left is
+// the music and the look of the scene.
+func (g *Game) freezeWorld(frozen bool) {
+	if s, ok := g.Scenes[g.CurrentScene]; ok {
+		s.Frozen = frozen
+	}
+	if frozen {
+		g.Music.Freeze()
+	} else {
+		g.Music.Thaw()
+	}
+}
+
+// SetTPS changes how many times a second Update runs. Everything moves in units
+// per second, so this only makes the game smoother or choppier.
+func (g *Game) SetTPS(tps int) {
+	g.Clock.TPS = tps
+	g.History = g.newHistory()
+	if !g.Headless {
+		ebiten.SetTPS(tps)
+	}
+}
+
+// unloadScene frees a scene the player has left. Its NPCs are remembered the
+// same way a save remembers them and put back when the scene is loaded again.
+func (g *Game) unloadScene(name string) {
+	s, ok := g.Scenes[name]
+	if !ok {
+		return
+	}
+	if g.pendingScenes == nil {
+		g.pendingScenes = make(map[string]savegame.SceneState)
+	}
+	g.pendingScenes[name] = snapshotScene(s)
+	s.Unload()
+	delete(g.Scenes, name)
+}
+
+// ShowError switches to the error screen. From there the player can go back to
+// playing the current scene, if it loaded, or quit.
+func (g *Game) ShowError(err error) {
+	log.Println("Error:", err)
+	g.Error = err
+	g.State = shared.ErrorState
+	g.Transition.Alpha = 0
+	if g.CutScene != nil {
+		g.CutScene.IsPlaying = false
+	}
+	g.Dialogue.IsOpen = false
+	g.Player.CanMove = true
+}
+
+// updateError handles the error screen. Quitting returns the error from Update,
+// which ends the game with it.
+func (g *Game) updateError() error {
+	if g.Input.JustPressed(input.Pause) {
+		return g.Error
+	}
+	if _, ok := g.Scenes[g.CurrentScene]; ok && g.Input.JustPressed(input.Interact) {
+		g.Error = nil
+		g.State = shared.PlayState
 	}
 	return nil
 }
 
 func (g *Game) Draw(screen *ebiten.Image) {
+	if g.State == shared.ErrorState {
+		g.drawError(screen)
+		return
+	}
 	Scene := g.Scenes[g.CurrentScene]
+	view := g.Camera.Transform()
 	switch g.State {
-	case shared.PlayState, shared.TimeStopped:
-		Scene.Draw(screen, Scene.Background, g.Player)
-		Scene.DrawNPCs(screen)
-		g.Player.Draw(screen, Scene.Width, Scene.Height)
-		Scene.Draw(screen, Scene.Foreground, g.Player)
+	case shared.PlayState, shared.TimeStopped, shared.Rewinding:
+		Scene.Draw(screen, Scene.Background, view)
+		Scene.DrawEntities(screen, g.Player, view)
+		Scene.Draw(screen, Scene.Foreground, view)
+		Scene.DrawEmotes(screen, g.Player, view)
+		g.drawHUD(screen)
 		g.Dialogue.Draw(screen)
 	case shared.TransitionState, shared.NewSceneState:
-		Scene.Draw(screen, Scene.Background, g.Player)
-		Scene.DrawNPCs(screen)
-		g.Player.Draw(screen, Scene.Width, Scene.Height)
-		Scene.Draw(screen, Scene.Foreground, g.Player)
+		Scene.Draw(screen, Scene.Background, view)
+		Scene.DrawEntities(screen, g.Player, view)
+		Scene.Draw(screen, Scene.Foreground, view)
+		Scene.DrawEmotes(screen, g.Player, view)
 		fadeImage := ebiten.NewImage(screen.Bounds().Dx(), screen.Bounds().Dy())
 		fadeColor := color.RGBA{0, 0, 0, uint8(g.Transition.Alpha * 0xff)} // Black with variable Alpha
 		fadeImage.Fill(fadeColor)
 		screen.DrawImage(fadeImage, nil)
 		fadeImage.Dispose()
 	case shared.CutSceneState:
-		Scene.Draw(screen, Scene.Background, g.Player)
-		Scene.DrawNPCs(screen)
-		g.Player.Draw(screen, Scene.Width, Scene.Height)
-		Scene.Draw(screen, Scene.Foreground, g.Player)
+		Scene.Draw(screen, Scene.Background, view)
+		Scene.DrawEntities(screen, g.Player, view)
+		Scene.Draw(screen, Scene.Foreground, view)
+		Scene.DrawEmotes(screen, g.Player, view)
 		fadeImage := ebiten.NewImage(screen.Bounds().Dx(), screen.Bounds().Dy())
 		fadeColor := color.RGBA{0, 0, 0, uint8(g.Transition.Alpha * 0xff)} // Black with variable Alpha
 		fadeImage.Fill(fadeColor)
@@ -147,16 +429,120 @@ func (g *Game) Draw(screen *ebiten.Image) {
 		screen.DrawImage(fadeImage, nil)
 		fadeImage.Dispose()
 	}
+	if g.Paused {
+		ebitenutil.DebugPrintAt(screen, "PAUSED", screen.Bounds().Dx()/2-20, screen.Bounds().Dy()/2)
+	}
+	if g.ShowVars {
+		ebitenutil.DebugPrint(screen, "World variables:\n"+g.Vars.Dump())
+	}
+}
+
+func (g *Game) drawError(screen *ebiten.Image) {
+	screen.Fill(color.RGBA{0x40, 0, 0, 0xff})
+	msg := "Something went wrong:\n\n" + wrapError(g.Error.Error(), 90) + "\n\n"
+	if _, ok := g.Scenes[g.CurrentScene]; ok {
+		msg += "Press " + g.Bindings.Name(input.Interact) + " to keep playing, " + g.Bindings.Name(input.Pause) + " to quit"
+	} else {
+		msg += "Press " + g.Bindings.Name(input.Pause) + " to quit"
+	}
+	ebitenutil.DebugPrintAt(screen, msg, 20, 20)
+}
+
+// wrapError breaks an error message into lines of at most width characters,
+// splitting after the ": " between wrapped errors where it can.
+func wrapError(msg string, width int) string {
+	var lines []string
+	for _, part := range strings.SplitAfter(msg, ": ") {
+		if n := len(lines); n > 0 && len(lines[n-1])+len(part) <= width {
+			lines[n-1] += part
+			continue
+		}
+		for len(part) > width {
+			lines = append(lines, part[:width])
+			part = part[width:]
+		}
+		lines = append(lines, part)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// fastForward is how many times faster cutscenes play while the fast-forward
+// key is held.
+const fastForward = 4
+
+// StartCutscene plays one of the current scene's cutscenes. Scenes without a
+// cutscene of that name are skipped with a log message.
+func (g *Game) StartCutscene(id string) error {
+	c, ok := g.Scenes[g.CurrentScene].Cutscenes[id]
+	if !ok {
+		log.Printf("Scene %s has no cutscene %q", g.CurrentScene, id)
+		return nil
+	}
+	g.CutScene = c
+	if err := g.processCutscene(); err != nil {
+		return err
+	}
+	g.CutScene.Start()
+	g.State = shared.CutSceneState
+	// Rewinding into the middle of a cutscene would undo it halfway
+	g.History.Clear()
+	return nil
+}
 
+// checkTriggers handles talking to NPCs and returns the trigger whose
+// cutscene should start, if any. Talking to an NPC with an interact trigger
+// plays the cutscene instead of the conversation, and nothing else fires
+// while a conversation is open.
+func (g *Game) checkTriggers(s *scene.Scene) *trigger.Trigger {
+	if g.Input.JustPressed(input.Interact) && !g.Dialogue.IsOpen {
+		if n := s.NPCInReach(g.Player); n != nil && n.InteractionState == npc.NoInteraction {
+			if t := s.Triggers.Interact(n.Name, g.Vars); t != nil {
+				return t
+			}
+		}
+	}
+	s.HandleNPCInteractions(g.Player, g.Input, g.Dialogue)
+	if g.Dialogue.IsOpen {
+		return nil
+	}
+	return s.Triggers.Check(g.Player.Rect(g.Player.X, g.Player.Y), g.Vars)
 }
 
-func (g *Game) Layout(outsideWidth, outsideHeight int) (screenWidth, screenHeight int) {
-	return 320 * 2.5, 240 * 2.5 //Mutiplied by 2.5
+// EnterDoor starts the transition through door unless its condition keeps it locked.
+func (g *Game) EnterDoor(door *collisions.Door) {
+	if !door.Open(g.Vars) {
+		if g.lockedDoor != door {
+			log.Printf("Door %s is locked (%s)", door.Id, door.Condition)
+		}
+		g.lockedDoor = door
+		return
+	}
+	g.lockedDoor = nil
+	g.CurrentDoor = door
+	g.State = shared.TransitionState
+}
+
+// Size of the screen the game draws to, scaled to fit the window
+const (
+	screenWidth  = 320 * 2.5 //Mutiplied by 2.5
+	screenHeight = 240 * 2.5
+)
+
+func (g *Game) Layout(outsideWidth, outsideHeight int) (int, int) {
+	return screenWidth, screenHeight
 }
 
 func (g *Game) HandleMusic() {
+	if g.Headless {
+		// Music runs on its own goroutines, keep it out of headless runs so they stay deterministic
+		return
+	}
+	if g.Music.Frozen || g.Music.Reversed() {
+		// Time is stopped or running backwards, leave the song to the ability
+		return
+	}
 	Scene := g.Scenes[g.CurrentScene]
-	if ebiten.IsKeyPressed(ebiten.KeyP) && !g.KeyPressedLastFrame.KeyP {
+	if g.Input.JustPressed(input.ToggleMusic) {
 		if g.Music.Paused && !g.Music.IsPlaying() {
 			ch := make(chan struct{})
 			go g.Music.FadeIn(time.Millisecond*500, ch)
@@ -168,13 +554,12 @@ func (g *Game) HandleMusic() {
 		}
 
 	}
-	g.KeyPressedLastFrame.KeyP = ebiten.IsKeyPressed(ebiten.KeyP)
 	if g.Music.IsEmpty() {
-		g.Music.LoadAudio("./assets/" + Scene.Music)
+		g.Music.LoadAudio(Scene.Music)
 		g.Music.PlayAudio()
 	} else if !g.Music.IsPlaying() && !g.Music.Paused {
 		g.Music.RewindMusic()
-	} else if g.Music.CurrentSong != "./assets/"+Scene.Music && !g.Transition.Music && g.State != shared.CutSceneState {
+	} else if g.Music.CurrentSong != Scene.Music && !g.Transition.Music && g.State != shared.CutSceneState {
 		g.Transition.Music = true
 		// Channel to signal when fade-out is complete
 		doneChan := make(chan struct{})
@@ -190,7 +575,7 @@ func (g *Game) HandleMusic() {
 			if g.Music.IsPlaying() || g.Music.Paused {
 				g.Music.CloseAudio() // Ensure the current audio is closed
 			}
-			g.Music.LoadAudio("./assets/" + Scene.Music)
+			g.Music.LoadAudio(Scene.Music)
 			g.Music.PlayAudio()
 			g.Transition.Music = false
 		}()
@@ -198,70 +583,132 @@ func (g *Game) HandleMusic() {
 
 }
 
-func (g *Game) processCutscene() {
-	for i := range g.CutScene.Actions {
-		target := g.resolveTarget(g.CutScene.Actions[i].Target)
-		data := g.resolveData(g.CutScene.Actions[i].Data)
-		// fmt.Println(target)
-		g.CutScene.Actions[i].Target = target
-		g.CutScene.Actions[i].Data = data
+// processCutscene resolves the target of every action in the current cutscene
+// against the current scene. It fails if an action names an NPC that isn't there.
+func (g *Game) processCutscene() error {
+	if err := g.resolveActions(g.CutScene.Actions); err != nil {
+		return fmt.Errorf("scene %q: cutscene %q: %w", g.CurrentScene, g.CutScene.ID, err)
 	}
+	return nil
 }
 
-func (g *Game) resolveTarget(target any) interface{} {
-	if target != nil {
-		id, ok := target.(string)
-		if !ok {
-			// Handle the case where target is not a string
-			return target
-		}
-		// fmt.Println(id)
-		switch id {
-		case "player":
-			return g.Player
-		case "dialogue":
-			return g.Dialogue
-		case "music":
-			return g.Music
-		case "scene":
-			return &g.CurrentScene
-		default:
-			npc1 := g.Scenes[g.CurrentScene].NPCs[id]
-			// fmt.Println("Made it")
-			// fmt.Println(npc1)
-			return npc1
+func (g *Game) resolveActions(actions []cutscene.CutsceneAction) error {
+	for i := range actions {
+		target, err := g.resolveTarget(actions[i].ActionType.TargetKind(), actions[i].TargetID)
+		if err != nil {
+			return fmt.Errorf("action %d (%s): %w", i, actions[i].ActionType, err)
+		}
+		actions[i].Target = target
+		for _, b := range actions[i].Blocks() {
+			if err := g.resolveActions(b.Actions); err != nil {
+				return fmt.Errorf("action %d (%s) %s: %w", i, actions[i].ActionType, b.Name, err)
+			}
 		}
 	}
 	return nil
 }
 
-func (g *Game) resolveData(actionData any) interface{} {
-	if actionData != nil {
-		switch t := actionData.(type) {
-		case map[string]interface{}:
-			fmt.Println("Map:", t)
-			return cutscene.Vector2D{
-				X: t["x"].(float64),
-				Y: t["y"].(float64),
-			}
-		case []interface{}:
-			var strings []string
-			for _, item := range t {
-				str, ok := item.(string)
-				if !ok {
-					// Handle the error or skip the item
-					continue
-				}
-				strings = append(strings, str)
+// callCutscene finds the cutscene a Call plays, in the current scene or else
+// among the shared cutscenes, with its targets resolved against the current scene.
+func (g *Game) callCutscene(id string) (*cutscene.Cutscene, error) {
+	c, ok := g.Scenes[g.CurrentScene].Cutscenes[id]
+	if !ok {
+		c, ok = g.Cutscenes[id]
+	}
+	if !ok {
+		return nil, fmt.Errorf("no cutscene %q in scene %q or the shared cutscenes", id, g.CurrentScene)
+	}
+	// A cutscene can call itself, every call plays and resolves its own copy
+	actions := cutscene.CopyActions(c.Actions)
+	if err := g.resolveActions(actions); err != nil {
+		return nil, fmt.Errorf("cutscene %q: %w", id, err)
+	}
+	return &cutscene.Cutscene{ID: c.ID, Actions: actions}, nil
+}
+
+// checkCalls makes sure every Call the cutscenes of a freshly built scene can
+// make finds its cutscene, and that the NPCs the called cutscenes name are in
+// the scene, following Calls inside called cutscenes too.
+func (g *Game) checkCalls(name string, s *scene.Scene) error {
+	ids := make([]string, 0, len(s.Cutscenes))
+	for id := range s.Cutscenes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	checked := make(map[*cutscene.Cutscene]bool)
+	for _, id := range ids {
+		if err := g.checkCalled(name, s, s.Cutscenes[id].Actions, false, checked); err != nil {
+			return fmt.Errorf("scene %q: cutscene %q: %w", name, id, err)
+		}
+	}
+	return nil
+}
+
+// checkCalled checks the Calls in actions, and their NPC targets too if they
+// belong to a called cutscene. The cutscenes in checked are skipped, so ones
+// that call each other are only checked once.
+func (g *Game) checkCalled(name string, s *scene.Scene, actions []cutscene.CutsceneAction, called bool, checked map[*cutscene.Cutscene]bool) error {
+	for i, action := range actions {
+		kind := action.ActionType.TargetKind()
+		needsNPC := kind == cutscene.NPCTarget ||
+			kind == cutscene.CharacterTarget && action.TargetID != cutscene.PlayerTarget.TargetName()
+		if _, ok := s.NPCs[action.TargetID]; called && needsNPC && !ok {
+			return fmt.Errorf("action %d (%s): no NPC named %q in scene %q", i, action.ActionType, action.TargetID, name)
+		}
+		for _, b := range action.Blocks() {
+			if err := g.checkCalled(name, s, b.Actions, called, checked); err != nil {
+				return fmt.Errorf("action %d (%s) %s: %w", i, action.ActionType, b.Name, err)
 			}
-			fmt.Println("Strings:", strings)
-			return strings
-		default:
-			fmt.Println("Value:", t)
-			return t
 		}
-	} else {
-		fmt.Println("is Nil")
+		p, ok := action.Params.(*cutscene.CallParams)
+		if !ok {
+			continue
+		}
+		callee, ok := s.Cutscenes[p.Cutscene]
+		if !ok {
+			callee, ok = g.Cutscenes[p.Cutscene]
+		}
+		if !ok {
+			return fmt.Errorf("action %d (%s): no cutscene %q in scene %q or the shared cutscenes", i, action.ActionType, p.Cutscene, name)
+		}
+		if checked[callee] {
+			continue
+		}
+		checked[callee] = true
+		if err := g.checkCalled(name, s, callee.Actions, true, checked); err != nil {
+			return fmt.Errorf("action %d (%s) cutscene %q: %w", i, action.ActionType, p.Cutscene, err)
+		}
 	}
 	return nil
 }
+
+func (g *Game) resolveTarget(kind cutscene.TargetKind, id string) (interface{}, error) {
+	switch kind {
+	case cutscene.PlayerTarget:
+		return g.Player, nil
+	case cutscene.DialogueTarget:
+		return g.Dialogue, nil
+	case cutscene.MusicTarget:
+		return g.Music, nil
+	case cutscene.SceneTarget:
+		return &g.CurrentScene, nil
+	case cutscene.WorldTarget:
+		return g.Vars, nil
+	case cutscene.CameraTarget:
+		return g.Camera, nil
+	case cutscene.LibraryTarget:
+		return cutscene.Library(g.callCutscene), nil
+	case cutscene.CharacterTarget:
+		if id == cutscene.PlayerTarget.TargetName() {
+			return g.Player, nil
+		}
+		return g.resolveTarget(cutscene.NPCTarget, id)
+	case cutscene.NPCTarget:
+		npc1, ok := g.Scenes[g.CurrentScene].NPCs[id]
+		if !ok {
+			return nil, fmt.Errorf("no NPC named %q in scene %q", id, g.CurrentScene)
+		}
+		return npc1, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,53 @@
+package game
+
+import (
+	"fmt"
+	"rpg_demo/assets"
+	"rpg_demo/data"
+	"rpg_demo/input"
+	"rpg_demo/player"
+	"rpg_demo/scene"
+
+	"github.com/hajimehoshi/ebiten/v2"
+)
+
+// NewHeadless builds a Game that never opens a window, reads assets or starts
+// audio. Scenes come from the given in-memory data, keyed by scene name, and
+// input comes from source, usually an *input.Script. Step it with Step and
+// inspect the exported fields to check the outcome.
+func NewHeadless(start string, scenes map[string]*data.Data, source input.Source) (*Game, error) {
+	sheets := map[string]*ebiten.Image{
+		"up":   ebiten.NewImage(192, 68),
+		"down": ebiten.NewImage(192, 68),
+	}
+	sheets["right"] = ebiten.NewImage(192, 68)
+	sheets["left"] = sheets["right"]
+
+	// Without a file system the manager only has the built in font for the dialogue box
+	g, err := newGame(player.NewWithSpriteSheets(sheets), source, func(name string) (*scene.Scene, error) {
+		d, ok := scenes[name]
+		if !ok {
+			return nil, fmt.Errorf("headless game has no scene %q", name)
+		}
+		return scene.NewHeadless(name, d)
+	}, assets.New(nil))
+	if err != nil {
+		return nil, err
+	}
+	g.Headless = true
+	g.CurrentScene = start
+	if _, err := g.loadScene(start); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Step runs n ticks, stopping early if Update returns an error.
+func (g *Game) Step(n int) error {
+	for i := 0; i < n; i++ {
+		if err := g.Update(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,303 @@
+package game
+
+import (
+	"encoding/json"
+	"math"
+	"rpg_demo/ability"
+	"rpg_demo/data"
+	"rpg_demo/input"
+	"rpg_demo/replay"
+	"rpg_demo/shared"
+	"strings"
+	"testing"
+)
+
+// twoScenes is a scene with a door in a wall to the right of where the player
+// starts, leading to a scene with an NPC that walks right.
+func twoScenes() map[string]*data.Data {
+	sheets := map[string]string{"left": "l", "right": "r", "up": "u", "down": "d"}
+	return map[string]*data.Data{
+		"start": {
+			Obstacles: []data.ObstacleData{{X1: 1100, Y1: 900, X2: 1200, Y2: 1100}},
+			Doors: []data.DoorData{{
+				X1: 1100, Y1: 900, X2: 1200, Y2: 1100,
+				NewX: 300, NewY: 400,
+				Destination: "next",
+				Id:          "startToNext",
+			}},
+		},
+		"next": {
+			NPCs: []data.NPCData{{
+				Name:         "Walker",
+				SpriteSheets: sheets,
+				FrameCount:   4,
+				X:            100,
+				Y:            100,
+				Behaviors: []data.BehaviorData{{
+					Type: "walker",
+					Details: map[string]interface{}{
+						"speed":     60.0,
+						"direction": "right",
+						"timer": map[string]interface{}{
+							"moveTimer":    1.0,
+							"isStopped":    false,
+							"stopDuration": 1.0,
+						},
+					},
+				}},
+			}},
+		},
+	}
+}
+
+// stepUntil steps g until done holds, failing the test if that takes more
+// than max ticks.
+func stepUntil(t *testing.T, g *Game, max int, what string, done func() bool) {
+	t.Helper()
+	for i := 0; i < max; i++ {
+		if done() {
+			return
+		}
+		if err := g.Step(1); err != nil {
+			t.Fatalf("waiting for %s: %s", what, err)
+		}
+	}
+	if !done() {
+		t.Fatalf("no %s after %d ticks", what, max)
+	}
+}
+
+func TestHeadlessDoorAndWalker(t *testing.T) {
+	// The player starts at 1000,1000 and walks 5 pixels a tick, its right edge
+	// reaches the wall after 15 ticks and bumps into the door on the 16th
+	script := input.NewScript().Hold(input.MoveRight, 0, 30)
+	g, err := NewHeadless("start", twoScenes(), script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Step(15); err != nil {
+		t.Fatal(err)
+	}
+	if g.State != shared.PlayState || math.Abs(g.Player.X-1075) > 0.01 || g.Player.Y != 1000 {
+		t.Fatalf("before the door: state %v at %v,%v, want play at 1075,1000", g.State, g.Player.X, g.Player.Y)
+	}
+	if err := g.Step(1); err != nil {
+		t.Fatal(err)
+	}
+	if g.State != shared.TransitionState || g.CurrentDoor == nil || g.CurrentDoor.Id != "startToNext" {
+		t.Fatalf("bumping into the door: state %v, want a transition through startToNext", g.State)
+	}
+	if g.CurrentScene != "start" {
+		t.Fatalf("scene changed to %q before the fade out", g.CurrentScene)
+	}
+
+	// Fading out and back in takes a third of a second each way
+	stepUntil(t, g, 60, "new scene", func() bool { return g.State == shared.NewSceneState })
+	if g.CurrentScene != "next" || g.Player.X != 300 || g.Player.Y != 400 {
+		t.Fatalf("after the door: in %q at %v,%v, want next at 300,400", g.CurrentScene, g.Player.X, g.Player.Y)
+	}
+	if _, loaded := g.Scenes["start"]; loaded {
+		t.Errorf("scene start is still loaded after leaving it")
+	}
+	stepUntil(t, g, 60, "fade in", func() bool { return g.State == shared.PlayState })
+
+	walker := g.Scenes["next"].NPCs["Walker"]
+	if walker.X != 100 || walker.Y != 100 {
+		t.Fatalf("walker moved during the transition to %v,%v", walker.X, walker.Y)
+	}
+	// It walks for a second at 60 pixels a second, then stands for a second
+	if err := g.Step(90); err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(walker.X-160) > 1 || walker.Y != 100 || walker.Direction != "right" {
+		t.Errorf("walker at %v,%v facing %s, want about 160,100 facing right", walker.X, walker.Y, walker.Direction)
+	}
+	if g.Player.X != 300 || g.Player.Y != 400 || g.State != shared.PlayState {
+		t.Errorf("player at %v,%v in state %v, want standing at 300,400", g.Player.X, g.Player.Y, g.State)
+	}
+}
+
+func TestRestoreMissingScene(t *testing.T) {
+	g, err := NewHeadless("start", twoScenes(), input.NewScript().Hold(input.MoveRight, 0, 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Vars.SetInt("coins", 3)
+	save := g.Snapshot()
+	save.CurrentScene = "gone"
+	save.Player.X, save.Player.Y = 10, 10
+	save.Vars = nil
+
+	if err := g.Restore(save); err == nil {
+		t.Fatal("restoring a save in a scene that doesn't exist worked")
+	}
+	if g.CurrentScene != "start" || g.Scenes["start"] == nil {
+		t.Fatalf("after the failed restore the scene is %q, loaded %v", g.CurrentScene, g.Scenes["start"] != nil)
+	}
+	if g.Player.X != 1000 || g.Player.Y != 1000 || g.Vars.Int("coins") != 3 {
+		t.Errorf("failed restore changed the game: player at %v,%v with %d coins", g.Player.X, g.Player.Y, g.Vars.Int("coins"))
+	}
+	// The game carries on where it was
+	if err := g.Step(5); err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(g.Player.X-1025) > 0.01 {
+		t.Errorf("player at %v after walking 5 ticks, want 1025", g.Player.X)
+	}
+}
+
+// calling is a scene whose intro cutscene calls the given cutscene, with a
+// greet cutscene that has the named character show a "!".
+func calling(callee, greeter string) map[string]*data.Data {
+	return map[string]*data.Data{"start": {
+		Cutscenes: []data.CutsceneData{
+			{ID: "intro", Actions: []data.CutsceneAction{
+				{ActionType: "Call", Data: json.RawMessage(`{"cutscene": "` + callee + `"}`)},
+			}},
+			{ID: "greet", Actions: []data.CutsceneAction{
+				{ActionType: "Emote", TargetID: greeter, Data: json.RawMessage(`{"emote": "!"}`)},
+			}},
+		},
+	}}
+}
+
+func TestCallsCheckedAtSceneLoad(t *testing.T) {
+	for _, c := range []struct {
+		callee, greeter string
+		want            string
+	}{
+		{"missing", "player", `scene "start": cutscene "intro": action 0 (Call): no cutscene "missing"`},
+		{"greet", "Nobody", `scene "start": cutscene "intro": action 0 (Call) cutscene "greet": action 0 (Emote): no NPC named "Nobody"`},
+	} {
+		_, err := NewHeadless("start", calling(c.callee, c.greeter), input.NewScript())
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("calling %s greeted by %s: got %v, want %q", c.callee, c.greeter, err, c.want)
+		}
+	}
+}
+
+func TestCallPlaysACopy(t *testing.T) {
+	g, err := NewHeadless("start", calling("greet", "player"), input.NewScript())
+	if err != nil {
+		t.Fatal(err)
+	}
+	called, err := g.callCutscene("greet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if called.Actions[0].Target != g.Player {
+		t.Errorf("called cutscene's emote targets %v, want the player", called.Actions[0].Target)
+	}
+	if original := g.Scenes["start"].Cutscenes["greet"]; original.Actions[0].Target != nil {
+		t.Errorf("calling greet resolved the scene's own copy of it")
+	}
+}
+
+func TestBrokenBehaviorFailsSceneLoad(t *testing.T) {
+	scenes := twoScenes()
+	scenes["next"].NPCs[0].Behaviors[0].Details["direction"] = "sideways"
+	_, err := NewHeadless("next", scenes, input.NewScript())
+	if want := "scene next: NPC Walker: walker direction"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("loading a walker going sideways: got %v, want %q", err, want)
+	}
+}
+
+func TestReplayReportsDesyncTick(t *testing.T) {
+	script := input.NewScript().Hold(input.MoveRight, 0, 40)
+	g, err := NewHeadless("next", twoScenes(), script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.StartRecording(10); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Step(40); err != nil {
+		t.Fatal(err)
+	}
+	rec := g.Recorder.Recording
+	if len(rec.Checkpoints) != 4 {
+		t.Fatalf("recorded %d checkpoints in 40 ticks, want 4", len(rec.Checkpoints))
+	}
+
+	play := func(rec *replay.Recording) *replay.Desync {
+		t.Helper()
+		g, err := NewHeadless("next", twoScenes(), input.NewScript())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := g.StartReplay(rec); err != nil {
+			t.Fatal(err)
+		}
+		if err := g.Step(rec.Ticks()); err != nil {
+			t.Fatal(err)
+		}
+		return g.Replay.Desync
+	}
+	if d := play(rec); d != nil {
+		t.Fatalf("replaying the recording as is: %s", d)
+	}
+
+	// Let go of the key for tick 25 only, the player falls behind from there
+	changed := *rec
+	changed.Inputs = nil
+	for tick := 1; tick <= rec.Ticks(); tick++ {
+		state := input.State(0).With(input.MoveRight)
+		if tick == 25 {
+			state = 0
+		}
+		changed.Inputs = append(changed.Inputs, replay.Run{State: state, Count: 1})
+	}
+	d := play(&changed)
+	if d == nil {
+		t.Fatal("no desync after changing tick 25")
+	}
+	if d.Tick != 30 || d.LastGoodTick != 20 {
+		t.Errorf("desync reported between tick %d and %d, want 20 and 30", d.LastGoodTick, d.Tick)
+	}
+}
+
+func TestRewindUndoesOneTickAtATime(t *testing.T) {
+	// Walk for 10 ticks, then hold rewind for 5
+	script := input.NewScript().Hold(input.MoveRight, 0, 10).Hold(input.UseAbility, 10, 5)
+	g, err := NewHeadless("next", twoScenes(), script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Vars.SetBool(ability.UnlockFlag(ability.Rewind), true)
+	walker := g.Scenes["next"].NPCs["Walker"]
+	check := func(when string, playerX, walkerX float64) {
+		t.Helper()
+		if math.Abs(g.Player.X-playerX) > 1e-6 || math.Abs(walker.X-walkerX) > 1e-6 {
+			t.Errorf("%s: player at %v, walker at %v, want %v and %v", when, g.Player.X, walker.X, playerX, walkerX)
+		}
+	}
+
+	// The player walks 5 pixels a tick and the walker 1
+	if err := g.Step(11); err != nil {
+		t.Fatal(err)
+	}
+	if g.State != shared.Rewinding {
+		t.Fatalf("state %v after pressing rewind, want rewinding", g.State)
+	}
+	check("pressing rewind", 1050, 111)
+	if err := g.Step(1); err != nil {
+		t.Fatal(err)
+	}
+	check("first rewound tick", 1050, 110)
+	if err := g.Step(1); err != nil {
+		t.Fatal(err)
+	}
+	check("second rewound tick", 1045, 109)
+
+	// Letting go carries on from there, and the next rewind goes back from it
+	if err := g.Step(3); err != nil {
+		t.Fatal(err)
+	}
+	if g.State != shared.PlayState {
+		t.Fatalf("state %v after letting go of rewind, want play", g.State)
+	}
+	check("after rewinding", 1035, 107)
+	if got := g.History.Len(); got != 7 {
+		t.Errorf("history has %d ticks after rewinding to tick 7, want 7", got)
+	}
+}
@@ -0,0 +1,39 @@
+package game
+
+import (
+	"fmt"
+	"image/color"
+	"rpg_demo/ability"
+
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/ebitenutil"
+	"github.com/hajimehoshi/ebiten/v2/vector"
+)
+
+// drawHUD draws the energy meter and the selected ability in the top right
+// corner, once the player has an ability to use.
+func (g *Game) drawHUD(screen *ebiten.Image) {
+	a := g.Player.Abilities
+	if a.Selected == "" {
+		return
+	}
+	const width, height, margin = 150, 10, 10
+	x := float32(screen.Bounds().Dx() - width - margin)
+	y := float32(margin)
+
+	fill := color.RGBA{0x40, 0xa0, 0xff, 0xff}
+	if a.Active != "" {
+		fill = color.RGBA{0xff, 0xd0, 0x40, 0xff}
+	}
+	vector.DrawFilledRect(screen, x, y, width, height, color.RGBA{0x20, 0x20, 0x20, 0xc0}, false)
+	vector.DrawFilledRect(screen, x, y, float32(width*a.Energy/ability.MaxEnergy), height, fill, false)
+	vector.StrokeRect(screen, x, y, width, height, 1, color.White, false)
+
+	label := a.Selected
+	if left := a.Cooldowns[a.Selected]; left > 0 {
+		label += fmt.Sprintf(" (%.1fs)", left)
+	} else if spec := ability.Lookup(a.Active); spec != nil && spec.Duration > 0 {
+		label += fmt.Sprintf(" %.1fs", spec.Duration-a.Elapsed)
+	}
+	ebitenutil.DebugPrintAt(screen, label, int(x), int(y)+height+2)
+}
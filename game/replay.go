@@ -0,0 +1,100 @@
+package game
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"rpg_demo/input"
+	"rpg_demo/replay"
+	"rpg_demo/shared"
+)
+
+// StartRecording captures input from now on. The game is reset to its own
+// snapshot first, so the recording and any replay start from the exact same state.
+func (g *Game) StartRecording(interval int) error {
+	if g.State != shared.PlayState || g.Dialogue.IsOpen {
+		return fmt.Errorf("can only start recording while playing")
+	}
+	start := g.Snapshot()
+	if err := g.Restore(start); err != nil {
+		return err
+	}
+	g.Recorder = replay.NewRecorder(g.Input.Source, start, g.Clock.TPS, interval)
+	g.Input = input.New(g.Recorder)
+	return nil
+}
+
+// StopRecording writes the recording to path and goes back to live input.
+func (g *Game) StopRecording(path string) error {
+	if g.Recorder == nil {
+		return fmt.Errorf("not recording")
+	}
+	rec := g.Recorder
+	g.Input = input.New(rec.Source)
+	g.Recorder = nil
+	return replay.Write(path, rec.Recording)
+}
+
+// StartReplay restores the recording's starting state and feeds its input into
+// Update. Once it runs out the previous input source takes over again. The
+// clock switches to the recording's tick rate, any other would desync.
+func (g *Game) StartReplay(rec *replay.Recording) error {
+	if err := g.Restore(rec.Start); err != nil {
+		return err
+	}
+	if rec.TPS > 0 && rec.TPS != g.Clock.TPS {
+		log.Printf("Replay was recorded at %d TPS, switching from %d", rec.TPS, g.Clock.TPS)
+		g.SetTPS(rec.TPS)
+	}
+	g.liveSource = g.Input.Source
+	g.Replay = replay.NewPlayer(rec)
+	g.Input = input.New(g.Replay)
+	return nil
+}
+
+// Checksum hashes the state a replay has to reproduce: the scene, game state,
+// player position and the position of every NPC in the current scene.
+func (g *Game) Checksum() uint64 {
+	h := fnv.New64a()
+	buf := make([]byte, 8)
+	writeFloat := func(f float64) {
+		binary.LittleEndian.PutUint64(buf, math.Float64bits(f))
+		h.Write(buf)
+	}
+	h.Write([]byte(g.CurrentScene))
+	binary.LittleEndian.PutUint64(buf, uint64(g.State))
+	h.Write(buf)
+	writeFloat(g.Player.X)
+	writeFloat(g.Player.Y)
+	if s, ok := g.Scenes[g.CurrentScene]; ok {
+		for _, name := range s.NPCNames() {
+			h.Write([]byte(name))
+			writeFloat(s.NPCs[name].X)
+			writeFloat(s.NPCs[name].Y)
+		}
+	}
+	return h.Sum64()
+}
+
+// checkpoint runs after every Update and checksums the ticks the recorder or
+// replay asks for.
+func (g *Game) checkpoint() {
+	if g.Recorder != nil && g.Recorder.Due() {
+		g.Recorder.Checkpoint(g.Checksum())
+	}
+	if g.Replay == nil || g.liveSource == nil {
+		return
+	}
+	if desync := g.Replay.Check(g.Checksum()); desync != nil {
+		log.Println(desync)
+	}
+	if g.Replay.Done() {
+		if g.Replay.Desync == nil {
+			log.Printf("Replay finished after %d ticks without desync", g.Replay.Recording.Ticks())
+		}
+		g.Input = input.New(g.liveSource)
+		g.liveSource = nil
+	}
+}
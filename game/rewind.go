@@ -0,0 +1,119 @@
+package game
+
+import (
+	"rpg_demo/input"
+	"rpg_demo/npc"
+	"rpg_demo/rewind"
+	"rpg_demo/scene"
+	"rpg_demo/shared"
+	"time"
+)
+
+// rewindSeconds is how far back the rewind ability can go. The history is a
+// ring buffer of one snapshot per tick, so this also caps its memory.
+const rewindSeconds = 10
+
+func (g *Game) newHistory() *rewind.Buffer {
+	return rewind.New(rewindSeconds * g.Clock.TPS)
+}
+
+// record adds the current scene to the rewind history.
+func (g *Game) record(s *scene.Scene) {
+	snap := &g.snapshot
+	snap.Scene = g.CurrentScene
+	snap.Player = rewind.Entity{
+		X:            g.Player.X,
+		Y:            g.Player.Y,
+		Direction:    g.Player.Direction,
+		Frame:        g.Player.Frame.Current,
+		FrameElapsed: g.Player.Frame.Elapsed,
+	}
+	snap.NPCs = snap.NPCs[:0]
+	for _, name := range s.NPCNames() {
+		n := s.NPCs[name]
+		state := rewind.NPC{
+			Name: name,
+			Entity: rewind.Entity{
+				X:            n.X,
+				Y:            n.Y,
+				Direction:    n.Direction,
+				Frame:        n.Frame.Current,
+				FrameElapsed: n.Frame.Elapsed,
+			},
+		}
+		if w, ok := n.Behaviors["walker"].(*npc.Walker); ok {
+			state.Walker = &rewind.Walker{
+				Direction:    w.Direction,
+				MoveTimer:    w.Timer.MoveTimer,
+				StopTimer:    w.Timer.StopTimer,
+				IsStopped:    w.Timer.IsStopped,
+				StopDuration: w.Timer.StopDuration,
+			}
+		}
+		snap.NPCs = append(snap.NPCs, state)
+	}
+	g.History.Push(*snap)
+}
+
+// rewindTick puts the scene back one tick. It returns false once there is no
+// history left in this scene to go back to.
+func (g *Game) rewindTick(s *scene.Scene) bool {
+	snap, ok := g.History.Pop()
+	if !ok || snap.Scene != g.CurrentScene {
+		// Rewinding never crosses a door
+		g.History.Clear()
+		return false
+	}
+	g.Player.X, g.Player.Y = snap.Player.X, snap.Player.Y
+	g.Player.Direction = snap.Player.Direction
+	g.Player.Frame.Current = snap.Player.Frame
+	g.Player.Frame.Elapsed = snap.Player.FrameElapsed
+	for _, state := range snap.NPCs {
+		n, ok := s.NPCs[state.Name]
+		if !ok {
+			continue
+		}
+		n.X, n.Y = state.X, state.Y
+		n.Direction = state.Direction
+		n.Frame.Current = state.Frame
+		n.Frame.Elapsed = state.FrameElapsed
+		if w, ok := n.Behaviors["walker"].(*npc.Walker); ok && state.Walker != nil {
+			w.Direction = state.Walker.Direction
+			w.Timer.MoveTimer = state.Walker.MoveTimer
+			w.Timer.StopTimer = state.Walker.StopTimer
+			w.Timer.IsStopped = state.Walker.IsStopped
+			w.Timer.StopDuration = state.Walker.StopDuration
+		}
+	}
+	return true
+}
+
+// updateRewind runs a tick of the rewind ability: the world goes back a tick
+// for as long as the key is held and there is history left.
+func (g *Game) updateRewind(s *scene.Scene, dt float64) {
+	g.Player.Abilities.Update(dt, g.Input.Pressed(input.UseAbility), g.Input.JustPressed(input.UseAbility))
+	if g.Player.Abilities.World.Rewinding && !g.rewindTick(s) {
+		g.Player.Abilities.Deactivate()
+	}
+	if !g.Player.Abilities.World.Rewinding {
+		g.State = shared.PlayState
+		// The tick rewound to was popped, put it back for the next rewind
+		g.record(s)
+		if !g.Headless {
+			g.Music.Forward()
+		}
+	}
+}
+
+// startRewind switches to rewinding if the rewind ability just started, and
+// reports whether it did.
+func (g *Game) startRewind() bool {
+	if !g.Player.Abilities.World.Rewinding {
+		return false
+	}
+	g.State = shared.Rewinding
+	if !g.Headless {
+		g.Music.Reverse(rewindSeconds * time.Second)
+	}
+	return true
+}
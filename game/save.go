@@ -0,0 +1,221 @@
+package game
+
+import (
+	"fmt"
+	"log"
+	"rpg_demo/input"
+	"rpg_demo/npc"
+	"rpg_demo/savegame"
+	"rpg_demo/scene"
+	"rpg_demo/shared"
+)
+
+const quickSaveSlot = "quicksave"
+
+// Save writes the current game to the named save slot.
+func (g *Game) Save(slot string) error {
+	if g.State != shared.PlayState {
+		return fmt.Errorf("can only save while playing")
+	}
+	return g.Saves.Write(slot, g.Snapshot())
+}
+
+// Load replaces the current game with the contents of the named save slot.
+func (g *Game) Load(slot string) error {
+	save, err := g.Saves.Read(slot)
+	if err != nil {
+		return err
+	}
+	return g.Restore(save)
+}
+
+// Snapshot captures everything that changes while playing. Scenes that were
+// restored from a save but not visited since are carried over untouched.
+func (g *Game) Snapshot() *savegame.Save {
+	save := &savegame.Save{
+		CurrentScene: g.CurrentScene,
+		Player: savegame.PlayerState{
+			X:         g.Player.X,
+			Y:         g.Player.Y,
+			Direction: g.Player.Direction,
+		},
+		Ability: savegame.AbilityState{
+			Selected:  g.Player.Abilities.Selected,
+			Active:    g.Player.Abilities.Active,
+			Elapsed:   g.Player.Abilities.Elapsed,
+			Energy:    g.Player.Abilities.Energy,
+			Cooldowns: g.Player.Abilities.Cooldowns,
+		},
+		Music: savegame.MusicState{
+			CurrentSong: g.Music.CurrentSong,
+			Paused:      g.Music.Paused,
+		},
+		Scenes: make(map[string]savegame.SceneState),
+		Vars:   g.Vars.All(),
+	}
+	for name, state := range g.pendingScenes {
+		save.Scenes[name] = state
+	}
+	for name, s := range g.Scenes {
+		save.Scenes[name] = snapshotScene(s)
+	}
+	return save
+}
+
+// Restore puts the game into the state described by save. Only the current
+// scene is rebuilt right away, the others are loaded when the player enters them.
+// The scene is built before anything else changes, so a save that can't be
+// loaded leaves the game as it was.
+func (g *Game) Restore(save *savegame.Save) error {
+	current, err := g.buildScene(save.CurrentScene)
+	if err != nil {
+		return fmt.Errorf("restoring save: %w", err)
+	}
+	pending := make(map[string]savegame.SceneState, len(save.Scenes))
+	for name, state := range save.Scenes {
+		pending[name] = state
+	}
+	if state, ok := pending[save.CurrentScene]; ok {
+		restoreScene(current, state)
+		delete(pending, save.CurrentScene)
+	}
+
+	g.State = shared.PlayState
+	g.CutScene = nil
+	g.CurrentDoor = nil
+	g.Transition.Alpha = 0
+	g.History.Clear()
+	g.Music.Forward()
+	g.Camera.Release()
+	g.Camera.ZoomTo(1, 0)
+	g.snapCamera = true
+	g.Dialogue.IsOpen = false
+	g.Dialogue.Image = nil
+	g.Player.Emote = nil
+
+	g.Player.X = save.Player.X
+	g.Player.Y = save.Player.Y
+	if _, ok := g.Player.SpriteSheets[save.Player.Direction]; ok {
+		g.Player.Direction = save.Player.Direction
+	}
+	g.Player.CanMove = true
+
+	g.Vars.Replace(save.Vars)
+	a := save.Ability
+	g.Player.Abilities.Restore(a.Selected, a.Active, a.Elapsed, a.Energy, a.Cooldowns)
+
+	if song := save.Music.CurrentSong; song != g.Music.CurrentSong {
+		if song == "" {
+			// Saved before any music started, the scene picks it
+			g.Music.CloseAudio()
+			g.Music.CurrentSong = ""
+		} else if err := g.Music.LoadAudio(song); err != nil {
+			log.Printf("Restoring song %s: %s", song, err)
+		}
+	}
+	if save.Music.Paused {
+		g.Music.Pause()
+	} else {
+		g.Music.PlayAudio()
+	}
+
+	g.pendingScenes = pending
+	for _, s := range g.Scenes {
+		s.Unload()
+	}
+	g.Scenes = map[string]*scene.Scene{save.CurrentScene: current}
+	g.CurrentScene = save.CurrentScene
+	return nil
+}
+
+// loadScene builds the named scene and applies any state restored from a save.
+func (g *Game) loadScene(name string) (*scene.Scene, error) {
+	s, err := g.buildScene(name)
+	if err != nil {
+		return nil, err
+	}
+	if state, ok := g.pendingScenes[name]; ok {
+		restoreScene(s, state)
+		delete(g.pendingScenes, name)
+	}
+	g.Scenes[name] = s
+	return s, nil
+}
+
+// buildScene builds the named scene and checks the Calls of its cutscenes.
+func (g *Game) buildScene(name string) (*scene.Scene, error) {
+	s, err := g.newScene(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := g.checkCalls(name, s); err != nil {
+		s.Unload()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (g *Game) HandleSaves() {
+	if g.Input.JustPressed(input.QuickSave) {
+		if err := g.Save(quickSaveSlot); err != nil {
+			log.Println("Quick save failed:", err)
+		}
+	}
+	if g.Input.JustPressed(input.QuickLoad) {
+		if err := g.Load(quickSaveSlot); err != nil {
+			log.Println("Quick load failed:", err)
+		}
+	}
+}
+
+func snapshotScene(s *scene.Scene) savegame.SceneState {
+	state := savegame.SceneState{NPCs: make(map[string]savegame.NPCState)}
+	for name, n := range s.NPCs {
+		npcState := savegame.NPCState{
+			X:                n.X,
+			Y:                n.Y,
+			Direction:        n.Direction,
+			InteractionState: int(n.InteractionState),
+		}
+		if w, ok := n.Behaviors["walker"].(*npc.Walker); ok {
+			npcState.Walker = &savegame.WalkerState{
+				Direction:    w.Direction,
+				MoveTimer:    w.Timer.MoveTimer,
+				StopTimer:    w.Timer.StopTimer,
+				IsStopped:    w.Timer.IsStopped,
+				StopDuration: w.Timer.StopDuration,
+			}
+		}
+		state.NPCs[name] = npcState
+	}
+	return state
+}
+
+// restoreScene applies saved NPC state. NPCs that no longer exist in the scene
+// data are skipped so old saves keep loading after maps are edited.
+func restoreScene(s *scene.Scene, state savegame.SceneState) {
+	for name, npcState := range state.NPCs {
+		n, ok := s.NPCs[name]
+		if !ok {
+			log.Printf("save references unknown NPC %q, skipping", name)
+			continue
+		}
+		n.X = npcState.X
+		n.Y = npcState.Y
+		if _, ok := n.SpriteSheets[npcState.Direction]; ok {
+			n.Direction = npcState.Direction
+		}
+		n.InteractionState = npc.InteractionState(npcState.InteractionState)
+		// Restore closes the dialogue box, so a half finished conversation starts over
+		if n.InteractionState == npc.PlayerInteracted || n.InteractionState == npc.WaitingForPlayerToResume {
+			n.InteractionState = npc.NoInteraction
+		}
+		if w, ok := n.Behaviors["walker"].(*npc.Walker); ok && npcState.Walker != nil {
+			w.Direction = npcState.Walker.Direction
+			w.Timer.MoveTimer = npcState.Walker.MoveTimer
+			w.Timer.StopTimer = npcState.Walker.StopTimer
+			w.Timer.IsStopped = npcState.Walker.IsStopped
+			w.Timer.StopDuration = npcState.Walker.StopDuration
+		}
+	}
+}
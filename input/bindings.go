@@ -0,0 +1,233 @@
+package input
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+
+	"github.com/hajimehoshi/ebiten/v2"
+)
+
+// axisThreshold is how far a stick has to be pushed before it counts as pressed
+const axisThreshold = 0.5
+
+type AxisBinding struct {
+	Axis      ebiten.StandardGamepadAxis
+	Direction float64 // -1 for up/left, 1 for down/right
+}
+
+// Binding lists every key, gamepad button and stick direction that triggers an action.
+type Binding struct {
+	Keys           []ebiten.Key
+	GamepadButtons []ebiten.StandardGamepadButton
+	GamepadAxes    []AxisBinding
+}
+
+type Bindings map[Action]*Binding
+
+func DefaultBindings() Bindings {
+	return Bindings{
+		MoveUp: {
+			Keys:           []ebiten.Key{ebiten.KeyUp},
+			GamepadButtons: []ebiten.StandardGamepadButton{ebiten.StandardGamepadButtonLeftTop},
+			GamepadAxes:    []AxisBinding{{Axis: ebiten.StandardGamepadAxisLeftStickVertical, Direction: -1}},
+		},
+		MoveDown: {
+			Keys:           []ebiten.Key{ebiten.KeyDown},
+			GamepadButtons: []ebiten.StandardGamepadButton{ebiten.StandardGamepadButtonLeftBottom},
+			GamepadAxes:    []AxisBinding{{Axis: ebiten.StandardGamepadAxisLeftStickVertical, Direction: 1}},
+		},
+		MoveLeft: {
+			Keys:           []ebiten.Key{ebiten.KeyLeft},
+			GamepadButtons: []ebiten.StandardGamepadButton{ebiten.StandardGamepadButtonLeftLeft},
+			GamepadAxes:    []AxisBinding{{Axis: ebiten.StandardGamepadAxisLeftStickHorizontal, Direction: -1}},
+		},
+		MoveRight: {
+			Keys:           []ebiten.Key{ebiten.KeyRight},
+			GamepadButtons: []ebiten.StandardGamepadButton{ebiten.StandardGamepadButtonLeftRight},
+			GamepadAxes:    []AxisBinding{{Axis: ebiten.StandardGamepadAxisLeftStickHorizontal, Direction: 1}},
+		},
+		Interact: {
+			Keys:           []ebiten.Key{ebiten.KeyZ},
+			GamepadButtons: []ebiten.StandardGamepadButton{ebiten.StandardGamepadButtonRightBottom},
+		},
+		CycleAbility: {
+			Keys:           []ebiten.Key{ebiten.KeyV},
+			GamepadButtons: []ebiten.StandardGamepadButton{ebiten.StandardGamepadButtonFrontTopRight},
+		},
+		UseAbility: {
+			Keys:           []ebiten.Key{ebiten.KeyC},
+			GamepadButtons: []ebiten.StandardGamepadButton{ebiten.StandardGamepadButtonRightLeft},
+		},
+		ToggleMusic: {
+			Keys:           []ebiten.Key{ebiten.KeyP},
+			GamepadButtons: []ebiten.StandardGamepadButton{ebiten.StandardGamepadButtonCenterLeft},
+		},
+		Pause: {
+			Keys:           []ebiten.Key{ebiten.KeyEscape},
+			GamepadButtons: []ebiten.StandardGamepadButton{ebiten.StandardGamepadButtonCenterRight},
+		},
+		ResetPosition: {Keys: []ebiten.Key{ebiten.KeyR}},
+		DebugCutscene: {Keys: []ebiten.Key{ebiten.KeyD}},
+		QuickSave:     {Keys: []ebiten.Key{ebiten.KeyF5}},
+		QuickLoad:     {Keys: []ebiten.Key{ebiten.KeyF9}},
+		DebugVars:     {Keys: []ebiten.Key{ebiten.KeyF1}},
+		SkipCutscene: {
+			Keys:           []ebiten.Key{ebiten.KeyEnter},
+			GamepadButtons: []ebiten.StandardGamepadButton{ebiten.StandardGamepadButtonRightTop},
+		},
+		FastForward: {
+			Keys:           []ebiten.Key{ebiten.KeyX},
+			GamepadButtons: []ebiten.StandardGamepadButton{ebiten.StandardGamepadButtonFrontTopLeft},
+		},
+	}
+}
+
+// Used for json unmarshalling
+type axisBindingData struct {
+	Axis      string
+	Direction float64
+}
+type bindingData struct {
+	Keys           []ebiten.Key
+	GamepadButtons []string
+	GamepadAxes    []axisBindingData
+}
+
+var buttonMap = map[string]ebiten.StandardGamepadButton{
+	"RightBottom":      ebiten.StandardGamepadButtonRightBottom,
+	"RightRight":       ebiten.StandardGamepadButtonRightRight,
+	"RightLeft":        ebiten.StandardGamepadButtonRightLeft,
+	"RightTop":         ebiten.StandardGamepadButtonRightTop,
+	"FrontTopLeft":     ebiten.StandardGamepadButtonFrontTopLeft,
+	"FrontTopRight":    ebiten.StandardGamepadButtonFrontTopRight,
+	"FrontBottomLeft":  ebiten.StandardGamepadButtonFrontBottomLeft,
+	"FrontBottomRight": ebiten.StandardGamepadButtonFrontBottomRight,
+	"CenterLeft":       ebiten.StandardGamepadButtonCenterLeft,
+	"CenterRight":      ebiten.StandardGamepadButtonCenterRight,
+	"LeftStick":        ebiten.StandardGamepadButtonLeftStick,
+	"RightStick":       ebiten.StandardGamepadButtonRightStick,
+	"LeftTop":          ebiten.StandardGamepadButtonLeftTop,
+	"LeftBottom":       ebiten.StandardGamepadButtonLeftBottom,
+	"LeftLeft":         ebiten.StandardGamepadButtonLeftLeft,
+	"LeftRight":        ebiten.StandardGamepadButtonLeftRight,
+	"CenterCenter":     ebiten.StandardGamepadButtonCenterCenter,
+}
+
+var axisMap = map[string]ebiten.StandardGamepadAxis{
+	"LeftStickHorizontal":  ebiten.StandardGamepadAxisLeftStickHorizontal,
+	"LeftStickVertical":    ebiten.StandardGamepadAxisLeftStickVertical,
+	"RightStickHorizontal": ebiten.StandardGamepadAxisRightStickHorizontal,
+	"RightStickVertical":   ebiten.StandardGamepadAxisRightStickVertical,
+}
+
+// Name describes what to press for an action in on-screen hints, its first key
+// or else its first gamepad button. An action bound to neither goes by its own name.
+func (b Bindings) Name(action Action) string {
+	binding := b[action]
+	if binding == nil {
+		return action.String()
+	}
+	if len(binding.Keys) > 0 {
+		return binding.Keys[0].String()
+	}
+	for _, button := range binding.GamepadButtons {
+		for name, mapped := range buttonMap {
+			if mapped == button {
+				return "gamepad " + name
+			}
+		}
+	}
+	return action.String()
+}
+
+// LoadBindings reads the named binding file from fsys. Actions missing from the
+// file keep their default bindings, so a file only needs to list what it changes.
+func LoadBindings(fsys fs.FS, name string) (Bindings, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return DecodeBindings(f)
+}
+
+func DecodeBindings(r io.Reader) (Bindings, error) {
+	raw := map[string]bindingData{}
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, err
+	}
+	bindings := DefaultBindings()
+	for name, bd := range raw {
+		action, err := ParseAction(name)
+		if err != nil {
+			return nil, err
+		}
+		b := &Binding{Keys: bd.Keys}
+		for _, buttonName := range bd.GamepadButtons {
+			button, ok := buttonMap[buttonName]
+			if !ok {
+				return nil, fmt.Errorf("%s: unknown gamepad button %q", name, buttonName)
+			}
+			b.GamepadButtons = append(b.GamepadButtons, button)
+		}
+		for _, ad := range bd.GamepadAxes {
+			axis, ok := axisMap[ad.Axis]
+			if !ok {
+				return nil, fmt.Errorf("%s: unknown gamepad axis %q", name, ad.Axis)
+			}
+			if ad.Direction != -1 && ad.Direction != 1 {
+				return nil, fmt.Errorf("%s: axis direction must be -1 or 1", name)
+			}
+			b.GamepadAxes = append(b.GamepadAxes, AxisBinding{Axis: axis, Direction: ad.Direction})
+		}
+		bindings[action] = b
+	}
+	return bindings, nil
+}
+
+// Device reads the keyboard and every connected gamepad through ebiten.
+type Device struct {
+	Bindings Bindings
+	gamepads []ebiten.GamepadID
+}
+
+func NewDevice(bindings Bindings) *Device {
+	return &Device{Bindings: bindings}
+}
+
+func (d *Device) Poll() State {
+	d.gamepads = ebiten.AppendGamepadIDs(d.gamepads[:0])
+	var state State
+	for action, binding := range d.Bindings {
+		if d.pressed(binding) {
+			state = state.With(action)
+		}
+	}
+	return state
+}
+
+func (d *Device) pressed(b *Binding) bool {
+	for _, key := range b.Keys {
+		if ebiten.IsKeyPressed(key) {
+			return true
+		}
+	}
+	for _, id := range d.gamepads {
+		if !ebiten.IsStandardGamepadLayoutAvailable(id) {
+			continue
+		}
+		for _, button := range b.GamepadButtons {
+			if ebiten.IsStandardGamepadButtonPressed(id, button) {
+				return true
+			}
+		}
+		for _, axis := range b.GamepadAxes {
+			if ebiten.StandardGamepadAxisValue(id, axis.Axis)*axis.Direction > axisThreshold {
+				return true
+			}
+		}
+	}
+	return false
+}
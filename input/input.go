@@ -0,0 +1,116 @@
+package input
+
+import "fmt"
+
+// Action is a logical input the game reacts to, independent of which key or
+// gamepad button produced it.
+type Action int
+
+const (
+	MoveUp Action = iota
+	MoveDown
+	MoveLeft
+	MoveRight
+	Interact
+	CycleAbility
+	UseAbility
+	ToggleMusic
+	Pause
+	ResetPosition
+	DebugCutscene
+	QuickSave
+	QuickLoad
+	DebugVars
+	SkipCutscene
+	FastForward
+	MaxAction
+)
+
+// actionMap maps the names used in binding files to Action constants
+var actionMap = map[string]Action{
+	"MoveUp":        MoveUp,
+	"MoveDown":      MoveDown,
+	"MoveLeft":      MoveLeft,
+	"MoveRight":     MoveRight,
+	"Interact":      Interact,
+	"CycleAbility":  CycleAbility,
+	"UseAbility":    UseAbility,
+	"ToggleMusic":   ToggleMusic,
+	"Pause":         Pause,
+	"ResetPosition": ResetPosition,
+	"DebugCutscene": DebugCutscene,
+	"QuickSave":     QuickSave,
+	"QuickLoad":     QuickLoad,
+	"DebugVars":     DebugVars,
+	"SkipCutscene":  SkipCutscene,
+	"FastForward":   FastForward,
+}
+
+func (a Action) String() string {
+	for name, action := range actionMap {
+		if action == a {
+			return name
+		}
+	}
+	return fmt.Sprintf("Action(%d)", int(a))
+}
+
+// ParseAction returns the Action for a name used in binding files.
+func ParseAction(name string) (Action, error) {
+	if a, ok := actionMap[name]; ok {
+		return a, nil
+	}
+	return 0, fmt.Errorf("unknown input action %q", name)
+}
+
+// State holds which actions are down during a single tick, one bit per Action.
+type State uint32
+
+func (s State) Has(a Action) bool {
+	return s&(1<<uint(a)) != 0
+}
+
+func (s State) With(a Action) State {
+	return s | 1<<uint(a)
+}
+
+// Source produces the raw action state for the current tick. The game polls
+// it exactly once per Update.
+type Source interface {
+	Poll() State
+}
+
+// Handler turns a Source into per-action pressed, just-pressed and
+// just-released queries.
+type Handler struct {
+	Source   Source
+	current  State
+	previous State
+}
+
+func New(source Source) *Handler {
+	return &Handler{Source: source}
+}
+
+// Update polls the source. Call it once at the start of every tick.
+func (h *Handler) Update() {
+	h.previous = h.current
+	h.current = h.Source.Poll()
+}
+
+// State returns the actions held down this tick.
+func (h *Handler) State() State {
+	return h.current
+}
+
+func (h *Handler) Pressed(a Action) bool {
+	return h.current.Has(a)
+}
+
+func (h *Handler) JustPressed(a Action) bool {
+	return h.current.Has(a) && !h.previous.Has(a)
+}
+
+func (h *Handler) JustReleased(a Action) bool {
+	return !h.current.Has(a) && h.previous.Has(a)
+}
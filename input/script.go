@@ -0,0 +1,45 @@
+package input
+
+// Script is a Source that plays back a fixed timeline, one State per tick.
+// Once the timeline runs out every action reads as released.
+type Script struct {
+	Frames []State
+	Tick   int
+}
+
+func NewScript() *Script {
+	return &Script{}
+}
+
+func (s *Script) Poll() State {
+	var state State
+	if s.Tick < len(s.Frames) {
+		state = s.Frames[s.Tick]
+	}
+	s.Tick++
+	return state
+}
+
+// Hold keeps action down for ticks frames starting at frame from.
+func (s *Script) Hold(action Action, from, ticks int) *Script {
+	for len(s.Frames) < from+ticks {
+		s.Frames = append(s.Frames, 0)
+	}
+	for i := from; i < from+ticks; i++ {
+		s.Frames[i] = s.Frames[i].With(action)
+	}
+	return s
+}
+
+// Press taps action for a single frame.
+func (s *Script) Press(action Action, at int) *Script {
+	return s.Hold(action, at, 1)
+}
+
+// Idle extends the timeline with ticks frames of no input.
+func (s *Script) Idle(ticks int) *Script {
+	for i := 0; i < ticks; i++ {
+		s.Frames = append(s.Frames, 0)
+	}
+	return s
+}
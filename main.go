@@ -1,19 +1,52 @@
 package main
 
 import (
+	"flag"
 	"log"
+	"rpg_demo/clock"
 	g "rpg_demo/game"
+	"rpg_demo/replay"
 
 	"github.com/hajimehoshi/ebiten/v2"
 	"github.com/hajimehoshi/ebiten/v2/audio"
 )
 
 func main() {
+	record := flag.String("record", "", "record the session's input to this file")
+	replayPath := flag.String("replay", "", "replay a recorded session from this file")
+	tps := flag.Int("tps", clock.DefaultTPS, "game updates per second")
+	flag.Parse()
+
 	ebiten.SetWindowSize(640, 480)
 	ebiten.SetWindowTitle("My Game")
-	game := g.New()
+	game, err := g.New()
+	if err != nil {
+		log.Fatal(err)
+	}
 	game.Music.SetCtx(audio.NewContext(44100))
-	if err := ebiten.RunGame(game); err != nil {
+	game.SetTPS(*tps)
+	if *replayPath != "" {
+		rec, err := replay.Read(*replayPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := game.StartReplay(rec); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *record != "" {
+		if err := game.StartRecording(replay.DefaultInterval); err != nil {
+			log.Fatal(err)
+		}
+	}
+	err = ebiten.RunGame(game)
+	// Keep the recording even if the game ended on an error, that's the one worth replaying
+	if *record != "" {
+		if err := game.StopRecording(*record); err != nil {
+			log.Println("Saving the recording failed:", err)
+		}
+	}
+	if err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,130 +1,225 @@
 package music
 
 import (
-	"os"
-	"strings"
+	"rpg_demo/assets"
+	"sync"
 	"time"
 
 	"github.com/hajimehoshi/ebiten/v2/audio"
-	"github.com/hajimehoshi/ebiten/v2/audio/mp3"
-	"github.com/hajimehoshi/ebiten/v2/audio/wav"
 )
 
 type Music struct {
 	audioContext *audio.Context
+	mu           sync.Mutex // Guards player, the fades and song changes run on their own goroutines
 	player       *audio.Player
-	audioFile    *os.File // Add a field to store the audio file
+	Assets       *assets.Manager // Where songs are loaded from
 	CurrentSong  string
 	Paused       bool
+	Frozen       bool // Held still by a time stop, apart from Paused so it doesn't forget what the player chose
+	pcm          []byte
+	reverse      *audio.Player // Plays the song backwards while rewinding
+	reverseFrom  time.Duration // Where in the song the reversed part starts
 }
 
 const sampleRate = 44100
 
-func (m *Music) LoadAudio(filePath string) error {
-	m.CurrentSong = filePath
-	parts := strings.Split(filePath, ".")
+// bytesPerSecond is the size of a second of decoded audio, 16 bit stereo.
+const bytesPerSecond = sampleRate * 4
 
-	var err error
-	m.audioFile, err = os.Open(filePath)
+// LoadAudio loads a song by its name in the assets directory, replacing the
+// current one. It has to be an mp3 or wav file.
+func (m *Music) LoadAudio(name string) error {
+	m.CloseAudio()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.CurrentSong = name
+	if m.audioContext == nil {
+		// No audio device, only keep track of what should be playing
+		return nil
+	}
+	pcm, err := m.Assets.Audio(name, sampleRate)
 	if err != nil {
 		return err
 	}
-	var d *mp3.Stream
-	var dw *wav.Stream
-	switch parts[2] {
-	case "mp3":
-		// Use DecodeWithSampleRate for decoding
-		d, err = mp3.DecodeWithSampleRate(sampleRate, m.audioFile)
-		if err != nil {
-			m.audioFile.Close()
-			return err
-		}
-		// Use the new method to create a player
-		m.player, err = m.audioContext.NewPlayer(d)
-		if err != nil {
-			return err
-		}
-	case "wav":
-		dw, err = wav.DecodeWithSampleRate(sampleRate, m.audioFile)
-		if err != nil {
-			m.audioFile.Close()
-			return err
-		}
-		m.player, err = m.audioContext.NewPlayer(dw)
-		if err != nil {
-			return err
-		}
-	}
-
+	m.pcm = pcm
+	m.player = m.audioContext.NewPlayerFromBytes(pcm)
 	return nil
 }
-func (m *Music) FadeIn(duration time.Duration, doneChan chan struct{}) {
-	// Determine the amount of time to sleep between volume adjustments
-	const steps = 30
-	sleepDuration := duration / steps
 
-	// Start with volume at 0
-	m.player.SetVolume(0)
-	// Gradually increase the volume
-	for i := 0; i < steps; i++ {
-		// Calculate the new volume (linearly increases)
-		newVolume := float64(i+1) / float64(steps)
-		m.player.SetVolume(newVolume)
-		time.Sleep(sleepDuration)
+// Reverse plays the song backwards, and a bit quieter, from where it is. It
+// goes back at most max, which should be as far as the game can rewind.
+func (m *Music) Reverse(max time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.player == nil || m.reverse != nil || m.Paused {
+		return
+	}
+	end := int(m.player.Current().Seconds()*bytesPerSecond) &^ 3
+	if end > len(m.pcm) {
+		end = len(m.pcm) &^ 3
+	}
+	start := end - int(max.Seconds()*bytesPerSecond)&^3
+	if start < 0 {
+		start = 0
+	}
+	reversed := make([]byte, end-start)
+	for i := start; i < end; i += 4 {
+		copy(reversed[end-4-i:], m.pcm[i:i+4])
+	}
+	m.player.Pause()
+	m.reverseFrom = time.Duration(end) * time.Second / bytesPerSecond
+	m.reverse = m.audioContext.NewPlayerFromBytes(reversed)
+	m.reverse.SetVolume(0.6)
+	m.reverse.Play()
+}
+
+// Forward plays the song forwards again, from as far back as Reverse got.
+func (m *Music) Forward() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.reverse == nil {
+		return
+	}
+	pos := m.reverseFrom - m.reverse.Current()
+	if pos < 0 {
+		pos = 0
+	}
+	m.reverse.Close()
+	m.reverse = nil
+	m.player.SetPosition(pos)
+	if !m.Paused {
+		m.player.Play()
 	}
+}
 
-	// Ensure the volume is set to the maximum at the end
-	m.player.SetVolume(1)
-	// Resume playing if the player was paused
-	m.player.Play()
-	m.Paused = false
-	// Signal that the fade-in is complete
-	close(doneChan)
+// Reversed reports whether the song is playing backwards.
+func (m *Music) Reversed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.reverse != nil
 }
-func (m *Music) FadeOut(duration time.Duration, doneChan chan struct{}) {
-	// Determine the amount of time to sleep between volume adjustments
-	const steps = 30
-	sleepDuration := duration / steps
 
-	// Gradually decrease the volume
-	for i := 0; i < steps; i++ {
-		// Calculate the new volume (linearly decreases)
-		newVolume := float64(steps-i-1) / float64(steps)
-		m.player.SetVolume(newVolume)
-		time.Sleep(sleepDuration)
+// FadeIn turns the volume up from nothing over duration and plays the song,
+// then closes doneChan. It stops early if the song is closed or changed.
+func (m *Music) FadeIn(duration time.Duration, doneChan chan struct{}) {
+	defer close(doneChan)
+	faded := m.fade(duration, 0, 1)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if faded {
+		m.player.Play()
 	}
+	m.Paused = false
+}
 
-	// Ensure the volume is set to 0 at the end
-	m.player.SetVolume(0)
-	// Stop the player if needed
+// FadeOut turns the volume down to nothing over duration and pauses the song,
+// then closes doneChan. It stops early if the song is closed or changed.
+func (m *Music) FadeOut(duration time.Duration, doneChan chan struct{}) {
+	defer close(doneChan)
+	if !m.fade(duration, 1, 0) {
+		m.mu.Lock()
+		m.Paused = true
+		m.mu.Unlock()
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.player.Pause()
 	m.Paused = true
-	// Signal that the fade-out is complete
-	close(doneChan)
 }
+
+// fade moves the volume of the current song from one level to another over
+// duration. It reports false, leaving the volume alone, if there's no song or
+// it was closed or replaced on the way. Otherwise the player is still current
+// when it returns.
+func (m *Music) fade(duration time.Duration, from, to float64) bool {
+	const steps = 30
+	sleepDuration := duration / steps
+	m.mu.Lock()
+	p := m.player
+	m.mu.Unlock()
+	if p == nil {
+		return false
+	}
+	for i := 0; i <= steps; i++ {
+		m.mu.Lock()
+		if m.player != p {
+			m.mu.Unlock()
+			return false
+		}
+		p.SetVolume(from + (to-from)*float64(i)/steps)
+		m.mu.Unlock()
+		if i < steps {
+			time.Sleep(sleepDuration)
+		}
+	}
+	return true
+}
+
 func (m *Music) GetPlayer() *audio.Player {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	return m.player
 }
 func (m *Music) IsPlaying() bool {
-	return m.player.IsPlaying()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.player != nil && m.player.IsPlaying()
 }
 func (m *Music) Pause() {
-	m.player.Pause()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.player != nil {
+		m.player.Pause()
+	}
 	m.Paused = true
 }
+
+// Freeze holds the song where it is until Thaw.
+func (m *Music) Freeze() {
+	if m.Frozen {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.player != nil {
+		m.player.Pause()
+	}
+	m.Frozen = true
+}
+
+// Thaw goes on with the song from where Freeze held it, unless it was paused.
+func (m *Music) Thaw() {
+	if !m.Frozen {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.player != nil && !m.Paused {
+		m.player.Play()
+	}
+	m.Frozen = false
+}
+
 func (m *Music) RewindMusic() {
-	m.player.Rewind()
-	m.player.Play()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.player != nil {
+		m.player.Rewind()
+		m.player.Play()
+	}
 	m.Paused = false
 }
 func (m *Music) SetCtx(auctx *audio.Context) {
 	m.audioContext = auctx
 }
 func (m *Music) IsEmpty() bool {
-	return m.audioFile == nil
+	return m.CurrentSong == ""
 }
 
 func (m *Music) PlayAudio() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if m.player != nil {
 		m.player.Play()
 	}
@@ -132,10 +227,16 @@ func (m *Music) PlayAudio() {
 }
 
 func (m *Music) CloseAudio() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.reverse != nil {
+		m.reverse.Close()
+		m.reverse = nil
+	}
 	if m.player != nil {
 		m.player.Close()
-	}
-	if m.audioFile != nil {
-		m.audioFile.Close()
+		m.player = nil
+		m.pcm = nil
+		m.Assets.ReleaseAudio(m.CurrentSong, sampleRate)
 	}
 }
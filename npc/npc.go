@@ -1,13 +1,19 @@
 package npc
 
 import (
+	"encoding/json"
+	"fmt"
 	"image"
 	"log"
 	"math"
+	"rpg_demo/collisions"
 	"rpg_demo/data"
+	"rpg_demo/dialogue"
+	"rpg_demo/emote"
+	"rpg_demo/input"
+	"rpg_demo/shared"
 
 	"github.com/hajimehoshi/ebiten/v2"
-	"github.com/hajimehoshi/ebiten/v2/ebitenutil"
 )
 
 type InteractionState int
@@ -20,31 +26,30 @@ const (
 )
 
 type Behavior interface {
-	Execute(*NPC)
-	Value() []string
+	Execute(npc *NPC, in *input.Handler, dt float64, c collisions.Collisions)
 }
 
-type Frame struct {
-	Height    int
-	Width     int
-	Count     int
-	Current   int
-	TickCount int // Counter to track the number of updates
-}
+type Frame = shared.Frame
+
+// Timer times a walker's walks and stops, in seconds.
 type Timer struct {
-	MoveTimer    int
-	StopTimer    int
+	MoveTimer    float64
+	StopTimer    float64
 	IsStopped    bool
-	StopDuration int
+	StopDuration float64
 }
 
+// WalkTime is how many seconds a walker walks between stops.
+const WalkTime = 1.0
+
 type Walker struct {
 	Direction string
-	Speed     float64
+	Speed     float64 // Pixels per second
 	Timer     *Timer
 }
 type Talker struct {
-	Dialogues []string
+	Tree   *dialogue.Tree
+	Frozen *dialogue.Tree // Said while time is stopped, nil if the NPC can't talk then
 }
 
 type NPC struct {
@@ -56,9 +61,27 @@ type NPC struct {
 	Behaviors        map[string]Behavior
 	InteractionState InteractionState
 	Image            *ebiten.Image
+	Portraits        map[string]*ebiten.Image // By expression
+	Emote            *emote.Bubble            // Shown over their head, nil for none
 }
 
-func (n *NPC) Draw(screen *ebiten.Image, bgX, bgY float64) {
+// Portrait returns the dialogue portrait for an expression, the usual one if
+// the NPC doesn't have it.
+func (n *NPC) Portrait(expression string) *ebiten.Image {
+	if img, ok := n.Portraits[expression]; ok {
+		return img
+	}
+	return n.Image
+}
+
+// Head is where an emote over the NPC floats from.
+func (n *NPC) Head() (x, y float64) {
+	return n.X + float64(n.Frame.Width)/2, n.Y
+}
+
+// Draw draws the NPC through view, the camera's world to screen transform.
+// frozen drains the color, for while time is stopped.
+func (n *NPC) Draw(screen *ebiten.Image, view ebiten.GeoM, frozen bool) {
 	currentSpriteSheet := n.SpriteSheets[n.Direction]
 	// Determine the x, y location of the current frame on the sprite sheet
 	sx := n.Frame.Current * n.Frame.Width
@@ -72,21 +95,45 @@ func (n *NPC) Draw(screen *ebiten.Image, bgX, bgY float64) {
 		opts.GeoM.Scale(-1, 1)                         // Flip horizontally
 		opts.GeoM.Translate(float64(n.Frame.Width), 0) // Adjust the position after flipping
 	}
-	opts.GeoM.Translate(bgX+n.X, bgY+n.Y)
+	opts.GeoM.Translate(n.X, n.Y)
+	opts.GeoM.Concat(view)
+	if frozen {
+		shared.DrawFrozen(screen, frame, opts)
+		return
+	}
 	screen.DrawImage(frame, opts)
 }
 
-func (npc *NPC) Update() {
+// Update runs the NPC's behaviors for dt seconds. c is what they have to walk
+// around.
+func (npc *NPC) Update(in *input.Handler, dt float64, c collisions.Collisions) {
 	for _, behavior := range npc.Behaviors {
-		behavior.Execute(npc)
+		behavior.Execute(npc, in, dt, c)
 	}
 }
-func New(data *data.NPCData) *NPC {
-	sheets := loadSpriteSheets(data)
+
+// ImageLoader loads the image at a path relative to the assets directory.
+type ImageLoader func(path string) (*ebiten.Image, error)
+
+// New creates an NPC from its scene data. Art that fails to load is replaced by
+// a checkerboard, only data the NPC can't work without is an error.
+func New(data *data.NPCData, load ImageLoader) (*NPC, error) {
+	if data.FrameCount <= 0 {
+		return nil, fmt.Errorf("NPC %s: frameCount must be positive, got %d", data.Name, data.FrameCount)
+	}
+	if len(data.SpriteSheets) == 0 {
+		return nil, fmt.Errorf("NPC %s: no sprite sheets", data.Name)
+	}
+	behaviors, err := loadBehaviors(data)
+	if err != nil {
+		return nil, fmt.Errorf("NPC %s: %w", data.Name, err)
+	}
+	sheets := loadSpriteSheets(data, load)
 	direction, sheet := GetAnySpriteSheet(sheets)
-	img, err := LoadSpriteSheet(data.Image)
+	img, err := load(data.Image)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("NPC %s: error loading portrait: %s", data.Name, err)
+		img = shared.Checkerboard(1024, 1024, 128)
 	}
 	npc := &NPC{
 		Name:         data.Name,
@@ -99,75 +146,136 @@ func New(data *data.NPCData) *NPC {
 		Direction: direction,
 		X:         data.X,
 		Y:         data.Y,
-		Behaviors: loadBehaviors(data),
+		Behaviors: behaviors,
 		Image:     img,
+		Portraits: make(map[string]*ebiten.Image),
 	}
-	return npc
+	for expression, path := range data.Portraits {
+		img, err := load(path)
+		if err != nil {
+			log.Printf("NPC %s: error loading %s portrait: %s", data.Name, expression, err)
+			img = shared.Checkerboard(1024, 1024, 128)
+		}
+		npc.Portraits[expression] = img
+	}
+	return npc, nil
+}
+
+// CheckBehaviors reports what New would find wrong with an NPC's behaviors,
+// without loading any images.
+func CheckBehaviors(data *data.NPCData) error {
+	_, err := loadBehaviors(data)
+	return err
 }
 
-func loadBehaviors(data *data.NPCData) map[string]Behavior {
+func loadBehaviors(data *data.NPCData) (map[string]Behavior, error) {
 	behaviors := make(map[string]Behavior)
 	// Initialize behaviors
 	for _, behaviorData := range data.Behaviors {
 		switch behaviorData.Type {
 		case "walker":
 			if speed, ok := behaviorData.Details["speed"].(float64); ok {
-				direction := behaviorData.Details["direction"].(string)
+				direction, _ := behaviorData.Details["direction"].(string)
+				if _, ok := opposite[direction]; !ok {
+					return nil, fmt.Errorf("walker direction must be up, down, left or right, got %v", behaviorData.Details["direction"])
+				}
 				timerData, ok := behaviorData.Details["timer"].(map[string]interface{})
 				timer := &Timer{}
 				if ok {
 
 					if moveTimer, ok := timerData["moveTimer"].(float64); ok {
-						timer.MoveTimer = int(moveTimer)
+						timer.MoveTimer = moveTimer
 					}
 					if stopTimer, ok := timerData["stopTimer"].(float64); ok {
-						timer.StopTimer = int(stopTimer)
+						timer.StopTimer = stopTimer
 					}
 					if isStopped, ok := timerData["isStopped"].(bool); ok {
 						timer.IsStopped = isStopped
 					}
 					if stopDuration, ok := timerData["stopDuration"].(float64); ok {
-						timer.StopDuration = int(stopDuration)
+						timer.StopDuration = stopDuration
 					}
 				}
 				behaviors["walker"] = &Walker{Direction: direction, Speed: speed, Timer: timer}
 			}
 		case "talker":
-			// Extract the interface{} slice
-			if dialogueInterfaces, ok := behaviorData.Details["dialogues"].([]interface{}); ok {
-				var dialogues []string
-
-				// Iterate over the slice and convert each element to a string
-				for _, dialogueInterface := range dialogueInterfaces {
-					if dialogue, ok := dialogueInterface.(string); ok {
-						dialogues = append(dialogues, dialogue)
-					} else {
-						// Handle the error if the type assertion fails
-						log.Printf("Invalid dialogue type: %T\n", dialogueInterface)
-					}
+			talker := &Talker{}
+			// A dialogue tree takes priority over a flat list of lines
+			if treeDetails, ok := behaviorData.Details["tree"]; ok {
+				tree, err := loadTree(treeDetails)
+				if err != nil {
+					return nil, fmt.Errorf("invalid dialogue tree: %w", err)
 				}
-
+				talker.Tree = tree
+			} else if dialogueInterfaces, ok := behaviorData.Details["dialogues"].([]interface{}); ok {
 				// Create the Talker behavior with the extracted dialogues
-				behaviors["talker"] = &Talker{Dialogues: dialogues}
+				talker.Tree = dialogue.Linear(loadLines(data.Name, dialogueInterfaces))
+			}
+			// What the NPC says frozen in time, a tree or a list of lines like above
+			switch frozen := behaviorData.Details["frozen"].(type) {
+			case nil:
+			case []interface{}:
+				talker.Frozen = dialogue.Linear(loadLines(data.Name, frozen))
+			default:
+				tree, err := loadTree(frozen)
+				if err != nil {
+					return nil, fmt.Errorf("invalid frozen dialogue: %w", err)
+				}
+				talker.Frozen = tree
+			}
+			if talker.Tree != nil || talker.Frozen != nil {
+				behaviors["talker"] = talker
 			}
 		}
 
 	}
-	return behaviors
+	return behaviors, nil
 }
-func (t *Talker) Value() []string {
-	return t.Dialogues
+
+// loadLines converts the lines of a talker, which arrive as generic JSON, to
+// strings.
+func loadLines(name string, dialogueInterfaces []interface{}) []string {
+	var dialogues []string
+
+	// Iterate over the slice and convert each element to a string
+	for _, dialogueInterface := range dialogueInterfaces {
+		if line, ok := dialogueInterface.(string); ok {
+			if err := dialogue.CheckMarkup(line); err != nil {
+				log.Printf("%s: %s", name, err)
+			}
+			dialogues = append(dialogues, line)
+		} else {
+			// Handle the error if the type assertion fails
+			log.Printf("%s: invalid dialogue type: %T\n", name, dialogueInterface)
+		}
+	}
+	return dialogues
 }
-func (w *Walker) Value() []string {
-	return []string{}
+
+// loadTree decodes the "tree" detail of a talker, which arrives as generic
+// JSON, into a dialogue tree.
+func loadTree(details interface{}) (*dialogue.Tree, error) {
+	raw, err := json.Marshal(details)
+	if err != nil {
+		return nil, err
+	}
+	treeData := &data.DialogueTreeData{}
+	if err := json.Unmarshal(raw, treeData); err != nil {
+		return nil, err
+	}
+	return dialogue.NewTree(treeData)
 }
-func LoadNPCs(dataList []data.NPCData) map[string]*NPC {
+func LoadNPCs(dataList []data.NPCData, load ImageLoader) (map[string]*NPC, error) {
 	npcs := make(map[string]*NPC)
-	for _, npc := range dataList {
-		npcs[npc.Name] = New(&npc)
+	for _, data := range dataList {
+		npc, err := New(&data, load)
+		if err != nil {
+			return nil, err
+		}
+		npcs[data.Name] = npc
 	}
 
-	return npcs
+	return npcs, nil
 }
 
 func GetAnySpriteSheet(spriteSheets map[string]*ebiten.Image) (string, *ebiten.Image) {
@@ -177,31 +285,30 @@ func GetAnySpriteSheet(spriteSheets map[string]*ebiten.Image) (string, *ebiten.I
 	return "", nil // Return nil if the map is empty
 }
 
-func loadSpriteSheets(data *data.NPCData) map[string]*ebiten.Image {
+func loadSpriteSheets(data *data.NPCData, load ImageLoader) map[string]*ebiten.Image {
 	sheets := make(map[string]*ebiten.Image)
 	// Load sprite sheets
 	for direction, path := range data.SpriteSheets {
 		// Load the image for the given path and store it in SpriteSheets
-		// Assuming a function LoadSpriteSheet(path string) (*ebiten.Image, error)
-		spriteSheet, err := LoadSpriteSheet(path)
+		spriteSheet, err := load(path)
 		if err != nil {
-			log.Printf("Error loading sprite sheet: %s", err)
-			continue
+			log.Printf("NPC %s: error loading sprite sheet: %s", data.Name, err)
+			spriteSheet = shared.Checkerboard(192, 68, 12)
 		}
 		sheets[direction] = spriteSheet
 	}
 	return sheets
 }
 
-func LoadSpriteSheet(path string) (*ebiten.Image, error) {
-	img, _, err := ebitenutil.NewImageFromFile("./assets/" + path)
-
-	return img, err
+// BlankSpriteSheet stands in for the asset manager when running headless. It
+// returns an empty sheet the size of the 4 frame character sheets.
+func BlankSpriteSheet(path string) (*ebiten.Image, error) {
+	return ebiten.NewImage(192, 68), nil
 }
 
-func (t *Talker) Execute(npc *NPC) {
+func (t *Talker) Execute(npc *NPC, in *input.Handler, dt float64, c collisions.Collisions) {
 	// Check for interaction key press to change the NPC's state
-	if ebiten.IsKeyPressed(ebiten.KeyZ) {
+	if in.Pressed(input.Interact) {
 		if npc.InteractionState == PlayerInteracted {
 			npc.InteractionState = WaitingForPlayerToResume
 		}
@@ -212,7 +319,6 @@ func (npc *NPC) ChangeDirection(playerX, playerY float64) {
 	var direction string
 	const verticalThreshold = 30
 	verticalDistance := math.Abs(playerY - npc.Y)
-	log.Println(verticalDistance)
 	// horizontalDistance := math.Abs(playerX - npc.X) unused for now
 
 	if verticalDistance >= verticalThreshold {
@@ -233,17 +339,17 @@ func (npc *NPC) ChangeDirection(playerX, playerY float64) {
 		npc.Direction = direction
 	}
 }
-func (w *Walker) Execute(npc *NPC) {
+func (w *Walker) Execute(npc *NPC, in *input.Handler, dt float64, c collisions.Collisions) {
 	// NPC movement logic
 	if npc.InteractionState == NoInteraction {
 		if w.Timer.IsStopped {
 			// w.Timer is stopped, so we might count down the stop timer
-			w.Timer.StopTimer--
+			w.Timer.StopTimer -= dt
 			if w.Timer.StopTimer <= 0 {
 				// Time to move again
 				w.Timer.IsStopped = false
 				// Reset the move timer to some value
-				w.Timer.MoveTimer = 60
+				w.Timer.MoveTimer = WalkTime
 				// Change direction
 				if w.Direction == "right" {
 					w.Direction = "left"
@@ -252,8 +358,8 @@ func (w *Walker) Execute(npc *NPC) {
 				}
 			}
 		} else {
-			w.Timer.MoveTimer--
-			w.Move(npc)
+			w.Timer.MoveTimer -= dt
+			w.Move(npc, dt, c)
 			npc.Direction = w.Direction
 			if w.Timer.MoveTimer <= 0 {
 				// Time to stop
@@ -264,24 +370,42 @@ func (w *Walker) Execute(npc *NPC) {
 			}
 		}
 	}
-	// Update the current frame every 10 ticks
-	if npc.Frame.TickCount >= 10 {
-		npc.Frame.Current = (npc.Frame.Current + 1) % npc.Frame.Count
-		npc.Frame.TickCount = 0 // Reset the tick count
-	}
 }
-func (w *Walker) Move(npc *NPC) {
+
+// Move walks for dt seconds, turning around instead if an obstacle is in the
+// way.
+func (w *Walker) Move(npc *NPC, dt float64, c collisions.Collisions) {
+	x, y := npc.X, npc.Y
+	step := w.Speed * dt
 	switch w.Direction {
 	case "left":
-		npc.X -= w.Speed
+		x -= step
 	case "right":
-		npc.X += w.Speed
+		x += step
 	case "up":
-		npc.Y -= w.Speed
+		y -= step
 	case "down":
-		npc.Y += w.Speed
+		y += step
+	}
+	if c.Blocked(npc.Rect(x, y)) {
+		w.Direction = opposite[w.Direction]
+		return
 	}
-	npc.Frame.TickCount++
+	npc.X, npc.Y = x, y
+	npc.Frame.Animate(dt)
+}
+
+var opposite = map[string]string{"left": "right", "right": "left", "up": "down", "down": "up"}
+
+// Rect returns the NPC's box if it stood at x, y. The position is the top
+// left corner of the box.
+func (npc *NPC) Rect(x, y float64) image.Rectangle {
+	return image.Rect(int(x), int(y), int(x)+npc.Frame.Width, int(y)+npc.Frame.Height)
+}
+
+// FootY returns the Y of the bottom of the NPC, where it stands.
+func (npc *NPC) FootY() float64 {
+	return npc.Y + float64(npc.Frame.Height)
 }
 
 func (npc *NPC) IsTalker() bool {
@@ -294,6 +418,19 @@ func (npc *NPC) IsTalker() bool {
 	return hasTalker
 }
 
+// Conversation returns what the NPC has to say, nil if nothing. frozen picks
+// the dialogue for when time is stopped.
+func (npc *NPC) Conversation(frozen bool) *dialogue.Tree {
+	talker, ok := npc.Behaviors["talker"].(*Talker)
+	if !ok {
+		return nil
+	}
+	if frozen {
+		return talker.Frozen
+	}
+	return talker.Tree
+}
+
 func (npc *NPC) Near(playerX, playerY float64) bool {
 	return math.Abs(playerX-npc.X) < 50 && math.Abs(playerY-npc.Y) < 50
 }
@@ -3,55 +3,62 @@ package player
 import (
 	"image"
 	"log"
+	"math"
 	"rpg_demo/ability"
 	"rpg_demo/collisions"
+	"rpg_demo/emote"
+	"rpg_demo/input"
 	"rpg_demo/shared"
 
 	"github.com/hajimehoshi/ebiten/v2"
-	"github.com/hajimehoshi/ebiten/v2/ebitenutil"
 	"golang.org/x/text/cases"
 	"golang.org/x/text/language"
 )
 
-type Frame struct {
-	Height    int
-	Width     int
-	Count     int
-	Current   int
-	TickCount int // Counter to track the number of updates
-}
+type Frame = shared.Frame
 
 type Player struct {
 	SpriteSheets map[string]*ebiten.Image // Map of sprite sheets for each direction
 	Direction    string
 	Frame        *Frame
-	Speed        float64
+	Speed        float64 // Pixels per second
 	X, Y         float64
-	Ability      *ability.Ability
+	Abilities    *ability.Loadout
 	CanMove      bool
+	Emote        *emote.Bubble // Shown over their head, nil for none
+}
+
+// Head is where an emote over the player floats from.
+func (p *Player) Head() (x, y float64) {
+	return p.X, p.Y - float64(p.Frame.Height)/2
+}
+
+// New creates the player, loading its sprite sheets with load.
+func New(load func(name string) (*ebiten.Image, error)) *Player {
+	return NewWithSpriteSheets(loadSpriteSheets(load))
 }
 
-func New() *Player {
+// NewWithSpriteSheets creates a player using already loaded sprite sheets,
+// keyed by direction.
+func NewWithSpriteSheets(sheets map[string]*ebiten.Image) *Player {
 	return &Player{
-		SpriteSheets: loadSpriteSheets(),
+		SpriteSheets: sheets,
 		Frame: &Frame{
 			Height: 68,
 			Width:  192 / 4,
 			Count:  4,
 		},
-		Speed:     5,
+		Speed:     300,
 		Direction: "down",
 		X:         1000,
 		Y:         1000,
-		Ability: &ability.Ability{
-			Type:      ability.None,
-			Activated: false,
-		},
-		CanMove: true,
+		Abilities: ability.NewLoadout(),
+		CanMove:   true,
 	}
 }
 
-func (p *Player) Draw(screen *ebiten.Image, WorldWidth, WorldHeight float64) {
+// Draw draws the player through view, the camera's world to screen transform.
+func (p *Player) Draw(screen *ebiten.Image, view ebiten.GeoM) {
 	currentSpriteSheet := p.SpriteSheets[p.Direction]
 	// Determine the x, y location of the current frame on the sprite sheet
 	sx := p.Frame.Current * p.Frame.Width
@@ -65,134 +72,147 @@ func (p *Player) Draw(screen *ebiten.Image, WorldWidth, WorldHeight float64) {
 		opts.GeoM.Scale(-1, 1)                         // Flip horizontally
 		opts.GeoM.Translate(float64(p.Frame.Width), 0) // Adjust the position after flipping
 	}
-
-	//Draw Character at the center of the screen
-	var charX, charY float64
-	ScreenWidth, ScreenHeight := float64(screen.Bounds().Dx()), float64(screen.Bounds().Dy())
-
-	// Keep player centered unless near world boundaries
-	if p.X > ScreenWidth/2 && p.X < WorldWidth-ScreenWidth/2 {
-		charX = ScreenWidth / 2
-	} else {
-		// Player is near or at the horizontal boundary
-		if p.X <= ScreenWidth/2 {
-			charX = p.X
-		} else {
-			charX = ScreenWidth - (WorldWidth - p.X)
-		}
-	}
-
-	if p.Y > ScreenHeight/2 && p.Y < WorldHeight-ScreenHeight/2 {
-		charY = ScreenHeight / 2
-	} else {
-		// Player is near or at the vertical boundary
-		if p.Y <= ScreenHeight/2 {
-			charY = p.Y
-		} else {
-			charY = ScreenHeight - (WorldHeight - p.Y)
-		}
-	}
-	if p.Ability.Type == ability.GhostMode && p.Ability.Activated {
-		var alpha float32 = 0.5
-		opts.ColorScale.Scale(1, 1, 1, alpha)
-	}
-	opts.GeoM.Translate(charX-float64(p.Frame.Width)/2, charY-float64(p.Frame.Height)/2)
+	p.Abilities.ModifyDraw(opts)
+	// The position is the middle of the sprite
+	opts.GeoM.Translate(p.X-float64(p.Frame.Width)/2, p.Y-float64(p.Frame.Height)/2)
+	opts.GeoM.Concat(view)
 	screen.DrawImage(frame, opts)
 }
 
-func (p *Player) Update(sceneCollisions collisions.Collisions, onDoorChange func(*collisions.Door), onStateChange func(newState shared.GameState)) error {
-	var newX, newY float64
-	moving := false
+// Update moves the player for dt seconds. onDoor is called when the player
+// walks into a door, it's up to the caller to decide whether the door opens.
+func (p *Player) Update(in *input.Handler, dt float64, sceneCollisions collisions.Collisions, onDoor func(*collisions.Door)) error {
+	var dx, dy float64
 	if p.CanMove {
-		if ebiten.IsKeyPressed(ebiten.KeyLeft) {
-			p.Direction = "left"
-			moving = true
+		if in.Pressed(input.MoveLeft) {
+			dx--
 		}
-		if ebiten.IsKeyPressed(ebiten.KeyRight) {
-			p.Direction = "right"
-			moving = true
+		if in.Pressed(input.MoveRight) {
+			dx++
 		}
-		if ebiten.IsKeyPressed(ebiten.KeyUp) {
-			p.Direction = "up"
-			moving = true
+		if in.Pressed(input.MoveUp) {
+			dy--
 		}
-		if ebiten.IsKeyPressed(ebiten.KeyDown) {
-			p.Direction = "down"
-			moving = true
+		if in.Pressed(input.MoveDown) {
+			dy++
 		}
 	}
+	moving := dx != 0 || dy != 0
 
-	if ebiten.IsKeyPressed(ebiten.KeyR) {
+	if in.Pressed(input.ResetPosition) {
 		p.X = 1000
 		p.Y = 1000
 	}
-	p.Ability.DeactivateAbility()
-	if ebiten.IsKeyPressed(ebiten.KeyC) {
-		p.Ability.ActivateAbility()
-	}
+	// No abilities in the middle of a conversation
+	p.Abilities.Update(dt, p.CanMove && in.Pressed(input.UseAbility), p.CanMove && in.JustPressed(input.UseAbility))
 	if moving {
-		newX, newY = p.FuturePosition(p.Direction)
-		if !p.Colliding(sceneCollisions.Obstacles, newX, newY) || p.Ability.Type == ability.GhostMode && p.Ability.Activated {
-			p.X = newX
-			p.Y = newY
+		p.face(dx, dy)
+		if dx != 0 && dy != 0 {
+			dx, dy = dx*diagonal, dy*diagonal
 		}
-		colliding, door := p.CollidingWithDoor(sceneCollisions.Doors, newX, newY)
-		if p.Colliding(sceneCollisions.Obstacles, newX, newY) && colliding {
-			onDoorChange(door)
-			onStateChange(shared.TransitionState)
-		}
-		// Increment the tick count
-		p.Frame.TickCount++
+		p.move(dx*p.Speed*dt, dy*p.Speed*dt, sceneCollisions, onDoor)
+		p.Frame.Animate(dt)
 	}
+	return nil
+}
 
-	// Update the current frame every 10 ticks
-	if p.Frame.TickCount >= 10 {
-		p.Frame.Current = (p.Frame.Current + 1) % p.Frame.Count
-		p.Frame.TickCount = 0 // Reset the tick count
+// diagonal scales each axis of a diagonal step so it's as long as a straight one
+const diagonal = 1 / math.Sqrt2
+
+// face turns the player towards a movement. There are only sprite sheets for
+// four directions, so moving diagonally keeps the current facing if it's one
+// of the two, and faces sideways otherwise.
+func (p *Player) face(dx, dy float64) {
+	horizontal, vertical := "", ""
+	switch {
+	case dx < 0:
+		horizontal = "left"
+	case dx > 0:
+		horizontal = "right"
+	}
+	switch {
+	case dy < 0:
+		vertical = "up"
+	case dy > 0:
+		vertical = "down"
+	}
+	if p.Direction == horizontal || p.Direction == vertical {
+		return
+	}
+	if horizontal != "" {
+		p.Direction = horizontal
+	} else {
+		p.Direction = vertical
 	}
-	return nil
 }
 
-func (p *Player) Colliding(obstacles []*image.Rectangle, newX, newY float64) bool {
-	playerRect := image.Rect(int(newX)-p.Frame.Width/2, int(newY)-p.Frame.Height/2, int(newX)+p.Frame.Width-p.Frame.Width/2, int(newY)+p.Frame.Height-p.Frame.Height/2)
-	for _, obstacle := range obstacles {
-		if !playerRect.Intersect(*obstacle).Empty() {
-			// Collision detected
+// move moves the player by dx, dy one axis at a time, so running into a wall
+// at an angle slides along it instead of stopping. A straight move blocked by a
+// corner, like a step of a diagonal staircase, is nudged sideways around it.
+func (p *Player) move(dx, dy float64, c collisions.Collisions, onDoor func(*collisions.Door)) {
+	try := func(x, y float64) bool {
+		blocked := p.Colliding(c, x, y)
+		// Doors sit in walls, so they are only entered by bumping into them,
+		// even by a player who could walk through the wall
+		if blocked {
+			if door := c.DoorAt(p.Rect(x, y)); door != nil {
+				onDoor(door)
+			}
+		}
+		if !p.Abilities.ModifyCollision(blocked) {
+			p.X, p.Y = x, y
 			return true
 		}
+		return false
+	}
+	movedX := dx == 0 || try(p.X+dx, p.Y)
+	movedY := dy == 0 || try(p.X, p.Y+dy)
+	if movedX && movedY || dx != 0 && dy != 0 {
+		return
 	}
-	// No collision
-	return false
-}
 
-func (p *Player) CollidingWithDoor(doors []*collisions.Door, newX, newY float64) (bool, *collisions.Door) {
-	playerRect := image.Rect(int(newX)-p.Frame.Width/2, int(newY)-p.Frame.Height/2, int(newX)+p.Frame.Width-p.Frame.Width/2, int(newY)+p.Frame.Height-p.Frame.Height/2)
-	for _, door := range doors {
-		if !playerRect.Intersect(*door.Rect).Empty() {
-			//Collision dectected
-			return true, door
+	// Blocked going straight, see if one side is free
+	step := math.Abs(dx+dy) * diagonal
+	if dx != 0 {
+		up, down := !p.Colliding(c, p.X+dx*diagonal, p.Y-step), !p.Colliding(c, p.X+dx*diagonal, p.Y+step)
+		if up != down {
+			if up {
+				step = -step
+			}
+			try(p.X+dx*diagonal, p.Y+step)
 		}
+		return
+	}
+	left, right := !p.Colliding(c, p.X-step, p.Y+dy*diagonal), !p.Colliding(c, p.X+step, p.Y+dy*diagonal)
+	if left != right {
+		if left {
+			step = -step
+		}
+		try(p.X+step, p.Y+dy*diagonal)
 	}
-	// No collision
-	var door *collisions.Door
-	return false, door
 }
 
-func (p Player) FuturePosition(dir string) (float64, float64) {
-	switch dir {
-	case "left":
-		p.X -= p.Speed // Move left
-	case "right":
-		p.X += p.Speed // Move right
-	case "up":
-		p.Y -= p.Speed // Move up
-	case "down":
-		p.Y += p.Speed // Move down
-	}
-	return p.X, p.Y
+// Rect returns the player's box if it stood at x, y. The position is the
+// middle of the box.
+func (p *Player) Rect(x, y float64) image.Rectangle {
+	return image.Rect(int(x)-p.Frame.Width/2, int(y)-p.Frame.Height/2, int(x)+p.Frame.Width-p.Frame.Width/2, int(y)+p.Frame.Height-p.Frame.Height/2)
+}
+
+// FootY returns the Y of the bottom of the player, where it stands.
+func (p *Player) FootY() float64 {
+	return p.Y + float64(p.Frame.Height)/2
+}
+
+func (p *Player) Colliding(c collisions.Collisions, newX, newY float64) bool {
+	return c.Blocked(p.Rect(newX, newY))
+}
+
+func (p *Player) CollidingWithDoor(c collisions.Collisions, newX, newY float64) (bool, *collisions.Door) {
+	door := c.DoorAt(p.Rect(newX, newY))
+	return door != nil, door
 }
 
-func loadSpriteSheets() map[string]*ebiten.Image {
+func loadSpriteSheets(load func(name string) (*ebiten.Image, error)) map[string]*ebiten.Image {
 	// Create a map to hold the sprite sheets
 	spriteSheets := make(map[string]*ebiten.Image)
 
@@ -207,13 +227,14 @@ func loadSpriteSheets() map[string]*ebiten.Image {
 			spriteSheets["left"] = spriteSheets["right"]
 			break
 		}
-		c := cases.Upper(language.English)
-		path := "assets/player" + c.String(direction) + "Black.png"
+		c := cases.Title(language.English)
+		path := "player" + c.String(direction) + "Black.png"
 
 		// Load the image
-		img, _, err := ebitenutil.NewImageFromFile(path)
+		img, err := load(path)
 		if err != nil {
-			log.Fatalf("failed to load '%s' sprite sheet: %v", direction, err)
+			log.Printf("failed to load '%s' sprite sheet: %v", direction, err)
+			img = shared.Checkerboard(192, 68, 12)
 		}
 
 		// Store the loaded image in the map
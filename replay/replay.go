@@ -0,0 +1,235 @@
+package replay
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"rpg_demo/input"
+	"rpg_demo/savegame"
+)
+
+// Version is the current recording file format.
+const Version = 2
+
+// DefaultInterval is how many ticks pass between checksums.
+const DefaultInterval = 60
+
+// Run is a stretch of identical input states, which keeps long recordings small.
+type Run struct {
+	State input.State `json:"s"`
+	Count int         `json:"n"`
+}
+
+type Checkpoint struct {
+	Tick int    `json:"t"`
+	Sum  uint64 `json:"c"`
+}
+
+// Recording is a captured play session: the state the game started in plus
+// the input for every tick after it.
+type Recording struct {
+	Version     int
+	Start       *savegame.Save
+	TPS         int // Tick rate of the game that recorded it, replays must step the same
+	Interval    int
+	Inputs      []Run
+	Checkpoints []Checkpoint
+}
+
+// Used for json marshalling. Start stays raw so it goes through the save
+// migrations when read back.
+type recordingData struct {
+	Version     int             `json:"version"`
+	Start       json.RawMessage `json:"start"`
+	TPS         int             `json:"tps"`
+	Interval    int             `json:"interval"`
+	Inputs      []Run           `json:"inputs"`
+	Checkpoints []Checkpoint    `json:"checkpoints"`
+}
+
+// Ticks returns the number of ticks of input in the recording.
+func (r *Recording) Ticks() int {
+	ticks := 0
+	for _, run := range r.Inputs {
+		ticks += run.Count
+	}
+	return ticks
+}
+
+func (r *Recording) add(state input.State) {
+	if n := len(r.Inputs); n > 0 && r.Inputs[n-1].State == state {
+		r.Inputs[n-1].Count++
+		return
+	}
+	r.Inputs = append(r.Inputs, Run{State: state, Count: 1})
+}
+
+// Write stores the recording gzipped at path.
+func Write(path string, r *Recording) error {
+	start, err := json.Marshal(r.Start)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(recordingData{
+		Version:     Version,
+		Start:       start,
+		TPS:         r.TPS,
+		Interval:    r.Interval,
+		Inputs:      r.Inputs,
+		Checkpoints: r.Checkpoints,
+	})
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(body); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf.Bytes(), 0o644)
+}
+
+func Read(path string) (*Recording, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	defer zr.Close()
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+	rd := recordingData{}
+	if err := json.Unmarshal(body, &rd); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if rd.Version != Version {
+		return nil, fmt.Errorf("%s: unsupported recording version %d", path, rd.Version)
+	}
+	start, err := savegame.Decode(bytes.NewReader(rd.Start))
+	if err != nil {
+		return nil, fmt.Errorf("%s: start state: %w", path, err)
+	}
+	return &Recording{
+		Version:     rd.Version,
+		Start:       start,
+		TPS:         rd.TPS,
+		Interval:    rd.Interval,
+		Inputs:      rd.Inputs,
+		Checkpoints: rd.Checkpoints,
+	}, nil
+}
+
+// Recorder is an input.Source that passes through another source and keeps
+// every state it returns.
+type Recorder struct {
+	Source    input.Source
+	Recording *Recording
+	ticks     int
+}
+
+func NewRecorder(source input.Source, start *savegame.Save, tps, interval int) *Recorder {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	return &Recorder{
+		Source: source,
+		Recording: &Recording{
+			Version:  Version,
+			Start:    start,
+			TPS:      tps,
+			Interval: interval,
+		},
+	}
+}
+
+func (r *Recorder) Poll() input.State {
+	state := r.Source.Poll()
+	r.Recording.add(state)
+	r.ticks++
+	return state
+}
+
+// Due reports whether the tick that just ran should be checksummed.
+func (r *Recorder) Due() bool {
+	return r.ticks > 0 && r.ticks%r.Recording.Interval == 0
+}
+
+func (r *Recorder) Checkpoint(sum uint64) {
+	r.Recording.Checkpoints = append(r.Recording.Checkpoints, Checkpoint{Tick: r.ticks, Sum: sum})
+}
+
+// Desync describes the first checkpoint where a replay stopped matching its
+// recording. The divergence happened after LastGoodTick and at or before Tick.
+type Desync struct {
+	Tick         int
+	LastGoodTick int
+	Want, Got    uint64
+}
+
+func (d *Desync) Error() string {
+	return fmt.Sprintf("replay desynced between tick %d and %d (checksum %x, want %x)", d.LastGoodTick, d.Tick, d.Got, d.Want)
+}
+
+// Player is an input.Source that feeds a Recording back one tick at a time.
+type Player struct {
+	Recording *Recording
+	Desync    *Desync // First divergence found, nil while the replay matches
+	ticks     int
+	run       int // Index into Recording.Inputs
+	used      int // Ticks consumed from the current run
+	next      int // Index of the next checkpoint to verify
+	lastGood  int
+}
+
+func NewPlayer(r *Recording) *Player {
+	return &Player{Recording: r}
+}
+
+func (p *Player) Poll() input.State {
+	p.ticks++
+	for p.run < len(p.Recording.Inputs) && p.used >= p.Recording.Inputs[p.run].Count {
+		p.run++
+		p.used = 0
+	}
+	if p.run >= len(p.Recording.Inputs) {
+		return 0
+	}
+	p.used++
+	return p.Recording.Inputs[p.run].State
+}
+
+// Done reports whether every recorded tick has been played.
+func (p *Player) Done() bool {
+	return p.ticks >= p.Recording.Ticks()
+}
+
+// Check compares sum against the recording if the tick that just ran has a
+// checkpoint. It returns the desync the first time one is found.
+func (p *Player) Check(sum uint64) *Desync {
+	if p.Desync != nil || p.next >= len(p.Recording.Checkpoints) {
+		return nil
+	}
+	cp := p.Recording.Checkpoints[p.next]
+	if cp.Tick != p.ticks {
+		return nil
+	}
+	p.next++
+	if cp.Sum != sum {
+		p.Desync = &Desync{Tick: cp.Tick, LastGoodTick: p.lastGood, Want: cp.Sum, Got: sum}
+		return p.Desync
+	}
+	p.lastGood = cp.Tick
+	return nil
+}
@@ -0,0 +1,82 @@
+package replay
+
+import (
+	"path/filepath"
+	"reflect"
+	"rpg_demo/input"
+	"rpg_demo/savegame"
+	"testing"
+)
+
+func TestRecordingRoundTrip(t *testing.T) {
+	right := input.State(0).With(input.MoveRight)
+	both := right.With(input.Interact)
+	script := input.NewScript().Idle(2).Hold(input.MoveRight, 2, 5).Press(input.Interact, 4).Idle(3)
+	want := append([]input.State(nil), script.Frames...)
+
+	rec := NewRecorder(script, &savegame.Save{Version: savegame.Version, CurrentScene: "start"}, 60, 4)
+	for range want {
+		rec.Poll()
+		if rec.Due() {
+			rec.Checkpoint(uint64(len(rec.Recording.Checkpoints) + 1))
+		}
+	}
+	runs := []Run{{0, 2}, {right, 2}, {both, 1}, {right, 2}, {0, 3}}
+	if !reflect.DeepEqual(rec.Recording.Inputs, runs) {
+		t.Fatalf("recorded runs %v, want %v", rec.Recording.Inputs, runs)
+	}
+	if ticks := rec.Recording.Ticks(); ticks != len(want) {
+		t.Errorf("recording has %d ticks, want %d", ticks, len(want))
+	}
+
+	path := filepath.Join(t.TempDir(), "test.rec")
+	if err := Write(path, rec.Recording); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Inputs, runs) || got.TPS != 60 || got.Interval != 4 || got.Start.CurrentScene != "start" {
+		t.Fatalf("read back %+v", got)
+	}
+	if cps := []Checkpoint{{4, 1}, {8, 2}}; !reflect.DeepEqual(got.Checkpoints, cps) {
+		t.Errorf("read back checkpoints %v, want %v", got.Checkpoints, cps)
+	}
+
+	// Played back it gives the same state every tick, then nothing
+	p := NewPlayer(got)
+	for tick, state := range want {
+		if s := p.Poll(); s != state {
+			t.Errorf("tick %d: played %b, recorded %b", tick+1, s, state)
+		}
+	}
+	if !p.Done() {
+		t.Errorf("player not done after every recorded tick")
+	}
+	if s := p.Poll(); s != 0 {
+		t.Errorf("past the end the player gives %b", s)
+	}
+}
+
+func TestPlayerCheck(t *testing.T) {
+	rec := &Recording{
+		Inputs:      []Run{{0, 12}},
+		Checkpoints: []Checkpoint{{4, 1}, {8, 2}, {12, 3}},
+	}
+	p := NewPlayer(rec)
+	sums := map[int]uint64{4: 1, 8: 5, 12: 6}
+	var found []*Desync
+	for tick := 1; tick <= 12; tick++ {
+		p.Poll()
+		if d := p.Check(sums[tick]); d != nil {
+			found = append(found, d)
+		}
+	}
+	if len(found) != 1 {
+		t.Fatalf("reported %d desyncs, want only the first", len(found))
+	}
+	if d := found[0]; d.Tick != 8 || d.LastGoodTick != 4 || d.Want != 2 || d.Got != 5 {
+		t.Errorf("desync %+v, want between tick 4 and 8", d)
+	}
+}
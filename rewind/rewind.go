@@ -0,0 +1,107 @@
+// Package rewind keeps the last few seconds of the world so the rewind ability
+// can play them backwards.
+package rewind
+
+// Entity is the part of a character that rewinding puts back.
+type Entity struct {
+	X, Y         float64
+	Direction    string
+	Frame        int     // Current animation frame
+	FrameElapsed float64 // Seconds the animation frame has been shown
+}
+
+type Walker struct {
+	Direction    string
+	MoveTimer    float64
+	StopTimer    float64
+	IsStopped    bool
+	StopDuration float64
+}
+
+type NPC struct {
+	Name string
+	Entity
+	Walker *Walker // nil for NPCs that don't walk
+}
+
+// Snapshot is the world at one tick.
+type Snapshot struct {
+	Scene  string
+	Player Entity
+	NPCs   []NPC
+}
+
+// Buffer is a ring buffer of snapshots. Once full, every new snapshot replaces
+// the oldest one, so memory stays the same however long the game runs.
+type Buffer struct {
+	snapshots []Snapshot
+	walkers   [][]Walker // Backing store for each slot's walker pointers
+	start     int        // Index of the oldest snapshot
+	n         int
+}
+
+// New makes a buffer for capacity snapshots, at least one.
+func New(capacity int) *Buffer {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &Buffer{
+		snapshots: make([]Snapshot, capacity),
+		walkers:   make([][]Walker, capacity),
+	}
+}
+
+// Push adds a snapshot, dropping the oldest one if the buffer is full. The
+// snapshot is copied into memory the buffer reuses, so s can be reused too.
+func (b *Buffer) Push(s Snapshot) {
+	i := (b.start + b.n) % len(b.snapshots)
+	if b.n == len(b.snapshots) {
+		b.start = (b.start + 1) % len(b.snapshots)
+	} else {
+		b.n++
+	}
+	slot := &b.snapshots[i]
+	slot.Scene = s.Scene
+	slot.Player = s.Player
+	slot.NPCs = append(slot.NPCs[:0], s.NPCs...)
+	walkers := b.walkers[i][:0]
+	for j := range slot.NPCs {
+		if w := slot.NPCs[j].Walker; w != nil {
+			walkers = append(walkers, *w)
+		}
+	}
+	// Point at the copies only once the slice is done growing
+	k := 0
+	for j := range slot.NPCs {
+		if slot.NPCs[j].Walker != nil {
+			slot.NPCs[j].Walker = &walkers[k]
+			k++
+		}
+	}
+	b.walkers[i] = walkers
+}
+
+// Pop removes and returns the newest snapshot. It stays valid until the next
+// Push.
+func (b *Buffer) Pop() (*Snapshot, bool) {
+	if b.n == 0 {
+		return nil, false
+	}
+	b.n--
+	return &b.snapshots[(b.start+b.n)%len(b.snapshots)], true
+}
+
+// Len returns the number of snapshots held.
+func (b *Buffer) Len() int {
+	return b.n
+}
+
+// Cap returns the most snapshots the buffer holds.
+func (b *Buffer) Cap() int {
+	return len(b.snapshots)
+}
+
+// Clear forgets every snapshot, keeping the memory for later.
+func (b *Buffer) Clear() {
+	b.start, b.n = 0, 0
+}
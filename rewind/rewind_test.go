@@ -0,0 +1,87 @@
+package rewind
+
+import "testing"
+
+// snap is a snapshot with the player at x and one walker and one other NPC.
+func snap(x float64) Snapshot {
+	return Snapshot{
+		Scene:  "start",
+		Player: Entity{X: x},
+		NPCs: []NPC{
+			{Name: "Walker", Entity: Entity{X: x}, Walker: &Walker{MoveTimer: x}},
+			{Name: "Still", Entity: Entity{X: -x}},
+		},
+	}
+}
+
+func TestBufferWrapsAround(t *testing.T) {
+	b := New(3)
+	for x := 1.0; x <= 5; x++ {
+		b.Push(snap(x))
+	}
+	if b.Len() != 3 || b.Cap() != 3 {
+		t.Fatalf("len %d cap %d after 5 pushes, want 3 and 3", b.Len(), b.Cap())
+	}
+	// The two oldest were dropped, the rest come back newest first
+	for _, want := range []float64{5, 4, 3} {
+		s, ok := b.Pop()
+		if !ok || s.Player.X != want {
+			t.Fatalf("popped %v, %v, want the snapshot at %v", s, ok, want)
+		}
+	}
+	if s, ok := b.Pop(); ok {
+		t.Fatalf("popped %v from an empty buffer", s)
+	}
+
+	// Pushing after popping reuses the slots in order
+	b.Push(snap(6))
+	b.Push(snap(7))
+	if s, _ := b.Pop(); s.Player.X != 7 {
+		t.Errorf("popped %v, want 7", s.Player.X)
+	}
+	b.Clear()
+	if b.Len() != 0 {
+		t.Errorf("len %d after Clear", b.Len())
+	}
+}
+
+func TestBufferCopiesWalkers(t *testing.T) {
+	b := New(4)
+	s := snap(1)
+	b.Push(s)
+	// The caller reuses its snapshot, as the game does every tick
+	s.NPCs[0].Walker.MoveTimer = 2
+	s.NPCs[0].X = 2
+	b.Push(s)
+
+	second, _ := b.Pop()
+	if second.NPCs[0].Walker == s.NPCs[0].Walker {
+		t.Fatal("the buffer keeps the caller's walker")
+	}
+	if second.NPCs[0].Walker.MoveTimer != 2 || second.NPCs[1].Walker != nil {
+		t.Errorf("second snapshot has walkers %+v and %+v", second.NPCs[0].Walker, second.NPCs[1].Walker)
+	}
+	first, _ := b.Pop()
+	if first.NPCs[0].Walker.MoveTimer != 1 || first.NPCs[0].X != 1 {
+		t.Errorf("first snapshot changed with the second, walker timer %v at %v", first.NPCs[0].Walker.MoveTimer, first.NPCs[0].X)
+	}
+
+	// Filling the slots again with more walkers than before, which grows their
+	// backing store, leaves every pointer on its own copy
+	many := snap(3)
+	for i := 0; i < 10; i++ {
+		many.NPCs = append(many.NPCs, NPC{Walker: &Walker{MoveTimer: float64(10 + i)}})
+	}
+	b.Push(many)
+	b.Push(snap(4))
+	b.Pop()
+	got, _ := b.Pop()
+	for i, n := range got.NPCs[2:] {
+		if n.Walker == many.NPCs[2+i].Walker || n.Walker.MoveTimer != float64(10+i) {
+			t.Fatalf("walker %d: %+v", i, n.Walker)
+		}
+	}
+	if got.NPCs[0].Walker.MoveTimer != 3 {
+		t.Errorf("first walker has timer %v, want 3", got.NPCs[0].Walker.MoveTimer)
+	}
+}
@@ -0,0 +1,261 @@
+package savegame
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"rpg_demo/world"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Version is the current on-disk save format. Bump it and register a
+// Migration whenever Save, or the scene data it refers to, changes shape.
+const Version = 1
+
+const extension = ".sav"
+
+var slotPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+type Save struct {
+	Version      int                    `json:"version"`
+	SavedAt      time.Time              `json:"savedAt"`
+	CurrentScene string                 `json:"currentScene"`
+	Player       PlayerState            `json:"player"`
+	Ability      AbilityState           `json:"ability"`
+	Music        MusicState             `json:"music"`
+	Scenes       map[string]SceneState  `json:"scenes"`
+	Vars         map[string]world.Value `json:"vars"`
+}
+
+type PlayerState struct {
+	X         float64 `json:"x"`
+	Y         float64 `json:"y"`
+	Direction string  `json:"direction"`
+}
+
+type AbilityState struct {
+	Selected  string             `json:"selected"`
+	Active    string             `json:"active,omitempty"`
+	Elapsed   float64            `json:"elapsed,omitempty"` // Seconds the active ability has run
+	Energy    float64            `json:"energy"`
+	Cooldowns map[string]float64 `json:"cooldowns,omitempty"`
+}
+
+type MusicState struct {
+	CurrentSong string `json:"currentSong"`
+	Paused      bool   `json:"paused"`
+}
+
+// SceneState holds everything about a scene that can change while playing,
+// keyed by NPC name so it can be applied to a freshly loaded scene.
+type SceneState struct {
+	NPCs map[string]NPCState `json:"npcs"`
+}
+
+type NPCState struct {
+	X                float64      `json:"x"`
+	Y                float64      `json:"y"`
+	Direction        string       `json:"direction"`
+	InteractionState int          `json:"interactionState"`
+	Walker           *WalkerState `json:"walker,omitempty"`
+}
+
+// WalkerState holds a walker's timers, in seconds.
+type WalkerState struct {
+	Direction    string  `json:"direction"`
+	MoveTimer    float64 `json:"moveTimer"`
+	StopTimer    float64 `json:"stopTimer"`
+	IsStopped    bool    `json:"isStopped"`
+	StopDuration float64 `json:"stopDuration"`
+}
+
+// Migration upgrades a decoded save from one version to the next. It works on
+// the raw JSON object so fields that no longer exist in Save can still be read.
+type Migration func(raw map[string]interface{}) error
+
+var migrations = map[int]Migration{}
+
+// RegisterMigration installs the migration that upgrades saves written with
+// version from to version from+1.
+func RegisterMigration(from int, m Migration) {
+	migrations[from] = m
+}
+
+// upgrade runs the migrations that take raw from the version it was saved
+// with to version to.
+func upgrade(raw map[string]interface{}, to int) error {
+	version, _ := raw["version"].(float64)
+	if int(version) > to {
+		return fmt.Errorf("save version %d is newer than supported version %d", int(version), to)
+	}
+	for v := int(version); v < to; v++ {
+		migrate, ok := migrations[v]
+		if !ok {
+			return fmt.Errorf("no migration from save version %d", v)
+		}
+		if err := migrate(raw); err != nil {
+			return fmt.Errorf("migrating save from version %d: %w", v, err)
+		}
+		raw["version"] = float64(v + 1)
+	}
+	return nil
+}
+
+// Slots stores saves as one file per named slot inside Dir.
+type Slots struct {
+	Dir      string
+	Compress bool // gzip new saves; reading detects either format
+}
+
+type SlotInfo struct {
+	Name    string
+	SavedAt time.Time
+	Scene   string
+}
+
+func NewSlots(dir string) *Slots {
+	return &Slots{
+		Dir:      dir,
+		Compress: true,
+	}
+}
+
+func (s *Slots) path(slot string) (string, error) {
+	if !slotPattern.MatchString(slot) {
+		return "", fmt.Errorf("invalid save slot name %q", slot)
+	}
+	return filepath.Join(s.Dir, slot+extension), nil
+}
+
+func (s *Slots) Write(slot string, save *Save) error {
+	path, err := s.path(slot)
+	if err != nil {
+		return err
+	}
+	save.Version = Version
+	if save.SavedAt.IsZero() {
+		save.SavedAt = time.Now()
+	}
+	body, err := json.MarshalIndent(save, "", "  ")
+	if err != nil {
+		return err
+	}
+	if s.Compress {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(body); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		body = buf.Bytes()
+	}
+	if err := os.MkdirAll(s.Dir, 0o755); err != nil {
+		return err
+	}
+	// Write to a temporary file first so a crash never leaves a half written slot
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, body, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *Slots) Read(slot string) (*Save, error) {
+	path, err := s.path(slot)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	save, err := Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("save slot %q: %w", slot, err)
+	}
+	return save, nil
+}
+
+func (s *Slots) Delete(slot string) error {
+	path, err := s.path(slot)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// List returns every readable slot in Dir, most recent first.
+func (s *Slots) List() ([]SlotInfo, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var slots []SlotInfo
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), extension)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		save, err := s.Read(name)
+		if err != nil {
+			continue
+		}
+		slots = append(slots, SlotInfo{Name: name, SavedAt: save.SavedAt, Scene: save.CurrentScene})
+	}
+	sort.Slice(slots, func(i, j int) bool {
+		return slots[i].SavedAt.After(slots[j].SavedAt)
+	})
+	return slots, nil
+}
+
+// Decode reads a plain or gzipped save and migrates it to the current Version.
+func Decode(r io.Reader) (*Save, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(2)
+	var src io.Reader = br
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		src = zr
+	}
+	body, err := io.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := map[string]interface{}{}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, err
+	}
+	if err := upgrade(raw, Version); err != nil {
+		return nil, err
+	}
+
+	body, err = json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	save := &Save{}
+	if err := json.Unmarshal(body, save); err != nil {
+		return nil, err
+	}
+	return save, nil
+}
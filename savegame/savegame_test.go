@@ -0,0 +1,82 @@
+package savegame
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestUpgradeRunsMigrationsInOrder(t *testing.T) {
+	defer func() {
+		delete(migrations, 1)
+		delete(migrations, 2)
+	}()
+	var ran []int
+	RegisterMigration(1, func(raw map[string]interface{}) error {
+		ran = append(ran, 1)
+		raw["currentScene"] = "renamed"
+		return nil
+	})
+	RegisterMigration(2, func(raw map[string]interface{}) error {
+		ran = append(ran, 2)
+		if raw["version"] != 2.0 {
+			return fmt.Errorf("second migration saw version %v", raw["version"])
+		}
+		raw["currentScene"] = raw["currentScene"].(string) + " twice"
+		return nil
+	})
+
+	raw := map[string]interface{}{"version": 1.0, "currentScene": "start"}
+	if err := upgrade(raw, 3); err != nil {
+		t.Fatal(err)
+	}
+	if len(ran) != 2 || ran[0] != 1 || ran[1] != 2 {
+		t.Errorf("ran migrations %v, want [1 2]", ran)
+	}
+	if raw["version"] != 3.0 || raw["currentScene"] != "renamed twice" {
+		t.Errorf("upgraded to %v", raw)
+	}
+
+	// Already current, nothing runs
+	ran = nil
+	if err := upgrade(raw, 3); err != nil || len(ran) != 0 {
+		t.Errorf("upgrading a current save ran %v, err %v", ran, err)
+	}
+}
+
+func TestUpgradeErrors(t *testing.T) {
+	defer delete(migrations, 1)
+	RegisterMigration(1, func(raw map[string]interface{}) error {
+		return fmt.Errorf("broken")
+	})
+	for _, c := range []struct {
+		version float64
+		to      int
+		want    string
+	}{
+		{1, 2, "migrating save from version 1: broken"},
+		{2, 3, "no migration from save version 2"},
+		{4, 3, "newer than supported"},
+	} {
+		err := upgrade(map[string]interface{}{"version": c.version}, c.to)
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("upgrading version %v to %d: got %v, want %q", c.version, c.to, err, c.want)
+		}
+	}
+}
+
+func TestDecodeCurrentVersion(t *testing.T) {
+	body, err := json.Marshal(&Save{Version: Version, CurrentScene: "start"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	save, err := Decode(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if save.Version != Version || save.CurrentScene != "start" {
+		t.Errorf("decoded %+v", save)
+	}
+}
@@ -1,18 +1,24 @@
 package scene
 
 import (
+	"fmt"
+	"image"
+	"io/fs"
 	"log"
-	"math"
-	"rpg_demo/ability"
+	"rpg_demo/assets"
 	"rpg_demo/collisions"
 	"rpg_demo/cutscene"
 	"rpg_demo/data"
 	"rpg_demo/dialogue"
+	"rpg_demo/input"
 	"rpg_demo/npc"
 	"rpg_demo/player"
+	"rpg_demo/shared"
+	"rpg_demo/tiled"
+	"rpg_demo/trigger"
+	"sort"
 
 	"github.com/hajimehoshi/ebiten/v2"
-	"github.com/hajimehoshi/ebiten/v2/ebitenutil"
 )
 
 type Scene struct {
@@ -24,74 +30,308 @@ type Scene struct {
 	Music      string
 	NPCs       map[string]*npc.NPC
 	Cutscenes  map[string]*cutscene.Cutscene
-	X, Y       float64
+	Triggers   *trigger.Set  // Start cutscenes without the player asking
+	Frozen     bool          // Time is stopped, NPCs keep still and everything is drawn gray
+	assets     *assets.Group // Everything the scene loaded, released by Unload
+	renderList []renderItem  // Reused by DrawEntities
 }
 
-func New(name string) *Scene {
-	prefix := "assets/"
-	JsonPath := prefix + name + ".json"
-	data := data.LoadJsonFile(JsonPath)
+// New loads the named scene through the asset manager. The scene is either a
+// Tiled map, <name>.tmj or <name>.tmx, or our own <name>.json with a
+// pre-rendered <name>.png and <name>Fore.png. A Tiled map can have a
+// <name>.json next to it for what Tiled doesn't cover, like NPCs and cutscenes.
+//
+// A missing background is replaced by a checkerboard and a missing foreground
+// is left out, anything else that fails to load is an error.
+func New(name string, a *assets.Manager) (*Scene, error) {
+	mapName := ""
+	for _, ext := range []string{".tmj", ".tmx"} {
+		if _, err := fs.Stat(a, name+ext); err == nil {
+			mapName = name + ext
+			break
+		}
+	}
+
+	var m *tiled.Map
+	d := &data.Data{}
+	if mapName != "" {
+		var err error
+		if m, err = tiled.Load(a, mapName); err != nil {
+			return nil, fmt.Errorf("scene %s: %w", name, err)
+		}
+	}
+	// Only Tiled maps can do without the scene data
+	if _, err := fs.Stat(a, name+".json"); err == nil || m == nil {
+		var err error
+		if d, err = loadData(a, name+".json"); err != nil {
+			return nil, fmt.Errorf("scene %s: %w", name, err)
+		}
+	}
+	if m != nil {
+		if err := m.Apply(d); err != nil {
+			return nil, fmt.Errorf("scene %s: %s: %w", name, mapName, err)
+		}
+	}
+	if err := cutscene.LoadScripts(a, d.Cutscenes); err != nil {
+		return nil, fmt.Errorf("scene %s: %w", name, err)
+	}
+
+	group := a.Group()
+	s, err := newScene(name, d, group.Image)
+	if err != nil {
+		group.Release()
+		return nil, err
+	}
+	s.assets = group
+
+	var Bg, Fg *ebiten.Image
+	if m != nil {
+		Bg, Fg, err = m.Render(group.Image)
+		if err != nil {
+			log.Printf("Scene %s: error rendering %s: %s", name, mapName, err)
+		}
+	} else {
+		// Load the background
+		Bg, err = group.Image(name + ".png")
+		if err != nil {
+			log.Printf("Scene %s: error loading background: %s", name, err)
+		}
+		// Load the foreground
+		Fg, err = group.Image(name + "Fore.png")
+		if err != nil {
+			log.Printf("Scene %s: error loading foreground: %s", name, err)
+			Fg = nil
+		}
+	}
+	if Bg == nil {
+		w, h := placeholderSize(s.Collisions)
+		Bg = shared.Checkerboard(w, h, 64)
+	}
+	s.Background = Bg
+	s.Foreground = Fg
+	s.Width = float64(Bg.Bounds().Dx())
+	s.Height = float64(Bg.Bounds().Dy())
+	return s, nil
+}
 
-	BgPath := prefix + name + ".png"
-	FgPath := prefix + name + "Fore.png"
+// SharedCutscenes loads the cutscenes any scene can Call from
+// cutscene.LibraryFile. Having no such file is fine.
+func SharedCutscenes(a *assets.Manager) (map[string]*cutscene.Cutscene, error) {
+	if _, err := fs.Stat(a, cutscene.LibraryFile); err != nil {
+		return map[string]*cutscene.Cutscene{}, nil
+	}
+	d, err := loadData(a, cutscene.LibraryFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := cutscene.LoadScripts(a, d.Cutscenes); err != nil {
+		return nil, fmt.Errorf("%s: %w", cutscene.LibraryFile, err)
+	}
+	return cutscene.LoadCutscenes("shared", d.Cutscenes)
+}
+
+func loadData(a *assets.Manager, name string) (*data.Data, error) {
+	f, err := a.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	d, err := data.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return d, nil
+}
+
+// Unload gives the scene's images back to the asset manager. The scene
+// shouldn't be drawn afterwards.
+func (s *Scene) Unload() {
+	if s.assets != nil {
+		s.assets.Release()
+	}
+}
+
+// NewHeadless builds a scene straight from in-memory data without touching the
+// disk. It has no background or foreground and its NPCs use blank sprite
+// sheets, which is enough to simulate the scene but not to draw it.
+func NewHeadless(name string, data *data.Data) (*Scene, error) {
+	return newScene(name, data, npc.BlankSpriteSheet)
+}
 
-	// Load the background
-	Bg, _, err := ebitenutil.NewImageFromFile(BgPath)
+func newScene(name string, data *data.Data, load npc.ImageLoader) (*Scene, error) {
+	c, err := collisions.New(data)
+	if err != nil {
+		return nil, fmt.Errorf("scene %s: %w", name, err)
+	}
+	npcs, err := npc.LoadNPCs(data.NPCs, load)
+	if err != nil {
+		return nil, fmt.Errorf("scene %s: %w", name, err)
+	}
+	cutscenes, err := cutscene.LoadCutscenes(name, data.Cutscenes)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	// Load the foreground
-	Fg, _, err := ebitenutil.NewImageFromFile(FgPath)
+	triggers, err := trigger.New(name, data.Triggers)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("scene %s: %w", name, err)
+	}
+	for _, t := range triggers.Triggers {
+		if _, ok := cutscenes[t.Cutscene]; !ok {
+			return nil, fmt.Errorf("scene %s: trigger %s: no cutscene %q", name, t.ID, t.Cutscene)
+		}
 	}
 	return &Scene{
-		Background: Bg,
-		Foreground: Fg,
-		Width:      float64(Bg.Bounds().Dx()),
-		Height:     float64(Bg.Bounds().Dy()),
-		Collisions: collisions.New(data),
+		Collisions: c,
 		Music:      data.Music,
-		NPCs:       npc.LoadNPCs(data.NPCs),
-		Cutscenes:  cutscene.LoadCutscenes(data.Cutscenes),
+		NPCs:       npcs,
+		Cutscenes:  cutscenes,
+		Triggers:   triggers,
+	}, nil
+}
+
+// placeholderSize returns a background size that covers everything the
+// player can bump into, and at least the screen.
+func placeholderSize(c collisions.Collisions) (int, int) {
+	w, h := 800, 600
+	grow := func(r image.Rectangle) {
+		if r.Max.X > w {
+			w = r.Max.X
+		}
+		if r.Max.Y > h {
+			h = r.Max.Y
+		}
+	}
+	for _, o := range c.Obstacles {
+		grow(*o)
+	}
+	for _, d := range c.Doors {
+		grow(*d.Rect)
 	}
+	return w, h
 }
 
-func (s *Scene) Draw(screen, img *ebiten.Image, p *player.Player) {
-	ScreenWidth := float64(screen.Bounds().Dx())
-	ScreenHeight := float64(screen.Bounds().Dy())
+// Draw draws one of the scene's layers, the background or the foreground,
+// through view, the camera's world to screen transform.
+func (s *Scene) Draw(screen, img *ebiten.Image, view ebiten.GeoM) {
+	opts := &ebiten.DrawImageOptions{}
+	opts.GeoM = view
+	if img != nil && s.Frozen {
+		shared.DrawFrozen(screen, img, opts)
+	} else if img != nil {
+		screen.DrawImage(img, opts)
+	}
+}
+func (s *Scene) Update(in *input.Handler, dt float64) {
+	for _, name := range s.NPCNames() {
+		s.NPCs[name].Update(in, dt, s.Collisions)
+	}
+}
 
-	bgX, bgY := -p.X+ScreenWidth/2, -p.Y+ScreenHeight/2
+// renderItem is something standing in the scene, drawn in order of where its
+// feet are.
+type renderItem struct {
+	footY float64
+	draw  func(screen *ebiten.Image)
+}
 
-	// Constrain background position to world boundaries
-	bgX = math.Min(math.Max(bgX, -s.Width+ScreenWidth), 0)
-	bgY = math.Min(math.Max(bgY, -s.Height+ScreenHeight), 0)
+// DrawEntities draws the NPCs and the player between the background and the
+// foreground, back to front by the Y of their feet, so whoever stands lower is
+// drawn in front. Ties keep a fixed order, NPCs by name and then the player.
+func (s *Scene) DrawEntities(screen *ebiten.Image, p *player.Player, view ebiten.GeoM) {
+	s.renderList = s.renderList[:0]
+	for _, name := range s.NPCNames() {
+		n := s.NPCs[name]
+		s.renderList = append(s.renderList, renderItem{n.FootY(), func(screen *ebiten.Image) {
+			n.Draw(screen, view, s.Frozen)
+		}})
+	}
+	s.renderList = append(s.renderList, renderItem{p.FootY(), func(screen *ebiten.Image) {
+		p.Draw(screen, view)
+	}})
+	sort.SliceStable(s.renderList, func(i, j int) bool {
+		return s.renderList[i].footY < s.renderList[j].footY
+	})
+	for _, item := range s.renderList {
+		item.draw(screen)
+	}
+}
 
-	opts := &ebiten.DrawImageOptions{}
-	opts.GeoM.Translate(bgX, bgY)
-	if p.Ability.Type == ability.StopTime && p.Ability.Activated {
-		opts.ColorScale.Scale(.5, .5, .5, 1)
+// UpdateEmotes ages the bubbles over everyone's heads by dt seconds and takes
+// down the ones that are over.
+func (s *Scene) UpdateEmotes(p *player.Player, dt float64) {
+	for _, n := range s.NPCs {
+		if n.Emote != nil && !n.Emote.Update(dt) {
+			n.Emote = nil
+		}
+	}
+	if p.Emote != nil && !p.Emote.Update(dt) {
+		p.Emote = nil
 	}
-	screen.DrawImage(img, opts)
-	s.X, s.Y = bgX, bgY
 }
-func (s *Scene) Update() {
-	for _, npc := range s.NPCs {
-		npc.Update()
+
+// DrawEmotes draws the bubbles over everyone's heads. They go on top of the
+// foreground so nothing hides them.
+func (s *Scene) DrawEmotes(screen *ebiten.Image, p *player.Player, view ebiten.GeoM) {
+	for _, name := range s.NPCNames() {
+		if n := s.NPCs[name]; n.Emote != nil {
+			x, y := n.Head()
+			n.Emote.Draw(screen, x, y, view)
+		}
+	}
+	if p.Emote != nil {
+		x, y := p.Head()
+		p.Emote.Draw(screen, x, y, view)
+	}
+}
+
+// NPCNames returns the scene's NPC names in a fixed order so updates don't
+// depend on map iteration.
+func (s *Scene) NPCNames() []string {
+	names := make([]string, 0, len(s.NPCs))
+	for name := range s.NPCs {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	return names
 }
-func (s *Scene) DrawNPCs(screen *ebiten.Image) {
-	for _, npc := range s.NPCs {
-		npc.Draw(screen, s.X, s.Y)
+
+// inSight reports whether no obstacle stands between the player and n, so
+// nobody talks through walls.
+func (s *Scene) inSight(p *player.Player, n *npc.NPC) bool {
+	from := p.Rect(p.X, p.Y)
+	to := n.Rect(n.X, n.Y)
+	center := func(r image.Rectangle) image.Point {
+		return r.Min.Add(r.Max).Div(2)
 	}
+	return s.Collisions.FirstObstacle(center(from), center(to)) == nil
 }
-func (s *Scene) HandleNPCInteractions(player *player.Player, PressedLastFrame bool, dial *dialogue.Dialogue) {
+
+// NPCInReach returns the NPC the player would talk to by pressing interact, or
+// nil if there is nobody.
+func (s *Scene) NPCInReach(p *player.Player) *npc.NPC {
+	playerX, playerY := p.X-float64(p.Frame.Width)/2, p.Y-float64(p.Frame.Height)/2
+	for _, name := range s.NPCNames() {
+		if n := s.NPCs[name]; n.Near(playerX, playerY) && s.inSight(p, n) {
+			return n
+		}
+	}
+	return nil
+}
+
+func (s *Scene) HandleNPCInteractions(player *player.Player, in *input.Handler, dial *dialogue.Dialogue) {
 	playerX, playerY := player.X-float64(player.Frame.Width)/2, player.Y-float64(player.Frame.Height)/2
-	for _, npc1 := range s.NPCs {
-		if npc1.Near(playerX, playerY) {
-			if ebiten.IsKeyPressed(ebiten.KeyZ) && !PressedLastFrame && npc1.IsTalker() {
+	for _, name := range s.NPCNames() {
+		npc1 := s.NPCs[name]
+		// Frozen NPCs only talk if they have something to say frozen, but a
+		// conversation that has started can always be finished
+		tree := npc1.Conversation(s.Frozen)
+		talking := npc1.InteractionState != npc.NoInteraction
+		if npc1.Near(playerX, playerY) && s.inSight(player, npc1) {
+			if in.JustPressed(input.Interact) && (tree != nil || talking) {
 				if npc1.InteractionState == npc.NoInteraction {
-					npc1.ChangeDirection(playerX, playerY)
+					if !s.Frozen {
+						npc1.ChangeDirection(playerX, playerY)
+					}
 					npc1.InteractionState = npc.PlayerInteracted
 					player.CanMove = false // Disallow player movement
 				} else if npc1.InteractionState == npc.WaitingForPlayerToResume && dial.Finished && dial.IsLastLine() {
@@ -100,19 +340,18 @@ func (s *Scene) HandleNPCInteractions(player *player.Player, PressedLastFrame bo
 					player.CanMove = true // Allow player movement
 				}
 
-				if !dial.IsOpen {
+				if !dial.IsOpen && tree != nil {
 					dial.Image = npc1.Image
 					dial.Speaker = npc1.Name
-					dial.OpenAndReset()
-					dial.TextLines = npc1.Behaviors["talker"].Value()
-				} else {
-					if dial.Finished {
-						dial.NextLine()
-					} else {
-						// Instantly display all characters in the current line
-						dial.CharIndex = len(dial.TextLines[dial.CurrentLine])
-						dial.Finished = true
-					}
+					dial.Open(tree)
+				} else if dial.IsOpen {
+					dial.Advance()
+				}
+				if !dial.IsOpen {
+					// The conversation is over, or conditions ruled out every line
+					npc1.InteractionState = npc.NoInteraction
+					dial.Image = nil
+					player.CanMove = true
 				}
 			}
 		}
@@ -0,0 +1,23 @@
+package shared
+
+// Frame is where a character's walk animation is, on a sprite sheet of Count
+// frames side by side.
+type Frame struct {
+	Height  int
+	Width   int
+	Count   int
+	Current int
+	Elapsed float64 // Seconds the current frame has been shown
+}
+
+// FrameTime is how many seconds each frame of the walk animation is shown.
+const FrameTime = 1.0 / 6
+
+// Animate moves the animation along by dt seconds.
+func (f *Frame) Animate(dt float64) {
+	f.Elapsed += dt
+	for f.Elapsed >= FrameTime {
+		f.Current = (f.Current + 1) % f.Count
+		f.Elapsed -= FrameTime
+	}
+}
@@ -0,0 +1,22 @@
+package shared
+
+import (
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/colorm"
+)
+
+// frozenColorM turns images gray and a bit darker, the look of a world with
+// time stopped.
+var frozenColorM = func() colorm.ColorM {
+	var c colorm.ColorM
+	c.ChangeHSV(0, 0, 0.7)
+	return c
+}()
+
+// DrawFrozen draws src onto dst like DrawImage, but in frozen gray. Only the
+// geometry of opts is used.
+func DrawFrozen(dst, src *ebiten.Image, opts *ebiten.DrawImageOptions) {
+	op := &colorm.DrawImageOptions{}
+	op.GeoM = opts.GeoM
+	colorm.DrawImage(dst, src, frozenColorM, op)
+}
@@ -0,0 +1,24 @@
+package shared
+
+import (
+	"github.com/hajimehoshi/ebiten/v2"
+)
+
+// Checkerboard returns a magenta and black checkerboard with squares of the
+// given size. It's drawn in place of art that failed to load so the game keeps
+// running and the gap is hard to miss.
+func Checkerboard(width, height, square int) *ebiten.Image {
+	pixels := make([]byte, 4*width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := 4 * (y*width + x)
+			if (x/square+y/square)%2 == 0 {
+				pixels[i], pixels[i+2] = 0xff, 0xff
+			}
+			pixels[i+3] = 0xff
+		}
+	}
+	img := ebiten.NewImage(width, height)
+	img.WritePixels(pixels)
+	return img
+}
@@ -8,18 +8,12 @@ const (
 	NewSceneState
 	CutSceneState
 	TimeStopped
+	ErrorState // Something failed to load, see Game.Error
+	Rewinding  // The rewind ability is playing the world backwards
 )
 
 type Transition struct {
 	Alpha     float64
-	FadeSpeed float64
-	Timer     int
+	FadeSpeed float64 // Alpha change per second
 	Music     bool
 }
-
-type KeyPressed struct {
-	KeyP bool
-	KeyZ bool
-	KeyD bool
-	KeyV bool
-}
@@ -0,0 +1,135 @@
+package tiled
+
+import (
+	"fmt"
+	"math"
+	"rpg_demo/data"
+	"strings"
+)
+
+// Object types the importer understands. Objects without a type take the
+// type of their layer's name, so a layer called "obstacles" can hold plain
+// rectangles.
+const (
+	ObstacleObject = "obstacle"
+	DoorObject     = "door"
+	NPCObject      = "npc"
+	TriggerObject  = "trigger"
+)
+
+// Apply adds the map's objects to a scene:
+//
+//   - obstacle: a rectangle the player can't walk through
+//   - door: a rectangle with the custom properties destination, newx, newy
+//     and optionally condition; the object's name is the door id
+//   - npc: a point that moves the NPC of the same name, defined by the scene
+//     data, to where it is
+//   - trigger: a rectangle, or a point covering one tile, with a cutscene
+//     property naming the cutscene to play when the player walks in, or out
+//     with the property on set to exit; condition and once work like in the
+//     scene data and the object's name is the trigger id
+//
+// The map's music property sets the scene's music unless the data already has some.
+func (m *Map) Apply(d *data.Data) error {
+	if music, ok := m.Properties["music"]; ok && d.Music == "" {
+		d.Music = music
+	}
+	for _, l := range m.Layers {
+		for _, o := range l.Objects {
+			if err := m.applyObject(d, l, o); err != nil {
+				return fmt.Errorf("layer %s: object %d (%s): %w", l.Name, o.ID, o.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (m *Map) applyObject(d *data.Data, l *Layer, o *Object) error {
+	typ := strings.ToLower(o.Type)
+	if typ == "" {
+		typ = strings.TrimSuffix(strings.ToLower(l.Name), "s")
+	}
+	x, y := o.X+l.OffsetX, o.Y+l.OffsetY
+	if o.GID != 0 {
+		// Tile objects hang up from their position
+		y -= o.Height
+	}
+	x1, y1 := int(math.Round(x)), int(math.Round(y))
+	x2, y2 := int(math.Round(x+o.Width)), int(math.Round(y+o.Height))
+	area := func() error {
+		if o.Point || x2 <= x1 || y2 <= y1 {
+			return fmt.Errorf("%s must be a rectangle", typ)
+		}
+		return nil
+	}
+
+	switch typ {
+	case ObstacleObject, "collision":
+		if err := area(); err != nil {
+			return err
+		}
+		d.Obstacles = append(d.Obstacles, data.ObstacleData{X1: x1, Y1: y1, X2: x2, Y2: y2})
+	case DoorObject:
+		if err := area(); err != nil {
+			return err
+		}
+		door := data.DoorData{
+			X1: x1, Y1: y1, X2: x2, Y2: y2,
+			Id:          o.Name,
+			Destination: o.Properties["destination"],
+			Condition:   o.Properties["condition"],
+		}
+		if door.Destination == "" {
+			return fmt.Errorf("door has no destination property")
+		}
+		var err error
+		var ok bool
+		if door.NewX, ok, err = o.Properties.Float("newx"); err != nil || !ok {
+			return propertyError("newx", err)
+		}
+		if door.NewY, ok, err = o.Properties.Float("newy"); err != nil || !ok {
+			return propertyError("newy", err)
+		}
+		d.Doors = append(d.Doors, door)
+	case NPCObject:
+		for i := range d.NPCs {
+			if d.NPCs[i].Name == o.Name {
+				d.NPCs[i].X, d.NPCs[i].Y = x, y
+				return nil
+			}
+		}
+		return fmt.Errorf("no NPC named %q in the scene data", o.Name)
+	case TriggerObject:
+		if o.Point {
+			x1, y1 = x1-m.TileWidth/2, y1-m.TileHeight/2
+			x2, y2 = x1+m.TileWidth, y1+m.TileHeight
+		} else if err := area(); err != nil {
+			return err
+		}
+		trigger := data.TriggerData{
+			X1: x1, Y1: y1, X2: x2, Y2: y2,
+			ID:        o.Name,
+			On:        o.Properties["on"],
+			Condition: o.Properties["condition"],
+			Cutscene:  o.Properties["cutscene"],
+			Once:      o.Properties.Bool("once"),
+		}
+		if trigger.Cutscene == "" {
+			return fmt.Errorf("trigger has no cutscene property")
+		}
+		if trigger.On != "" && trigger.On != "enter" && trigger.On != "exit" {
+			return fmt.Errorf("trigger objects fire on enter or exit, not %q", trigger.On)
+		}
+		d.Triggers = append(d.Triggers, trigger)
+	default:
+		// Anything else is the designer's notes
+	}
+	return nil
+}
+
+func propertyError(name string, err error) error {
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("missing %s property", name)
+}
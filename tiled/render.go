@@ -0,0 +1,75 @@
+package tiled
+
+import (
+	"fmt"
+	"image"
+	"strings"
+
+	"github.com/hajimehoshi/ebiten/v2"
+)
+
+// IsForeground reports whether a tile layer is drawn over the player: layers
+// with a true foreground property, or whose name starts with "fore".
+func (l *Layer) IsForeground() bool {
+	return l.Properties.Bool("foreground") || strings.HasPrefix(strings.ToLower(l.Name), "fore")
+}
+
+// Render draws the tile layers into a background and a foreground image the
+// size of the map. load is given the tileset image paths. The foreground is
+// nil if the map has no foreground layers.
+func (m *Map) Render(load func(name string) (*ebiten.Image, error)) (bg, fg *ebiten.Image, err error) {
+	images := make(map[*Tileset]*ebiten.Image)
+	for _, ts := range m.Tilesets {
+		img, err := load(ts.Image)
+		if err != nil {
+			return nil, nil, fmt.Errorf("tileset %s: %w", ts.Name, err)
+		}
+		images[ts] = img
+	}
+
+	w, h := m.Width*m.TileWidth, m.Height*m.TileHeight
+	bg = ebiten.NewImage(w, h)
+	for _, l := range m.Layers {
+		if l.Type != TileLayer {
+			continue
+		}
+		target := bg
+		if l.IsForeground() {
+			if fg == nil {
+				fg = ebiten.NewImage(w, h)
+			}
+			target = fg
+		}
+		m.drawLayer(target, l, images)
+	}
+	return bg, fg, nil
+}
+
+func (m *Map) drawLayer(target *ebiten.Image, l *Layer, images map[*Tileset]*ebiten.Image) {
+	for i, gid := range l.Tiles {
+		ts := m.Tileset(gid)
+		if ts == nil {
+			continue
+		}
+		id := int(gid&gidMask) - ts.FirstGID
+		sx := ts.Margin + (id%ts.Columns)*(ts.TileWidth+ts.Spacing)
+		sy := ts.Margin + (id/ts.Columns)*(ts.TileHeight+ts.Spacing)
+		tile := images[ts].SubImage(image.Rect(sx, sy, sx+ts.TileWidth, sy+ts.TileHeight)).(*ebiten.Image)
+
+		opts := &ebiten.DrawImageOptions{}
+		if gid&FlipHorizontal != 0 {
+			opts.GeoM.Scale(-1, 1)
+			opts.GeoM.Translate(float64(ts.TileWidth), 0)
+		}
+		if gid&FlipVertical != 0 {
+			opts.GeoM.Scale(1, -1)
+			opts.GeoM.Translate(0, float64(ts.TileHeight))
+		}
+		// Tiles bigger than the grid stick out upwards, like in Tiled
+		x := (i % m.Width) * m.TileWidth
+		y := (i/m.Width)*m.TileHeight + m.TileHeight - ts.TileHeight
+		opts.GeoM.Translate(float64(x)+l.OffsetX, float64(y)+l.OffsetY)
+		opts.ColorScale.ScaleAlpha(float32(l.Opacity))
+		target.DrawImage(tile, opts)
+	}
+}
@@ -0,0 +1,233 @@
+// Package tiled reads maps made with the Tiled editor (https://www.mapeditor.org),
+// both the JSON (.tmj) and the XML (.tmx) format, and turns them into scene data.
+//
+// Only orthogonal, finite maps are supported. Tilesets can be embedded or
+// external (.tsx, .tsj) but must use a single image. Tiles flipped diagonally,
+// which is how Tiled rotates them, are drawn without the rotation.
+package tiled
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Flags Tiled stores in the top bits of a tile's global ID
+const (
+	FlipHorizontal = 0x80000000
+	FlipVertical   = 0x40000000
+	FlipDiagonal   = 0x20000000
+	gidMask        = 0x0fffffff
+)
+
+type Map struct {
+	Width, Height         int // In tiles
+	TileWidth, TileHeight int
+	Tilesets              []*Tileset
+	Layers                []*Layer // Group layers are flattened, in drawing order
+	Properties            Properties
+}
+
+type Tileset struct {
+	FirstGID                int
+	Name                    string
+	Image                   string // Path in the file system the map came from
+	ImageWidth, ImageHeight int
+	TileWidth, TileHeight   int
+	Columns                 int
+	TileCount               int
+	Margin, Spacing         int
+}
+
+const (
+	TileLayer   = "tilelayer"
+	ObjectLayer = "objectgroup"
+)
+
+type Layer struct {
+	Name             string
+	Type             string // TileLayer or ObjectLayer
+	Visible          bool
+	Opacity          float64
+	OffsetX, OffsetY float64
+	Tiles            []uint32 // Global tile IDs row by row, 0 is empty
+	Objects          []*Object
+	Properties       Properties
+}
+
+type Object struct {
+	ID            int
+	Name          string
+	Type          string // Called class since Tiled 1.9
+	X, Y          float64
+	Width, Height float64
+	Point         bool
+	GID           uint32 // Set for tile objects, whose Y is their bottom edge
+	Properties    Properties
+}
+
+// Properties are the custom properties of a map, layer or object. Values are
+// kept as text whatever their type in Tiled.
+type Properties map[string]string
+
+// Float returns a number property. A missing property is not an error, ok
+// tells the two apart.
+func (p Properties) Float(name string) (f float64, ok bool, err error) {
+	s, ok := p[name]
+	if !ok {
+		return 0, false, nil
+	}
+	f, err = strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, true, fmt.Errorf("property %s: %q is not a number", name, s)
+	}
+	return f, true, nil
+}
+
+// Bool returns a boolean property, false if it's missing.
+func (p Properties) Bool(name string) bool {
+	b, _ := strconv.ParseBool(p[name])
+	return b
+}
+
+// IsMap reports whether name looks like a Tiled map file.
+func IsMap(name string) bool {
+	ext := path.Ext(name)
+	return ext == ".tmj" || ext == ".tmx"
+}
+
+// Load reads a map, and the external tilesets it refers to, from fsys. The
+// format is picked by the file extension.
+func Load(fsys fs.FS, name string) (*Map, error) {
+	b, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	var m *Map
+	switch path.Ext(name) {
+	case ".tmj", ".json":
+		m, err = decodeJSON(fsys, name, b)
+	case ".tmx":
+		m, err = decodeXML(fsys, name, b)
+	default:
+		return nil, fmt.Errorf("%s: not a Tiled map", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return m, nil
+}
+
+// loadTileset reads an external tileset, source is relative to the map.
+func loadTileset(fsys fs.FS, mapName, source string, firstGID int) (*Tileset, error) {
+	name := path.Join(path.Dir(mapName), source)
+	b, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	var ts *Tileset
+	switch path.Ext(name) {
+	case ".tsj", ".json":
+		ts, err = decodeTilesetJSON(name, b)
+	case ".tsx":
+		ts, err = decodeTilesetXML(name, b)
+	default:
+		return nil, fmt.Errorf("tileset %s: unknown format", source)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("tileset %s: %w", source, err)
+	}
+	ts.FirstGID = firstGID
+	return ts, nil
+}
+
+// check fills in what Tiled leaves out and rejects tilesets we can't draw.
+func (ts *Tileset) check() error {
+	if ts.Image == "" {
+		return fmt.Errorf("tileset %s: only tilesets with a single image are supported", ts.Name)
+	}
+	if ts.TileWidth <= 0 || ts.TileHeight <= 0 {
+		return fmt.Errorf("tileset %s: tile size must be positive", ts.Name)
+	}
+	if ts.Columns <= 0 {
+		ts.Columns = (ts.ImageWidth - 2*ts.Margin + ts.Spacing) / (ts.TileWidth + ts.Spacing)
+	}
+	if ts.Columns <= 0 {
+		return fmt.Errorf("tileset %s: no columns", ts.Name)
+	}
+	return nil
+}
+
+// Tileset returns the tileset a global tile ID belongs to, nil for empty tiles.
+func (m *Map) Tileset(gid uint32) *Tileset {
+	gid &= gidMask
+	if gid == 0 {
+		return nil
+	}
+	var found *Tileset
+	for _, ts := range m.Tilesets {
+		if ts.FirstGID <= int(gid) && (found == nil || ts.FirstGID > found.FirstGID) {
+			found = ts
+		}
+	}
+	return found
+}
+
+// decodeTiles reads the tile data of a layer, stored as CSV or as base64 of
+// little endian uint32s, maybe compressed.
+func decodeTiles(encoding, compression, text string, want int) ([]uint32, error) {
+	var tiles []uint32
+	switch encoding {
+	case "csv":
+		for _, field := range strings.Split(text, ",") {
+			field = strings.TrimSpace(field)
+			if field == "" {
+				continue
+			}
+			gid, err := strconv.ParseUint(field, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("bad tile %q", field)
+			}
+			tiles = append(tiles, uint32(gid))
+		}
+	case "base64":
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(text))
+		if err != nil {
+			return nil, err
+		}
+		var r io.Reader = bytes.NewReader(raw)
+		switch compression {
+		case "":
+		case "zlib":
+			if r, err = zlib.NewReader(r); err != nil {
+				return nil, err
+			}
+		case "gzip":
+			if r, err = gzip.NewReader(r); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unsupported compression %q", compression)
+		}
+		raw, err = io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i+4 <= len(raw); i += 4 {
+			tiles = append(tiles, uint32(raw[i])|uint32(raw[i+1])<<8|uint32(raw[i+2])<<16|uint32(raw[i+3])<<24)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q", encoding)
+	}
+	if len(tiles) != want {
+		return nil, fmt.Errorf("has %d tiles, want %d", len(tiles), want)
+	}
+	return tiles, nil
+}
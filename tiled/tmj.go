@@ -0,0 +1,226 @@
+package tiled
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+)
+
+type jsonProperty struct {
+	Name  string
+	Type  string
+	Value interface{}
+}
+
+type jsonTileset struct {
+	FirstGID    int
+	Source      string
+	Name        string
+	Image       string
+	ImageWidth  int
+	ImageHeight int
+	TileWidth   int
+	TileHeight  int
+	Columns     int
+	TileCount   int
+	Margin      int
+	Spacing     int
+}
+
+type jsonObject struct {
+	ID         int
+	Name       string
+	Type       string
+	Class      string
+	X, Y       float64
+	Width      float64
+	Height     float64
+	Point      bool
+	GID        uint32
+	Properties []jsonProperty
+}
+
+type jsonLayer struct {
+	Type        string
+	Name        string
+	Width       int
+	Height      int
+	Data        json.RawMessage // An array of tile IDs, or a string with Encoding
+	Encoding    string
+	Compression string
+	Visible     bool
+	Opacity     float64
+	OffsetX     float64
+	OffsetY     float64
+	Objects     []jsonObject
+	Layers      []jsonLayer
+	Properties  []jsonProperty
+}
+
+type jsonMap struct {
+	Width       int
+	Height      int
+	TileWidth   int
+	TileHeight  int
+	Orientation string
+	Infinite    bool
+	Tilesets    []jsonTileset
+	Layers      []jsonLayer
+	Properties  []jsonProperty
+}
+
+func jsonProperties(list []jsonProperty) Properties {
+	props := make(Properties)
+	for _, p := range list {
+		props[p.Name] = fmt.Sprint(p.Value)
+	}
+	return props
+}
+
+func decodeJSON(fsys fs.FS, name string, b []byte) (*Map, error) {
+	var jm jsonMap
+	if err := json.Unmarshal(b, &jm); err != nil {
+		return nil, err
+	}
+	if jm.Orientation != "" && jm.Orientation != "orthogonal" {
+		return nil, fmt.Errorf("%s orientation is not supported", jm.Orientation)
+	}
+	if jm.Infinite {
+		return nil, fmt.Errorf("infinite maps are not supported")
+	}
+	m := &Map{
+		Width:      jm.Width,
+		Height:     jm.Height,
+		TileWidth:  jm.TileWidth,
+		TileHeight: jm.TileHeight,
+		Properties: jsonProperties(jm.Properties),
+	}
+	for _, jt := range jm.Tilesets {
+		var ts *Tileset
+		if jt.Source != "" {
+			var err error
+			if ts, err = loadTileset(fsys, name, jt.Source, jt.FirstGID); err != nil {
+				return nil, err
+			}
+		} else {
+			ts = jt.tileset(path.Dir(name))
+			ts.FirstGID = jt.FirstGID
+			if err := ts.check(); err != nil {
+				return nil, err
+			}
+		}
+		m.Tilesets = append(m.Tilesets, ts)
+	}
+	if err := m.addJSONLayers(jm.Layers, 0, 0, 1); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (jt jsonTileset) tileset(dir string) *Tileset {
+	ts := &Tileset{
+		Name:        jt.Name,
+		ImageWidth:  jt.ImageWidth,
+		ImageHeight: jt.ImageHeight,
+		TileWidth:   jt.TileWidth,
+		TileHeight:  jt.TileHeight,
+		Columns:     jt.Columns,
+		TileCount:   jt.TileCount,
+		Margin:      jt.Margin,
+		Spacing:     jt.Spacing,
+	}
+	// Image collections have no image of their own, check rejects them
+	if jt.Image != "" {
+		ts.Image = path.Join(dir, jt.Image)
+	}
+	return ts
+}
+
+func decodeTilesetJSON(name string, b []byte) (*Tileset, error) {
+	var jt jsonTileset
+	if err := json.Unmarshal(b, &jt); err != nil {
+		return nil, err
+	}
+	ts := jt.tileset(path.Dir(name))
+	return ts, ts.check()
+}
+
+// addJSONLayers appends layers, flattening groups. A group's offset and
+// opacity carry over to the layers inside it.
+func (m *Map) addJSONLayers(layers []jsonLayer, offsetX, offsetY, opacity float64) error {
+	for _, jl := range layers {
+		if !jl.Visible {
+			continue
+		}
+		switch jl.Type {
+		case "group":
+			if err := m.addJSONLayers(jl.Layers, offsetX+jl.OffsetX, offsetY+jl.OffsetY, opacity*jl.Opacity); err != nil {
+				return err
+			}
+			continue
+		case TileLayer, ObjectLayer:
+		default:
+			// Image layers and anything newer are skipped
+			continue
+		}
+		l := &Layer{
+			Name:       jl.Name,
+			Type:       jl.Type,
+			Visible:    true,
+			Opacity:    opacity * jl.Opacity,
+			OffsetX:    offsetX + jl.OffsetX,
+			OffsetY:    offsetY + jl.OffsetY,
+			Properties: jsonProperties(jl.Properties),
+		}
+		if jl.Type == TileLayer {
+			tiles, err := jl.tiles()
+			if err != nil {
+				return fmt.Errorf("layer %s: %w", jl.Name, err)
+			}
+			if jl.Width != m.Width || jl.Height != m.Height {
+				return fmt.Errorf("layer %s: size %dx%d doesn't match the map", jl.Name, jl.Width, jl.Height)
+			}
+			l.Tiles = tiles
+		}
+		for _, jo := range jl.Objects {
+			o := &Object{
+				ID:         jo.ID,
+				Name:       jo.Name,
+				Type:       jo.Type,
+				X:          jo.X,
+				Y:          jo.Y,
+				Width:      jo.Width,
+				Height:     jo.Height,
+				Point:      jo.Point,
+				GID:        jo.GID,
+				Properties: jsonProperties(jo.Properties),
+			}
+			if o.Type == "" {
+				o.Type = jo.Class
+			}
+			l.Objects = append(l.Objects, o)
+		}
+		m.Layers = append(m.Layers, l)
+	}
+	return nil
+}
+
+func (jl jsonLayer) tiles() ([]uint32, error) {
+	want := jl.Width * jl.Height
+	if len(jl.Data) > 0 && jl.Data[0] == '"' {
+		var text string
+		if err := json.Unmarshal(jl.Data, &text); err != nil {
+			return nil, err
+		}
+		return decodeTiles(jl.Encoding, jl.Compression, text, want)
+	}
+	var tiles []uint32
+	if err := json.Unmarshal(jl.Data, &tiles); err != nil {
+		return nil, err
+	}
+	if len(tiles) != want {
+		return nil, fmt.Errorf("has %d tiles, want %d", len(tiles), want)
+	}
+	return tiles, nil
+}
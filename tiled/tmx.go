@@ -0,0 +1,256 @@
+package tiled
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+)
+
+type xmlProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+	Text  string `xml:",chardata"` // Multiline strings are stored as text
+}
+
+type xmlImage struct {
+	Source string `xml:"source,attr"`
+	Width  int    `xml:"width,attr"`
+	Height int    `xml:"height,attr"`
+}
+
+type xmlTileset struct {
+	FirstGID   int       `xml:"firstgid,attr"`
+	Source     string    `xml:"source,attr"`
+	Name       string    `xml:"name,attr"`
+	TileWidth  int       `xml:"tilewidth,attr"`
+	TileHeight int       `xml:"tileheight,attr"`
+	Spacing    int       `xml:"spacing,attr"`
+	Margin     int       `xml:"margin,attr"`
+	TileCount  int       `xml:"tilecount,attr"`
+	Columns    int       `xml:"columns,attr"`
+	Image      *xmlImage `xml:"image"`
+}
+
+type xmlData struct {
+	Encoding    string `xml:"encoding,attr"`
+	Compression string `xml:"compression,attr"`
+	Text        string `xml:",chardata"`
+	Tiles       []struct {
+		GID uint32 `xml:"gid,attr"`
+	} `xml:"tile"`
+}
+
+type xmlObject struct {
+	ID         int           `xml:"id,attr"`
+	Name       string        `xml:"name,attr"`
+	Type       string        `xml:"type,attr"`
+	Class      string        `xml:"class,attr"`
+	X          float64       `xml:"x,attr"`
+	Y          float64       `xml:"y,attr"`
+	Width      float64       `xml:"width,attr"`
+	Height     float64       `xml:"height,attr"`
+	GID        uint32        `xml:"gid,attr"`
+	Point      *struct{}     `xml:"point"`
+	Properties []xmlProperty `xml:"properties>property"`
+}
+
+// xmlLayer is any of layer, objectgroup or group, told apart by XMLName.
+// Children of groups stay in document order, which is the drawing order.
+type xmlLayer struct {
+	XMLName    xml.Name
+	Name       string        `xml:"name,attr"`
+	Width      int           `xml:"width,attr"`
+	Height     int           `xml:"height,attr"`
+	Visible    string        `xml:"visible,attr"`
+	Opacity    string        `xml:"opacity,attr"`
+	OffsetX    float64       `xml:"offsetx,attr"`
+	OffsetY    float64       `xml:"offsety,attr"`
+	Properties []xmlProperty `xml:"properties>property"`
+	Data       *xmlData      `xml:"data"`
+	Objects    []xmlObject   `xml:"object"`
+	Layers     []xmlLayer    `xml:",any"`
+}
+
+type xmlMap struct {
+	Orientation string        `xml:"orientation,attr"`
+	Width       int           `xml:"width,attr"`
+	Height      int           `xml:"height,attr"`
+	TileWidth   int           `xml:"tilewidth,attr"`
+	TileHeight  int           `xml:"tileheight,attr"`
+	Infinite    int           `xml:"infinite,attr"`
+	Properties  []xmlProperty `xml:"properties>property"`
+	Tilesets    []xmlTileset  `xml:"tileset"`
+	Layers      []xmlLayer    `xml:",any"`
+}
+
+func xmlProperties(list []xmlProperty) Properties {
+	props := make(Properties)
+	for _, p := range list {
+		if p.Value == "" {
+			p.Value = p.Text
+		}
+		props[p.Name] = p.Value
+	}
+	return props
+}
+
+func decodeXML(fsys fs.FS, name string, b []byte) (*Map, error) {
+	var xm xmlMap
+	if err := xml.Unmarshal(b, &xm); err != nil {
+		return nil, err
+	}
+	if xm.Orientation != "orthogonal" {
+		return nil, fmt.Errorf("%s orientation is not supported", xm.Orientation)
+	}
+	if xm.Infinite != 0 {
+		return nil, fmt.Errorf("infinite maps are not supported")
+	}
+	m := &Map{
+		Width:      xm.Width,
+		Height:     xm.Height,
+		TileWidth:  xm.TileWidth,
+		TileHeight: xm.TileHeight,
+		Properties: xmlProperties(xm.Properties),
+	}
+	for _, xt := range xm.Tilesets {
+		var ts *Tileset
+		if xt.Source != "" {
+			var err error
+			if ts, err = loadTileset(fsys, name, xt.Source, xt.FirstGID); err != nil {
+				return nil, err
+			}
+		} else {
+			ts = xt.tileset(path.Dir(name))
+			ts.FirstGID = xt.FirstGID
+			if err := ts.check(); err != nil {
+				return nil, err
+			}
+		}
+		m.Tilesets = append(m.Tilesets, ts)
+	}
+	if err := m.addXMLLayers(xm.Layers, 0, 0, 1); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (xt xmlTileset) tileset(dir string) *Tileset {
+	ts := &Tileset{
+		Name:       xt.Name,
+		TileWidth:  xt.TileWidth,
+		TileHeight: xt.TileHeight,
+		Columns:    xt.Columns,
+		TileCount:  xt.TileCount,
+		Margin:     xt.Margin,
+		Spacing:    xt.Spacing,
+	}
+	// Image collections have no image of their own, check rejects them
+	if xt.Image != nil {
+		ts.Image = path.Join(dir, xt.Image.Source)
+		ts.ImageWidth = xt.Image.Width
+		ts.ImageHeight = xt.Image.Height
+	}
+	return ts
+}
+
+func decodeTilesetXML(name string, b []byte) (*Tileset, error) {
+	var xt xmlTileset
+	if err := xml.Unmarshal(b, &xt); err != nil {
+		return nil, err
+	}
+	ts := xt.tileset(path.Dir(name))
+	return ts, ts.check()
+}
+
+// addXMLLayers appends layers, flattening groups. A group's offset and
+// opacity carry over to the layers inside it.
+func (m *Map) addXMLLayers(layers []xmlLayer, offsetX, offsetY, opacity float64) error {
+	for _, xl := range layers {
+		if xl.Visible == "0" {
+			continue
+		}
+		layerOpacity := 1.0
+		if xl.Opacity != "" {
+			var err error
+			if layerOpacity, err = strconv.ParseFloat(xl.Opacity, 64); err != nil {
+				return fmt.Errorf("layer %s: bad opacity %q", xl.Name, xl.Opacity)
+			}
+		}
+		var typ string
+		switch xl.XMLName.Local {
+		case "group":
+			if err := m.addXMLLayers(xl.Layers, offsetX+xl.OffsetX, offsetY+xl.OffsetY, opacity*layerOpacity); err != nil {
+				return err
+			}
+			continue
+		case "layer":
+			typ = TileLayer
+		case "objectgroup":
+			typ = ObjectLayer
+		default:
+			// Image layers, editor settings and anything newer are skipped
+			continue
+		}
+		l := &Layer{
+			Name:       xl.Name,
+			Type:       typ,
+			Visible:    true,
+			Opacity:    opacity * layerOpacity,
+			OffsetX:    offsetX + xl.OffsetX,
+			OffsetY:    offsetY + xl.OffsetY,
+			Properties: xmlProperties(xl.Properties),
+		}
+		if typ == TileLayer {
+			if xl.Width != m.Width || xl.Height != m.Height {
+				return fmt.Errorf("layer %s: size %dx%d doesn't match the map", xl.Name, xl.Width, xl.Height)
+			}
+			tiles, err := xl.tiles()
+			if err != nil {
+				return fmt.Errorf("layer %s: %w", xl.Name, err)
+			}
+			l.Tiles = tiles
+		}
+		for _, xo := range xl.Objects {
+			o := &Object{
+				ID:         xo.ID,
+				Name:       xo.Name,
+				Type:       xo.Type,
+				X:          xo.X,
+				Y:          xo.Y,
+				Width:      xo.Width,
+				Height:     xo.Height,
+				Point:      xo.Point != nil,
+				GID:        xo.GID,
+				Properties: xmlProperties(xo.Properties),
+			}
+			if o.Type == "" {
+				o.Type = xo.Class
+			}
+			l.Objects = append(l.Objects, o)
+		}
+		m.Layers = append(m.Layers, l)
+	}
+	return nil
+}
+
+func (xl xmlLayer) tiles() ([]uint32, error) {
+	want := xl.Width * xl.Height
+	if xl.Data == nil {
+		return nil, fmt.Errorf("no tile data")
+	}
+	if xl.Data.Encoding == "" {
+		// Oldest format, one <tile> element per tile
+		var tiles []uint32
+		for _, t := range xl.Data.Tiles {
+			tiles = append(tiles, t.GID)
+		}
+		if len(tiles) != want {
+			return nil, fmt.Errorf("has %d tiles, want %d", len(tiles), want)
+		}
+		return tiles, nil
+	}
+	return decodeTiles(xl.Data.Encoding, xl.Data.Compression, strings.TrimSpace(xl.Data.Text), want)
+}
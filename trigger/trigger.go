@@ -0,0 +1,204 @@
+// Package trigger decides when a scene's cutscenes start by themselves: when
+// the player walks into or out of an area, talks to an NPC, enters the scene,
+// or when a condition on the world variables becomes true.
+package trigger
+
+import (
+	"fmt"
+	"image"
+	"rpg_demo/collisions"
+	"rpg_demo/data"
+	"rpg_demo/world"
+	"strconv"
+)
+
+// Event is what makes a trigger fire.
+type Event string
+
+const (
+	Enter      Event = "enter"      // The player walks into the area
+	Exit       Event = "exit"       // The player walks out of the area
+	Interact   Event = "interact"   // The player talks to the NPC
+	SceneEntry Event = "sceneEntry" // The player arrives in the scene
+	Flag       Event = "flag"       // The condition becomes true
+)
+
+type Trigger struct {
+	ID        string
+	On        Event
+	Rect      image.Rectangle // Area for Enter and Exit
+	NPC       string          // NPC for Interact
+	Condition *world.Cond     // nil always holds
+	Cutscene  string
+	Once      bool
+}
+
+// FiredFlag is the world variable that remembers a Once trigger has fired,
+// so it stays spent across saves.
+func FiredFlag(scene, id string) string {
+	return "trigger." + scene + "." + id
+}
+
+// Set is a scene's triggers and what they have seen so far. It's built with
+// the scene, so coming back to a scene starts it afresh.
+type Set struct {
+	Scene    string
+	Triggers []*Trigger
+	regions  *collisions.Index
+	areas    []*Trigger        // Trigger for each rectangle in regions
+	inside   map[*Trigger]bool // Areas the player was in on the last Check
+	held     map[*Trigger]bool // Flag triggers whose condition held on the last Check
+	entered  bool
+	pending  []*Trigger // Fired but not played yet, a cutscene plays at a time
+}
+
+// New builds the triggers of the named scene.
+func New(scene string, list []data.TriggerData) (*Set, error) {
+	s := &Set{
+		Scene:  scene,
+		inside: make(map[*Trigger]bool),
+		held:   make(map[*Trigger]bool),
+	}
+	var rects []*image.Rectangle
+	for i, d := range list {
+		t, err := newTrigger(i, d)
+		if err != nil {
+			return nil, fmt.Errorf("trigger %d: %w", i, err)
+		}
+		s.Triggers = append(s.Triggers, t)
+		if t.On == Enter || t.On == Exit {
+			rects = append(rects, &t.Rect)
+			s.areas = append(s.areas, t)
+		}
+	}
+	s.regions = collisions.NewIndex(collisions.CellSize, rects)
+	return s, nil
+}
+
+func newTrigger(i int, d data.TriggerData) (*Trigger, error) {
+	t := &Trigger{
+		ID:       d.ID,
+		On:       Event(d.On),
+		Rect:     image.Rect(d.X1, d.Y1, d.X2, d.Y2),
+		NPC:      d.NPC,
+		Cutscene: d.Cutscene,
+		Once:     d.Once,
+	}
+	if t.ID == "" {
+		t.ID = strconv.Itoa(i)
+	}
+	if t.On == "" {
+		t.On = Enter
+	}
+	if t.Cutscene == "" {
+		return nil, fmt.Errorf("no cutscene")
+	}
+	switch t.On {
+	case Enter, Exit:
+		if t.Rect.Empty() {
+			return nil, fmt.Errorf("no area")
+		}
+	case Interact:
+		if t.NPC == "" {
+			return nil, fmt.Errorf("no NPC to interact with")
+		}
+	case SceneEntry:
+	case Flag:
+		if d.Condition == "" {
+			return nil, fmt.Errorf("no condition")
+		}
+	default:
+		return nil, fmt.Errorf("unknown event %q", d.On)
+	}
+	if d.Condition != "" {
+		cond, err := world.Parse(d.Condition)
+		if err != nil {
+			return nil, err
+		}
+		t.Condition = cond
+	}
+	return t, nil
+}
+
+// Check looks at where the player is and at the world variables, and returns
+// a trigger whose cutscene should play now, or nil. Triggers that fire
+// together are returned one per call, in the order they fired.
+func (s *Set) Check(player image.Rectangle, vars *world.Vars) *Trigger {
+	if !s.entered {
+		s.entered = true
+		for _, t := range s.Triggers {
+			if t.On == SceneEntry {
+				s.fire(t, vars)
+			}
+		}
+	}
+
+	in := s.regions.All(player)
+	for i, t := range s.areas {
+		now := false
+		for _, j := range in {
+			if j == i {
+				now = true
+			}
+		}
+		if now && !s.inside[t] && t.On == Enter || !now && s.inside[t] && t.On == Exit {
+			s.fire(t, vars)
+		}
+		s.inside[t] = now
+	}
+
+	for _, t := range s.Triggers {
+		if t.On != Flag {
+			continue
+		}
+		holds := t.Condition.Holds(vars)
+		if holds && !s.held[t] {
+			s.fire(t, vars)
+		}
+		s.held[t] = holds
+	}
+
+	for len(s.pending) > 0 {
+		t := s.pending[0]
+		s.pending = s.pending[1:]
+		// An earlier cutscene may have changed the world since it fired
+		if s.ready(t, vars) {
+			s.spend(t, vars)
+			return t
+		}
+	}
+	return nil
+}
+
+// Interact returns the trigger for talking to the named NPC, or nil if
+// talking to them should just start the conversation.
+func (s *Set) Interact(npc string, vars *world.Vars) *Trigger {
+	for _, t := range s.Triggers {
+		if t.On == Interact && t.NPC == npc && s.ready(t, vars) {
+			s.spend(t, vars)
+			return t
+		}
+	}
+	return nil
+}
+
+func (s *Set) fire(t *Trigger, vars *world.Vars) {
+	if s.ready(t, vars) {
+		s.pending = append(s.pending, t)
+	}
+}
+
+// ready reports whether t may fire: its condition holds and, if it only fires
+// once, it hasn't yet.
+func (s *Set) ready(t *Trigger, vars *world.Vars) bool {
+	if t.Once && vars.Bool(FiredFlag(s.Scene, t.ID)) {
+		return false
+	}
+	return t.Condition.Holds(vars)
+}
+
+func (s *Set) spend(t *Trigger, vars *world.Vars) {
+	if t.Once {
+		vars.SetBool(FiredFlag(s.Scene, t.ID), true)
+	}
+}
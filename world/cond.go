@@ -0,0 +1,339 @@
+package world
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Cond is a parsed condition such as `talkedToBryan && coins >= 3`.
+//
+// Conditions support variable names, whole numbers, "strings", true and false,
+// the comparisons == != < <= > >=, and !, && and || with parentheses.
+// A variable on its own is true when it is set to true, a non-zero number or a
+// non-empty string.
+type Cond struct {
+	Source   string
+	root     expr
+	reported bool // Holds has logged an error, it only does once
+}
+
+// Parse compiles a condition. An empty source is a condition that always holds.
+func Parse(src string) (*Cond, error) {
+	c := &Cond{Source: src}
+	if strings.TrimSpace(src) == "" {
+		c.root = literal{BoolValue(true)}
+		return c, nil
+	}
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, fmt.Errorf("condition %q: %w", src, err)
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.or()
+	if err == nil && !p.done() {
+		err = fmt.Errorf("unexpected %q", p.peek().text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("condition %q: %w", src, err)
+	}
+	c.root = root
+	return c, nil
+}
+
+// Eval reports whether the condition holds for vars.
+func (c *Cond) Eval(vars *Vars) (bool, error) {
+	v, err := c.root.eval(vars)
+	if err != nil {
+		return false, fmt.Errorf("condition %q: %w", c.Source, err)
+	}
+	return v.Truthy(), nil
+}
+
+// Holds is Eval for callers that treat a broken condition as false. The error
+// is logged the first time, conditions are checked every tick.
+// A nil condition always holds.
+func (c *Cond) Holds(vars *Vars) bool {
+	if c == nil {
+		return true
+	}
+	ok, err := c.Eval(vars)
+	if err != nil && !c.reported {
+		log.Println(err)
+		c.reported = true
+	}
+	return ok
+}
+
+func (c *Cond) String() string {
+	return c.Source
+}
+
+type expr interface {
+	eval(*Vars) (Value, error)
+}
+
+type literal struct{ v Value }
+
+func (l literal) eval(*Vars) (Value, error) { return l.v, nil }
+
+type variable struct{ name string }
+
+func (v variable) eval(vars *Vars) (Value, error) { return vars.Get(v.name), nil }
+
+type not struct{ x expr }
+
+func (n not) eval(vars *Vars) (Value, error) {
+	v, err := n.x.eval(vars)
+	if err != nil {
+		return Value{}, err
+	}
+	return BoolValue(!v.Truthy()), nil
+}
+
+type logical struct {
+	op   string
+	l, r expr
+}
+
+func (e logical) eval(vars *Vars) (Value, error) {
+	l, err := e.l.eval(vars)
+	if err != nil {
+		return Value{}, err
+	}
+	// Short circuit like Go does
+	if e.op == "&&" && !l.Truthy() || e.op == "||" && l.Truthy() {
+		return BoolValue(l.Truthy()), nil
+	}
+	r, err := e.r.eval(vars)
+	if err != nil {
+		return Value{}, err
+	}
+	return BoolValue(r.Truthy()), nil
+}
+
+type compare struct {
+	op   string
+	l, r expr
+}
+
+func (e compare) eval(vars *Vars) (Value, error) {
+	l, err := e.l.eval(vars)
+	if err != nil {
+		return Value{}, err
+	}
+	r, err := e.r.eval(vars)
+	if err != nil {
+		return Value{}, err
+	}
+	// An unset variable takes the zero value of whatever it's compared with
+	if l.Kind == Unset {
+		l.Kind = r.Kind
+	}
+	if r.Kind == Unset {
+		r.Kind = l.Kind
+	}
+	if l.Kind != r.Kind {
+		return Value{}, fmt.Errorf("can't compare %s with %s", l, r)
+	}
+	var cmp int
+	switch l.Kind {
+	case Int:
+		// Not l.I - r.I, that overflows for numbers far apart
+		if l.I < r.I {
+			cmp = -1
+		} else if l.I > r.I {
+			cmp = 1
+		}
+	case String:
+		cmp = strings.Compare(l.S, r.S)
+	default:
+		if e.op != "==" && e.op != "!=" {
+			return Value{}, fmt.Errorf("%s only works on numbers and strings", e.op)
+		}
+		if l.B != r.B {
+			cmp = 1
+		}
+	}
+	switch e.op {
+	case "==":
+		return BoolValue(cmp == 0), nil
+	case "!=":
+		return BoolValue(cmp != 0), nil
+	case "<":
+		return BoolValue(cmp < 0), nil
+	case "<=":
+		return BoolValue(cmp <= 0), nil
+	case ">":
+		return BoolValue(cmp > 0), nil
+	default:
+		return BoolValue(cmp >= 0), nil
+	}
+}
+
+type tokenKind int
+
+const (
+	tokIdent tokenKind = iota
+	tokNumber
+	tokString
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+var operators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")"}
+
+func tokenize(src string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(src); {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"':
+			end := strings.IndexByte(src[i+1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, token{tokString, src[i+1 : i+1+end]})
+			i += end + 2
+		case unicode.IsDigit(c) || c == '-' && i+1 < len(src) && unicode.IsDigit(rune(src[i+1])):
+			j := i + 1
+			for j < len(src) && unicode.IsDigit(rune(src[j])) {
+				j++
+			}
+			tokens = append(tokens, token{tokNumber, src[i:j]})
+			i = j
+		case isIdentChar(c):
+			j := i
+			for j < len(src) && isIdentChar(rune(src[j])) {
+				j++
+			}
+			tokens = append(tokens, token{tokIdent, src[i:j]})
+			i = j
+		default:
+			matched := false
+			for _, op := range operators {
+				if strings.HasPrefix(src[i:], op) {
+					tokens = append(tokens, token{tokOp, op})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected character %q", c)
+			}
+		}
+	}
+	return tokens, nil
+}
+
+func isIdentChar(c rune) bool {
+	return unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_' || c == '.'
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) done() bool { return p.pos >= len(p.tokens) }
+
+func (p *parser) peek() token {
+	if p.done() {
+		return token{kind: tokOp, text: "end of condition"}
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *parser) accept(op string) bool {
+	if !p.done() && p.tokens[p.pos].kind == tokOp && p.tokens[p.pos].text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) or() (expr, error) {
+	l, err := p.and()
+	for err == nil && p.accept("||") {
+		var r expr
+		r, err = p.and()
+		l = logical{"||", l, r}
+	}
+	return l, err
+}
+
+func (p *parser) and() (expr, error) {
+	l, err := p.unary()
+	for err == nil && p.accept("&&") {
+		var r expr
+		r, err = p.unary()
+		l = logical{"&&", l, r}
+	}
+	return l, err
+}
+
+func (p *parser) unary() (expr, error) {
+	if p.accept("!") {
+		x, err := p.unary()
+		return not{x}, err
+	}
+	return p.comparison()
+}
+
+func (p *parser) comparison() (expr, error) {
+	l, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if p.accept(op) {
+			r, err := p.primary()
+			return compare{op, l, r}, err
+		}
+	}
+	return l, nil
+}
+
+func (p *parser) primary() (expr, error) {
+	if p.accept("(") {
+		x, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, fmt.Errorf("expected ) but got %q", p.peek().text)
+		}
+		return x, nil
+	}
+	t := p.peek()
+	if p.done() || t.kind == tokOp {
+		return nil, fmt.Errorf("expected a value but got %q", t.text)
+	}
+	p.pos++
+	switch t.kind {
+	case tokNumber:
+		n, err := strconv.Atoi(t.text)
+		if err != nil {
+			return nil, err
+		}
+		return literal{IntValue(n)}, nil
+	case tokString:
+		return literal{StringValue(t.text)}, nil
+	}
+	switch t.text {
+	case "true":
+		return literal{BoolValue(true)}, nil
+	case "false":
+		return literal{BoolValue(false)}, nil
+	}
+	return variable{t.text}, nil
+}
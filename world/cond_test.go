@@ -0,0 +1,120 @@
+package world
+
+import (
+	"bytes"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"testing"
+)
+
+func testVars() *Vars {
+	v := New()
+	v.SetBool("met", true)
+	v.SetBool("left", false)
+	v.SetInt("coins", 3)
+	v.SetInt("big", math.MaxInt)
+	v.SetInt("small", math.MinInt)
+	v.SetString("name", "Bryan")
+	return v
+}
+
+func TestCondEval(t *testing.T) {
+	vars := testVars()
+	for _, c := range []struct {
+		src  string
+		want bool
+	}{
+		{"", true},
+		{"met", true},
+		{"coins >= 3 && name == \"Bryan\"", true},
+		{"coins < -1", false},
+
+		// && binds tighter than ||, ! tighter than &&
+		{"true || false && false", true},
+		{"(true || false) && false", false},
+		{"!left && met", true},
+		{"!(met && left) || false", true},
+
+		// The right side isn't looked at once the left decides
+		{"left && coins < \"many\"", false},
+		{"met || coins < \"many\"", true},
+
+		// Unset variables read as false, 0 or "" depending on the other side
+		{"missing", false},
+		{"!missing", true},
+		{"missing == 0", true},
+		{"missing < 1", true},
+		{"missing == \"\"", true},
+		{"missing == false", true},
+		{"missing == other", true},
+
+		// Numbers far apart compare without overflowing
+		{"big > small", true},
+		{"small < big", true},
+		{"big > -1", true},
+		{"small < 1", true},
+	} {
+		cond, err := Parse(c.src)
+		if err != nil {
+			t.Errorf("%s: %s", c.src, err)
+			continue
+		}
+		got, err := cond.Eval(vars)
+		if err != nil {
+			t.Errorf("%s: %s", c.src, err)
+		} else if got != c.want {
+			t.Errorf("%s = %v, want %v", c.src, got, c.want)
+		}
+	}
+}
+
+func TestCondErrors(t *testing.T) {
+	vars := testVars()
+	for _, c := range []struct {
+		src  string
+		want string
+	}{
+		{"coins == \"3\"", "can't compare"},
+		{"met && coins < \"many\"", "can't compare"},
+		{"met < left", "only works on numbers and strings"},
+	} {
+		cond, err := Parse(c.src)
+		if err != nil {
+			t.Errorf("%s: %s", c.src, err)
+			continue
+		}
+		if _, err := cond.Eval(vars); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: got %v, want an error with %q", c.src, err, c.want)
+		}
+	}
+	for _, src := range []string{"coins >", "(met", "met met", "\"open", "coins = 3", "&& met"} {
+		if _, err := Parse(src); err == nil {
+			t.Errorf("%s: parsed", src)
+		}
+	}
+}
+
+func TestHoldsReportsOnce(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	cond, err := Parse("coins == \"3\"")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := testVars()
+	for i := 0; i < 3; i++ {
+		if cond.Holds(vars) {
+			t.Fatal("a broken condition holds")
+		}
+	}
+	if n := strings.Count(buf.String(), "can't compare"); n != 1 {
+		t.Errorf("logged %d times:\n%s", n, buf.String())
+	}
+	var none *Cond
+	if !none.Holds(vars) {
+		t.Errorf("a nil condition doesn't hold")
+	}
+}
@@ -0,0 +1,163 @@
+package world
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type Kind int
+
+const (
+	Unset Kind = iota
+	Bool
+	Int
+	String
+)
+
+// Value is a single typed variable. The zero Value is Unset, which reads as
+// false, 0 or "" depending on what it is compared with.
+type Value struct {
+	Kind Kind
+	B    bool
+	I    int
+	S    string
+}
+
+func BoolValue(b bool) Value     { return Value{Kind: Bool, B: b} }
+func IntValue(i int) Value       { return Value{Kind: Int, I: i} }
+func StringValue(s string) Value { return Value{Kind: String, S: s} }
+
+// Truthy is how a value reads when used on its own in a condition.
+func (v Value) Truthy() bool {
+	switch v.Kind {
+	case Bool:
+		return v.B
+	case Int:
+		return v.I != 0
+	case String:
+		return v.S != ""
+	}
+	return false
+}
+
+func (v Value) String() string {
+	switch v.Kind {
+	case Bool:
+		return strconv.FormatBool(v.B)
+	case Int:
+		return strconv.Itoa(v.I)
+	case String:
+		return strconv.Quote(v.S)
+	}
+	return "<unset>"
+}
+
+func (v Value) MarshalJSON() ([]byte, error) {
+	switch v.Kind {
+	case Bool:
+		return json.Marshal(v.B)
+	case Int:
+		return json.Marshal(v.I)
+	case String:
+		return json.Marshal(v.S)
+	}
+	return []byte("null"), nil
+}
+
+func (v *Value) UnmarshalJSON(b []byte) error {
+	var raw interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	value, err := ValueOf(raw)
+	if err != nil {
+		return err
+	}
+	*v = value
+	return nil
+}
+
+// ValueOf converts a decoded JSON value into a Value. Numbers must be whole.
+func ValueOf(raw interface{}) (Value, error) {
+	switch t := raw.(type) {
+	case nil:
+		return Value{}, nil
+	case bool:
+		return BoolValue(t), nil
+	case float64:
+		if t != float64(int(t)) {
+			return Value{}, fmt.Errorf("variable values must be whole numbers, got %v", t)
+		}
+		return IntValue(int(t)), nil
+	case string:
+		return StringValue(t), nil
+	}
+	return Value{}, fmt.Errorf("unsupported variable value %v (%T)", raw, raw)
+}
+
+// Vars is the game-wide store of flags and variables.
+type Vars struct {
+	values map[string]Value
+}
+
+func New() *Vars {
+	return &Vars{values: make(map[string]Value)}
+}
+
+// Get returns a variable's value. A nil *Vars reads every variable as unset.
+func (v *Vars) Get(name string) Value {
+	if v == nil {
+		return Value{}
+	}
+	return v.values[name]
+}
+
+func (v *Vars) Set(name string, value Value) {
+	if value.Kind == Unset {
+		delete(v.values, name)
+		return
+	}
+	v.values[name] = value
+}
+
+func (v *Vars) SetBool(name string, b bool)     { v.Set(name, BoolValue(b)) }
+func (v *Vars) SetInt(name string, i int)       { v.Set(name, IntValue(i)) }
+func (v *Vars) SetString(name string, s string) { v.Set(name, StringValue(s)) }
+
+func (v *Vars) Bool(name string) bool     { return v.Get(name).Truthy() }
+func (v *Vars) Int(name string) int       { return v.Get(name).I }
+func (v *Vars) String(name string) string { return v.Get(name).S }
+
+// All returns a copy of every variable, for saving.
+func (v *Vars) All() map[string]Value {
+	all := make(map[string]Value, len(v.values))
+	for name, value := range v.values {
+		all[name] = value
+	}
+	return all
+}
+
+// Replace throws away every variable and loads values instead.
+func (v *Vars) Replace(values map[string]Value) {
+	v.values = make(map[string]Value, len(values))
+	for name, value := range values {
+		v.Set(name, value)
+	}
+}
+
+// Dump lists every variable, one "name = value" per line in name order.
+func (v *Vars) Dump() string {
+	names := make([]string, 0, len(v.values))
+	for name := range v.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s = %s\n", name, v.values[name])
+	}
+	return b.String()
+}